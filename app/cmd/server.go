@@ -12,8 +12,10 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -42,6 +44,17 @@ import (
 
 const (
 	defaultListenAddr = ":443"
+
+	// shutdownTimeout 退出时提交剩余流量的最长等待时间
+	shutdownTimeout = 10 * time.Second
+
+	// remoteConfMinRestartInterval 远程配置变化导致的两次重启之间的最短间隔
+	remoteConfMinRestartInterval = 5 * time.Minute
+
+	// 流量统计接口的默认超时，防止慢速客户端长期占用连接
+	defaultTrafficStatsReadTimeout    = 30 * time.Second
+	defaultTrafficStatsWriteTimeout   = 60 * time.Second
+	defaultTrafficStatsRequestTimeout = 30 * time.Second
 )
 
 var serverCmd = &cobra.Command{
@@ -79,6 +92,74 @@ type v2raysocksConfig struct {
 	ApiHost string `mapstructure:"apiHost"`
 	ApiKey  string `mapstructure:"apiKey"`
 	NodeID  uint   `mapstructure:"nodeID"`
+	// Jitter 为各定时任务间隔的随机浮动比例（0~1）
+	Jitter float64 `mapstructure:"jitter"`
+	// NumberFormat 提交流量时数值的编码方式：int64（默认）、uint64 或 string
+	NumberFormat string `mapstructure:"numberFormat"`
+	// IDPrefix 提交给面板的用户 ID 前缀，用于多集群共用一个面板，默认不加前缀
+	IDPrefix string `mapstructure:"idPrefix"`
+	// NodeName 节点名称，附加到提交的系统状态和流量中，用于多个节点提交到同一地址时区分来源，默认不附加
+	NodeName string `mapstructure:"nodeName"`
+	// SlowPushThreshold 流量提交耗时超过该值时记录警告日志，为 0 时不记录
+	SlowPushThreshold time.Duration `mapstructure:"slowPushThreshold"`
+	// PercentPrecision 提交系统状态时使用率保留的小数位数，默认为 0
+	PercentPrecision int `mapstructure:"percentPrecision"`
+	// CPUWarmup 启动后多久内提交系统状态时先等待，避免首个 CPU 使用率采样区间过短而失真，默认不等待
+	CPUWarmup time.Duration `mapstructure:"cpuWarmup"`
+	// DisableSystemStatus 完全关闭系统状态监控（不读取 CPU、内存等信息，也不提交），只提交流量
+	DisableSystemStatus bool `mapstructure:"disableSystemStatus"`
+	// ConnCountInterval 提交系统状态时附带连接数的采样间隔，枚举连接开销较大，应明显长于提交间隔；为 0 时不统计
+	ConnCountInterval time.Duration `mapstructure:"connCountInterval"`
+	// CPUThreshold、MemThreshold、DiskThreshold 系统状态使用率（百分比）的告警阈值，
+	// 采集系统状态时超过阈值即在本地记录警告日志，不依赖面板；为 0 时不检查
+	CPUThreshold  float64 `mapstructure:"cpuThreshold"`
+	MemThreshold  float64 `mapstructure:"memThreshold"`
+	DiskThreshold float64 `mapstructure:"diskThreshold"`
+	// StaleMetricsThreshold 系统状态连续多少次完全相同时记录警告日志（指标来源可能返回缓存的旧值），为 0 时不检测；
+	// StaleMetricsRefresh 告警后立即重新采集一次
+	StaleMetricsThreshold int  `mapstructure:"staleMetricsThreshold"`
+	StaleMetricsRefresh   bool `mapstructure:"staleMetricsRefresh"`
+	// RequireAck 要求面板在响应中确认每次流量提交，未确认的流量保留到下次重试
+	RequireAck bool `mapstructure:"requireAck"`
+	// PartialAccept 按面板提交响应中的 accepted 列表只清除被接受的用户的流量，其余保留到下次重试
+	PartialAccept bool `mapstructure:"partialAccept"`
+	// MaxPushSize 单次提交流量数据的最大字节数，超过时自动分批提交，为 0 时不限制
+	MaxPushSize int `mapstructure:"maxPushSize"`
+	// SortedPush 提交前将流量数据按用户 ID 排序，使请求体保持稳定
+	SortedPush bool `mapstructure:"sortedPush"`
+	// PushLimits 提交流量时附带各用户的限速（st）和设备数限制（dt），便于面板核对
+	PushLimits bool `mapstructure:"pushLimits"`
+	// UnknownUsers 提交时对已不在用户列表中的用户的处理方式：send（默认）、drop 或 bucket
+	UnknownUsers string `mapstructure:"unknownUsers"`
+	// UnknownUserBucket UnknownUsers 为 bucket 时合并提交使用的用户 ID
+	UnknownUserBucket int64 `mapstructure:"unknownUserBucket"`
+	// PushMode 提交流量的方式：delta（默认，提交增量）或 cumulative（提交累计值，由面板计算增量）
+	PushMode string `mapstructure:"pushMode"`
+	// Granularity 提交流量的计量粒度（字节），如 1048576 表示按整 MB 提交，不足部分计入下次提交；为 0 时按字节提交
+	Granularity uint64 `mapstructure:"granularity"`
+	// MaxEntryValue 单次提交中每个用户上传、下载流量的最大值（字节），超出部分在之后的提交中提交；为 0 时不限制
+	MaxEntryValue uint64 `mapstructure:"maxEntryValue"`
+	// UsersKey 面板响应中用户列表的字段名，默认为 users；面板直接返回数组时自动识别
+	UsersKey string `mapstructure:"usersKey"`
+	// AllowEmpty 允许面板返回空用户列表时清空当前用户，默认视为面板故障并保留当前用户
+	AllowEmpty bool `mapstructure:"allowEmpty"`
+	// MaxShrink 单次更新允许减少的用户比例（0~1），超过时保留当前用户，为 0 时不限制
+	MaxShrink float64 `mapstructure:"maxShrink"`
+	// StartupWait 用户列表首次加载完成前的认证最多等待的时长，为 0 时直接拒绝
+	StartupWait time.Duration `mapstructure:"startupWait"`
+	// CaseSensitiveUUID 按面板返回的原样匹配 UUID，默认忽略大小写和首尾空白
+	CaseSensitiveUUID bool `mapstructure:"caseSensitiveUUID"`
+	// Insecure 跳过面板 TLS 证书校验，仅用于自签名证书的测试环境，存在中间人攻击风险
+	Insecure bool `mapstructure:"insecure"`
+	// Headers 附加到面板请求的请求头（如 API 令牌），面板重定向到其他主机时不会附加
+	Headers map[string]string `mapstructure:"headers"`
+	// RedirectHosts 面板重定向到这些主机时仍附加 Headers
+	RedirectHosts []string `mapstructure:"redirectHosts"`
+}
+
+// apiURL 返回指定 act 的面板接口地址
+func (c *v2raysocksConfig) apiURL(act string) string {
+	return fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=%s", c.ApiHost, c.ApiKey, c.NodeID, act)
 }
 
 type serverConfigObfsSalamander struct {
@@ -151,12 +232,23 @@ type serverConfigAuthHTTP struct {
 	Insecure bool   `mapstructure:"insecure"`
 }
 
+type serverConfigAuthStaticUser struct {
+	ID          int    `mapstructure:"id"`
+	UUID        string `mapstructure:"uuid"`
+	DeviceLimit int    `mapstructure:"dt"`
+	SpeedLimit  int    `mapstructure:"st"`
+	Group       string `mapstructure:"group"`
+}
+
 type serverConfigAuth struct {
-	Type     string               `mapstructure:"type"`
-	Password string               `mapstructure:"password"`
-	UserPass map[string]string    `mapstructure:"userpass"`
-	HTTP     serverConfigAuthHTTP `mapstructure:"http"`
-	Command  string               `mapstructure:"command"`
+	Type     string                       `mapstructure:"type"`
+	Password string                       `mapstructure:"password"`
+	UserPass map[string]string            `mapstructure:"userpass"`
+	HTTP     serverConfigAuthHTTP         `mapstructure:"http"`
+	Command  string                       `mapstructure:"command"`
+	Static   []serverConfigAuthStaticUser `mapstructure:"static"`
+	// StaticFile 为用户列表文件，收到 SIGHUP 时重新加载
+	StaticFile string `mapstructure:"staticFile"`
 }
 
 type serverConfigResolverTCP struct {
@@ -233,9 +325,62 @@ type serverConfigOutboundEntry struct {
 	HTTP   serverConfigOutboundHTTP   `mapstructure:"http"`
 }
 
+type serverConfigTrafficStatsBroker struct {
+	Type     string `mapstructure:"type"`
+	Addr     string `mapstructure:"addr"`
+	Subject  string `mapstructure:"subject"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	PerEntry bool   `mapstructure:"perEntry"`
+	Required bool   `mapstructure:"required"`
+}
+
+type serverConfigTrafficStatsInfluxDB struct {
+	URL         string            `mapstructure:"url"`
+	Token       string            `mapstructure:"token"`
+	Measurement string            `mapstructure:"measurement"`
+	Tags        map[string]string `mapstructure:"tags"`
+	Required    bool              `mapstructure:"required"`
+}
+
+type serverConfigTrafficStatsBacklog struct {
+	Mode         string        `mapstructure:"mode"`
+	MaxFailures  int           `mapstructure:"maxFailures"`
+	MaxDuration  time.Duration `mapstructure:"maxDuration"`
+	MaxUsers     int           `mapstructure:"maxUsers"`
+	SpillFile    string        `mapstructure:"spillFile"`
+	MaxSpillSize int64         `mapstructure:"maxSpillSize"`
+	MaxSpillAge  time.Duration `mapstructure:"maxSpillAge"`
+}
+
 type serverConfigTrafficStats struct {
-	Listen string `mapstructure:"listen"`
-	Secret string `mapstructure:"secret"`
+	Listen                 string                           `mapstructure:"listen"`
+	Secret                 string                           `mapstructure:"secret"`
+	MaxConcurrentRequests  int                              `mapstructure:"maxConcurrentRequests"`
+	KickTTL                time.Duration                    `mapstructure:"kickTTL"`
+	DisableSecurityHeaders bool                             `mapstructure:"disableSecurityHeaders"`
+	ReconnectGrace         time.Duration                    `mapstructure:"reconnectGrace"`
+	QuerySignature         bool                             `mapstructure:"querySignature"`
+	QuerySignatureMaxAge   time.Duration                    `mapstructure:"querySignatureMaxAge"`
+	ReplayWindow           time.Duration                    `mapstructure:"replayWindow"`
+	PushConcurrency        int                              `mapstructure:"pushConcurrency"`
+	SessionTime            string                           `mapstructure:"sessionTime"`
+	PushSessionTime        bool                             `mapstructure:"pushSessionTime"`
+	IdleTimeout            time.Duration                    `mapstructure:"idleTimeout"`
+	KickMarksOffline       bool                             `mapstructure:"kickMarksOffline"`
+	FleetMaxNodes          int                              `mapstructure:"fleetMaxNodes"`
+	ClientInfo             bool                             `mapstructure:"clientInfo"`
+	IndexPath              string                           `mapstructure:"indexPath"`
+	EmptyPathAsIndex       bool                             `mapstructure:"emptyPathAsIndex"`
+	BufferInterval         time.Duration                    `mapstructure:"bufferInterval"`
+	Shards                 int                              `mapstructure:"shards"`
+	TrustedProxies         []string                         `mapstructure:"trustedProxies"`
+	ReadTimeout            time.Duration                    `mapstructure:"readTimeout"`
+	WriteTimeout           time.Duration                    `mapstructure:"writeTimeout"`
+	RequestTimeout         time.Duration                    `mapstructure:"requestTimeout"`
+	Backlog                serverConfigTrafficStatsBacklog  `mapstructure:"backlog"`
+	InfluxDB               serverConfigTrafficStatsInfluxDB `mapstructure:"influxdb"`
+	Broker                 serverConfigTrafficStatsBroker   `mapstructure:"broker"`
 }
 
 type serverConfigMasqueradeFile struct {
@@ -773,6 +918,39 @@ func (c *serverConfig) fillAuthenticator(hyConfig *server.Config) error {
 		}
 		hyConfig.Authenticator = &auth.CommandAuthenticator{Cmd: c.Auth.Command}
 		return nil
+	case "static":
+		if c.Auth.StaticFile != "" {
+			a, err := auth.NewStaticAuthenticatorFromFile(c.Auth.StaticFile)
+			if err != nil {
+				return configError{Field: "auth.staticFile", Err: err}
+			}
+			a.OnReject = logAuthReject
+			hyConfig.Authenticator = a
+			return nil
+		}
+		if len(c.Auth.Static) == 0 {
+			return configError{Field: "auth.static", Err: errors.New("empty auth static users")}
+		}
+		users := make([]auth.User, 0, len(c.Auth.Static))
+		for i, u := range c.Auth.Static {
+			if u.UUID == "" {
+				return configError{Field: fmt.Sprintf("auth.static[%d].uuid", i), Err: errors.New("empty uuid")}
+			}
+			if u.ID <= 0 {
+				return configError{Field: fmt.Sprintf("auth.static[%d].id", i), Err: errors.New("id must be positive")}
+			}
+			users = append(users, auth.User{
+				ID:          u.ID,
+				UUID:        u.UUID,
+				DeviceLimit: u.DeviceLimit,
+				SpeedLimit:  u.SpeedLimit,
+				Group:       u.Group,
+			})
+		}
+		a := auth.NewStaticAuthenticator(users)
+		a.OnReject = logAuthReject
+		hyConfig.Authenticator = a
+		return nil
 	case "v2raysocks":
 		// 定时获取用户列表并储存
 		// 判断URL是否存在
@@ -781,7 +959,32 @@ func (c *serverConfig) fillAuthenticator(hyConfig *server.Config) error {
 			return configError{Field: "auth.v2raysocks", Err: errors.New("v2raysocks config error")}
 		}
 		// 创建定时更新用户UUID协程
-		hyConfig.Authenticator = &auth.V2RaySocksApiProvider{URL: fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=user", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID)}
+		provider := &auth.V2RaySocksApiProvider{
+			URL:        v2raysocksConfig.apiURL("user"),
+			Jitter:     v2raysocksConfig.Jitter,
+			UsersKey:   v2raysocksConfig.UsersKey,
+			AllowEmpty: v2raysocksConfig.AllowEmpty,
+			MaxShrink:  v2raysocksConfig.MaxShrink,
+			OnReject:   logAuthReject,
+
+			StartupWait:        v2raysocksConfig.StartupWait,
+			InsecureSkipVerify: v2raysocksConfig.Insecure,
+			CaseSensitiveUUID:  v2raysocksConfig.CaseSensitiveUUID,
+			RedirectHosts:      v2raysocksConfig.RedirectHosts,
+		}
+		for k, val := range v2raysocksConfig.Headers {
+			if provider.Header == nil {
+				provider.Header = make(http.Header)
+			}
+			provider.Header.Set(k, val)
+		}
+		if err := provider.Validate(); err != nil {
+			return configError{Field: "v2raysocks", Err: err}
+		}
+		if v2raysocksConfig.Insecure {
+			logger.Warn("TLS certificate verification for the v2raysocks panel is DISABLED, connections to the panel are open to man-in-the-middle attacks", zap.String("apiHost", v2raysocksConfig.ApiHost))
+		}
+		hyConfig.Authenticator = provider
 
 		return nil
 
@@ -790,26 +993,171 @@ func (c *serverConfig) fillAuthenticator(hyConfig *server.Config) error {
 	}
 }
 
+// logAuthReject 记录认证失败的原因
+func logAuthReject(addr net.Addr, reason auth.RejectReason) {
+	if reason == auth.RejectNotLoaded {
+		// 启动后面板用户列表尚未加载成功，所有认证都会失败，需要让运维看到
+		logger.Warn("authentication rejected, user list is not loaded yet", zap.String("addr", addr.String()))
+		return
+	}
+	logger.Debug("authentication rejected", zap.String("addr", addr.String()), zap.String("reason", string(reason)))
+}
+
 func (c *serverConfig) fillEventLogger(hyConfig *server.Config) error {
 	hyConfig.EventLogger = &serverLogger{}
 	return nil
 }
 
 func (c *serverConfig) fillTrafficLogger(hyConfig *server.Config) error {
+	provider, _ := hyConfig.Authenticator.(*auth.V2RaySocksApiProvider)
+	hasV2RaySocks := c.V2RaySocks != nil && c.V2RaySocks.ApiHost != ""
 	if c.TrafficStats.Listen != "" {
-		tss := trafficlogger.NewTrafficStatsServer(c.TrafficStats.Secret)
+		sessionTime, err := trafficlogger.ParseSessionTimeMode(c.TrafficStats.SessionTime)
+		if err != nil {
+			return configError{Field: "trafficStats.sessionTime", Err: err}
+		}
+		backlogMode, err := trafficlogger.ParseBacklogMode(c.TrafficStats.Backlog.Mode)
+		if err != nil {
+			return configError{Field: "trafficStats.backlog.mode", Err: err}
+		}
+		trustedProxies, err := eUtils.ParseTrustedProxies(c.TrafficStats.TrustedProxies)
+		if err != nil {
+			return configError{Field: "trafficStats.trustedProxies", Err: err}
+		}
+		opts := []trafficlogger.Option{
+			trafficlogger.WithSecret(c.TrafficStats.Secret),
+			trafficlogger.WithMaxConcurrentRequests(c.TrafficStats.MaxConcurrentRequests),
+			trafficlogger.WithKickTTL(c.TrafficStats.KickTTL),
+			trafficlogger.WithSecurityHeaders(!c.TrafficStats.DisableSecurityHeaders),
+			trafficlogger.WithReconnectGrace(c.TrafficStats.ReconnectGrace),
+			trafficlogger.WithQuerySignature(c.TrafficStats.QuerySignature),
+			trafficlogger.WithQuerySignatureMaxAge(c.TrafficStats.QuerySignatureMaxAge),
+			trafficlogger.WithReplayProtection(c.TrafficStats.ReplayWindow),
+			trafficlogger.WithPushConcurrency(c.TrafficStats.PushConcurrency),
+			trafficlogger.WithSessionTime(sessionTime, c.TrafficStats.PushSessionTime),
+			trafficlogger.WithIdleTimeout(c.TrafficStats.IdleTimeout),
+			trafficlogger.WithKickMarksOffline(c.TrafficStats.KickMarksOffline),
+			trafficlogger.WithFleetCollector(c.TrafficStats.FleetMaxNodes),
+			trafficlogger.WithIndexPath(c.TrafficStats.IndexPath, c.TrafficStats.EmptyPathAsIndex),
+			trafficlogger.WithTrustedProxies(trustedProxies),
+			trafficlogger.WithRequestTimeout(durationOrDefault(c.TrafficStats.RequestTimeout, defaultTrafficStatsRequestTimeout)),
+			trafficlogger.WithTrafficShards(c.TrafficStats.Shards),
+			trafficlogger.WithTrafficBuffer(c.TrafficStats.BufferInterval),
+			trafficlogger.WithBacklogPolicy(trafficlogger.BacklogPolicy{
+				Mode:         backlogMode,
+				MaxFailures:  c.TrafficStats.Backlog.MaxFailures,
+				MaxDuration:  c.TrafficStats.Backlog.MaxDuration,
+				MaxUsers:     c.TrafficStats.Backlog.MaxUsers,
+				SpillFile:    c.TrafficStats.Backlog.SpillFile,
+				MaxSpillSize: c.TrafficStats.Backlog.MaxSpillSize,
+				MaxSpillAge:  c.TrafficStats.Backlog.MaxSpillAge,
+			}),
+		}
+		if c.TrafficStats.ClientInfo {
+			opts = append(opts, trafficlogger.WithClientInfo())
+		}
+		if provider != nil {
+			// 提交流量与获取用户列表使用同一个客户端，共用面板 TLS 设置
+			opts = append(opts, trafficlogger.WithHTTPClient(provider.HTTPClient()))
+		}
+		if up, ok := hyConfig.Authenticator.(trafficlogger.UserProvider); ok {
+			opts = append(opts, trafficlogger.WithUserProvider(up))
+		}
+		if hasV2RaySocks {
+			numberFormat, err := trafficlogger.ParseNumberFormat(c.V2RaySocks.NumberFormat)
+			if err != nil {
+				return configError{Field: "v2raysocks.numberFormat", Err: err}
+			}
+			unknownUsers, err := trafficlogger.ParseUnknownUserPolicy(c.V2RaySocks.UnknownUsers)
+			if err != nil {
+				return configError{Field: "v2raysocks.unknownUsers", Err: err}
+			}
+			pushMode, err := trafficlogger.ParsePushMode(c.V2RaySocks.PushMode)
+			if err != nil {
+				return configError{Field: "v2raysocks.pushMode", Err: err}
+			}
+			opts = append(opts,
+				trafficlogger.WithTrafficPushURL(c.V2RaySocks.apiURL("submit")),
+				trafficlogger.WithSystemStatus(!c.V2RaySocks.DisableSystemStatus),
+				trafficlogger.WithSystemStatusURL(c.V2RaySocks.apiURL("nodestatus")),
+				trafficlogger.WithJitter(c.V2RaySocks.Jitter),
+				trafficlogger.WithNumberFormat(numberFormat),
+				trafficlogger.WithIDPrefix(c.V2RaySocks.IDPrefix),
+				trafficlogger.WithNodeName(c.V2RaySocks.NodeName),
+				trafficlogger.WithSlowPushThreshold(c.V2RaySocks.SlowPushThreshold),
+				trafficlogger.WithPercentPrecision(c.V2RaySocks.PercentPrecision),
+				trafficlogger.WithCPUWarmup(c.V2RaySocks.CPUWarmup),
+				trafficlogger.WithConnectionCounts(c.V2RaySocks.ConnCountInterval),
+				trafficlogger.WithThresholds(trafficlogger.Thresholds{
+					CPU:  c.V2RaySocks.CPUThreshold,
+					Mem:  c.V2RaySocks.MemThreshold,
+					Disk: c.V2RaySocks.DiskThreshold,
+				}, logThreshold),
+				trafficlogger.WithStaleMetricsDetection(c.V2RaySocks.StaleMetricsThreshold, c.V2RaySocks.StaleMetricsRefresh),
+				trafficlogger.WithPushAck(c.V2RaySocks.RequireAck),
+				trafficlogger.WithPartialAccept(c.V2RaySocks.PartialAccept),
+				trafficlogger.WithMaxPushSize(c.V2RaySocks.MaxPushSize),
+				trafficlogger.WithSortedPush(c.V2RaySocks.SortedPush),
+				trafficlogger.WithPushLimits(c.V2RaySocks.PushLimits),
+				trafficlogger.WithUnknownUserPolicy(unknownUsers, c.V2RaySocks.UnknownUserBucket),
+				trafficlogger.WithPushMode(pushMode),
+				trafficlogger.WithGranularity(c.V2RaySocks.Granularity),
+				trafficlogger.WithMaxEntryValue(c.V2RaySocks.MaxEntryValue),
+			)
+		}
+		if c.TrafficStats.InfluxDB.URL != "" {
+			opts = append(opts, trafficlogger.WithTrafficSink(&trafficlogger.InfluxDBSink{
+				URL:         c.TrafficStats.InfluxDB.URL,
+				Token:       c.TrafficStats.InfluxDB.Token,
+				Measurement: c.TrafficStats.InfluxDB.Measurement,
+				Tags:        c.TrafficStats.InfluxDB.Tags,
+			}, c.TrafficStats.InfluxDB.Required))
+		}
+		if c.TrafficStats.Broker.Addr != "" {
+			kind, err := trafficlogger.ParseBrokerKind(c.TrafficStats.Broker.Type)
+			if err != nil {
+				return configError{Field: "trafficStats.broker.type", Err: err}
+			}
+			opts = append(opts, trafficlogger.WithTrafficSink(&trafficlogger.BrokerSink{
+				Kind:     kind,
+				Addr:     c.TrafficStats.Broker.Addr,
+				Subject:  c.TrafficStats.Broker.Subject,
+				Username: c.TrafficStats.Broker.Username,
+				Password: c.TrafficStats.Broker.Password,
+				PerEntry: c.TrafficStats.Broker.PerEntry,
+			}, c.TrafficStats.Broker.Required))
+		}
+		tss := trafficlogger.NewTrafficStatsServerWithOptions(opts...)
+		if err := tss.Validate(); err != nil {
+			return configError{Field: "trafficStats", Err: err}
+		}
 		hyConfig.TrafficLogger = tss
+		if sa, ok := hyConfig.Authenticator.(*auth.StaticAuthenticator); ok {
+			sa.TrafficLogger = tss
+		}
 		// 添加定时更新用户使用流量协程
-		if c.V2RaySocks != nil && c.V2RaySocks.ApiHost != "" {
-			go auth.UpdateUsers(fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=user", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID), time.Second*60, hyConfig.TrafficLogger)
-			go hyConfig.TrafficLogger.PushTrafficToV2RaySocksInterval(fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=submit", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID), time.Second*60)
-			go hyConfig.TrafficLogger.PushSystemStatusInterval(fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=nodestatus", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID), time.Second*60)
-			go auth.CheckRemoteConf(fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=config", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID), time.Second*60)
+		if hasV2RaySocks {
+			go tss.PushTrafficToV2RaySocksInterval(c.V2RaySocks.apiURL("submit"), time.Second*60)
+			if !c.V2RaySocks.DisableSystemStatus {
+				go tss.PushSystemStatusInterval(c.V2RaySocks.apiURL("nodestatus"), time.Second*60)
+			}
 		}
-		go runTrafficStatsServer(c.TrafficStats.Listen, tss)
-	} else {
-		go auth.CheckRemoteConf(fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=config", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID), time.Second*60)
-		go auth.UpdateUsers(fmt.Sprintf("%s?token=%s&node_id=%d&node_type=hysteria2&act=user", c.V2RaySocks.ApiHost, c.V2RaySocks.ApiKey, c.V2RaySocks.NodeID), time.Second*60, nil)
+		go runTrafficStatsServer(c.TrafficStats.Listen, &http.Server{
+			Handler:           tss,
+			ReadHeaderTimeout: durationOrDefault(c.TrafficStats.ReadTimeout, defaultTrafficStatsReadTimeout),
+			ReadTimeout:       durationOrDefault(c.TrafficStats.ReadTimeout, defaultTrafficStatsReadTimeout),
+			WriteTimeout:      durationOrDefault(c.TrafficStats.WriteTimeout, defaultTrafficStatsWriteTimeout),
+		})
+	}
+	if hasV2RaySocks {
+		if provider != nil {
+			go provider.UpdateUsers(time.Second*60, hyConfig.TrafficLogger)
+		}
+		var client *http.Client
+		if provider != nil {
+			client = provider.HTTPClient()
+		}
+		go auth.CheckRemoteConf(c.V2RaySocks.apiURL("config"), time.Second*60, c.V2RaySocks.Jitter, client, remoteConfMinRestartInterval)
 	}
 	return nil
 }
@@ -1010,18 +1358,73 @@ func runServer(cmd *cobra.Command, args []string) {
 		go runCheckUpdateServer()
 	}
 
+	if sa, ok := hyConfig.Authenticator.(*auth.StaticAuthenticator); ok && sa.File != "" {
+		go runReloadOnSIGHUP(sa)
+	}
+
+	var users io.Closer
+	if p, ok := hyConfig.Authenticator.(*auth.V2RaySocksApiProvider); ok {
+		users = p
+	}
+	tss, _ := hyConfig.TrafficLogger.(trafficlogger.TrafficStatsServer)
+	if users != nil || tss != nil {
+		go runShutdownOnSignal(users, tss)
+	}
+
 	if err := s.Serve(); err != nil {
 		logger.Fatal("failed to serve", zap.Error(err))
 	}
 }
 
-func runTrafficStatsServer(listen string, handler http.Handler) {
+// runShutdownOnSignal 收到 SIGINT 或 SIGTERM 时先停止用户列表更新，再提交剩余的流量，然后退出
+func runShutdownOnSignal(users io.Closer, tss trafficlogger.TrafficStatsServer) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigChan
+	logger.Info("shutting down", zap.String("signal", sig.String()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err := trafficlogger.Shutdown(ctx, users, tss)
+	cancel()
+	if err != nil {
+		logger.Error("failed to push remaining traffic on shutdown", zap.Error(err))
+	}
+	os.Exit(0)
+}
+
+// logThreshold 系统状态超过告警阈值时记录警告日志
+func logThreshold(metric string, value float64) {
+	logger.Warn("system status exceeds threshold", zap.String("metric", metric), zap.Float64("value", value))
+}
+
+// durationOrDefault 返回 d，未配置（为 0）时返回 def
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func runTrafficStatsServer(listen string, srv *http.Server) {
 	logger.Info("traffic stats server up and running", zap.String("listen", listen))
-	if err := correctnet.HTTPListenAndServe(listen, handler); err != nil {
+	if err := correctnet.HTTPServerListenAndServe(listen, srv); err != nil {
 		logger.Fatal("failed to serve traffic stats", zap.Error(err))
 	}
 }
 
+// runReloadOnSIGHUP 收到 SIGHUP 时重新加载用户列表
+func runReloadOnSIGHUP(a *auth.StaticAuthenticator) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		if err := a.Reload(); err != nil {
+			logger.Error("failed to reload user list", zap.String("file", a.File), zap.Error(err))
+		} else {
+			logger.Info("user list reloaded", zap.String("file", a.File))
+		}
+	}
+}
+
 func runMasqTCPServer(s *masq.MasqTCPServer, httpAddr, httpsAddr string) {
 	errChan := make(chan error, 2)
 	if httpAddr != "" {
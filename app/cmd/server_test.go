@@ -88,6 +88,19 @@ func TestServerConfig(t *testing.T) {
 				Insecure: true,
 			},
 			Command: "/etc/some_command",
+			Static: []serverConfigAuthStaticUser{
+				{
+					ID:   1,
+					UUID: "6a1f3c52-7e0b-4c1d-9a8e-2f5b4d3c2b1a",
+				},
+				{
+					ID:          2,
+					UUID:        "0c9e8d7f-6b5a-4e3d-8c2b-1a0f9e8d7c6b",
+					DeviceLimit: 3,
+					SpeedLimit:  100,
+					Group:       "reseller",
+				},
+			},
 		},
 		Resolver: serverConfigResolver{
 			Type: "udp",
@@ -159,8 +172,55 @@ func TestServerConfig(t *testing.T) {
 			},
 		},
 		TrafficStats: serverConfigTrafficStats{
-			Listen: ":9999",
-			Secret: "its_me_mario",
+			Listen:                 ":9999",
+			Secret:                 "its_me_mario",
+			MaxConcurrentRequests:  4,
+			KickTTL:                30 * time.Minute,
+			DisableSecurityHeaders: true,
+			ReconnectGrace:         15 * time.Second,
+			QuerySignature:         true,
+			QuerySignatureMaxAge:   2 * time.Hour,
+			ReplayWindow:           5 * time.Minute,
+			PushConcurrency:        2,
+			SessionTime:            "wallclock",
+			PushSessionTime:        true,
+			IdleTimeout:            10 * time.Minute,
+			KickMarksOffline:       true,
+			FleetMaxNodes:          50,
+			ClientInfo:             true,
+			IndexPath:              "/stats/",
+			EmptyPathAsIndex:       true,
+			BufferInterval:         time.Second,
+			Shards:                 16,
+			TrustedProxies:         []string{"10.0.0.0/8", "127.0.0.1"},
+			ReadTimeout:            5 * time.Second,
+			WriteTimeout:           20 * time.Second,
+			RequestTimeout:         15 * time.Second,
+			Backlog: serverConfigTrafficStatsBacklog{
+				Mode:         "spill",
+				MaxFailures:  5,
+				MaxDuration:  time.Hour,
+				SpillFile:    "/var/lib/hysteria/backlog.json",
+				MaxSpillSize: 10485760,
+				MaxSpillAge:  72 * time.Hour,
+			},
+			InfluxDB: serverConfigTrafficStatsInfluxDB{
+				URL:         "http://127.0.0.1:8086/api/v2/write?org=mushroom&bucket=kingdom",
+				Token:       "its_me_luigi",
+				Measurement: "coins",
+				Tags: map[string]string{
+					"node": "castle",
+				},
+				Required: true,
+			},
+			Broker: serverConfigTrafficStatsBroker{
+				Type:     "nats",
+				Addr:     "127.0.0.1:4222",
+				Subject:  "hysteria.traffic",
+				Username: "toad",
+				Password: "mushroom",
+				PerEntry: true,
+			},
 		},
 		Masquerade: serverConfigMasquerade{
 			Type: "proxy",
@@ -215,3 +215,48 @@ type TrafficLogger interface {
 	PushSystemStatusInterval(url string, interval time.Duration)
 	LogOnlineState(id string, online bool)
 }
+
+// TrafficVerdict is the decision returned by TrafficVerdictLogger for a chunk of traffic.
+type TrafficVerdict int
+
+const (
+	// TrafficAllow lets the traffic through.
+	TrafficAllow TrafficVerdict = iota
+	// TrafficThrottle asks the server to slow the client down.
+	// TCP streams are paused briefly before forwarding, UDP messages are dropped.
+	TrafficThrottle
+	// TrafficOverQuota disconnects the client because it has used up its quota.
+	TrafficOverQuota
+	// TrafficKick disconnects the client. This is what LogTraffic returning false means.
+	TrafficKick
+)
+
+// TrafficVerdictLogger is an optional extension of TrafficLogger.
+// If the TrafficLogger also implements this interface, LogTrafficVerdict
+// is called instead of LogTraffic, allowing the logger to throttle a client
+// or report it as over quota instead of only disconnecting it.
+type TrafficVerdictLogger interface {
+	LogTrafficVerdict(id string, tx, rx uint64) TrafficVerdict
+}
+
+// ClientInfoLogger is an optional extension of TrafficLogger.
+// If the TrafficLogger also implements this interface, LogClientInfo is called
+// right after a client comes online, with a short description of the client
+// (User-Agent and TLS SNI, when available). It is not called when nothing is known.
+type ClientInfoLogger interface {
+	LogClientInfo(id, info string)
+}
+
+// trafficVerdictFunc returns a function that logs traffic to l and returns a verdict,
+// falling back to the boolean LogTraffic if l does not implement TrafficVerdictLogger.
+func trafficVerdictFunc(l TrafficLogger) func(id string, tx, rx uint64) TrafficVerdict {
+	if vl, ok := l.(TrafficVerdictLogger); ok {
+		return vl.LogTrafficVerdict
+	}
+	return func(id string, tx, rx uint64) TrafficVerdict {
+		if l.LogTraffic(id, tx, rx) {
+			return TrafficAllow
+		}
+		return TrafficKick
+	}
+}
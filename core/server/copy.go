@@ -3,17 +3,25 @@ package server
 import (
 	"errors"
 	"io"
+	"time"
 )
 
+// trafficThrottleDelay is how long a TCP stream is paused when the traffic logger asks for throttling
+const trafficThrottleDelay = 100 * time.Millisecond
+
 var errDisconnect = errors.New("traffic logger requested disconnect")
 
-func copyBufferLog(dst io.Writer, src io.Reader, log func(n uint64) bool) error {
+func copyBufferLog(dst io.Writer, src io.Reader, log func(n uint64) TrafficVerdict) error {
 	buf := make([]byte, 32*1024)
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
-			if !log(uint64(nr)) {
-				// Log returns false, which means that the client should be disconnected
+			switch log(uint64(nr)) {
+			case TrafficAllow:
+			case TrafficThrottle:
+				time.Sleep(trafficThrottleDelay)
+			default:
+				// The client should be disconnected (kicked or over quota)
 				return errDisconnect
 			}
 			_, ew := dst.Write(buf[0:nr])
@@ -32,15 +40,16 @@ func copyBufferLog(dst io.Writer, src io.Reader, log func(n uint64) bool) error
 }
 
 func copyTwoWayWithLogger(id string, serverRw, remoteRw io.ReadWriter, l TrafficLogger) error {
+	logVerdict := trafficVerdictFunc(l)
 	errChan := make(chan error, 2)
 	go func() {
-		errChan <- copyBufferLog(serverRw, remoteRw, func(n uint64) bool {
-			return l.LogTraffic(id, 0, n)
+		errChan <- copyBufferLog(serverRw, remoteRw, func(n uint64) TrafficVerdict {
+			return logVerdict(id, 0, n)
 		})
 	}()
 	go func() {
-		errChan <- copyBufferLog(remoteRw, serverRw, func(n uint64) bool {
-			return l.LogTraffic(id, n, 0)
+		errChan <- copyBufferLog(remoteRw, serverRw, func(n uint64) TrafficVerdict {
+			return logVerdict(id, n, 0)
 		})
 	}()
 	// Block until one of the two goroutines returns
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/apernet/quic-go"
@@ -160,6 +161,11 @@ func (h *h3sHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// Call event logger
 			if tl := h.config.TrafficLogger; tl != nil {
 				tl.LogOnlineState(id, true)
+				if cl, ok := tl.(ClientInfoLogger); ok {
+					if info := clientInfo(r, h.conn); info != "" {
+						cl.LogClientInfo(id, info)
+					}
+				}
 			}
 			if el := h.config.EventLogger; el != nil {
 				el.Connect(h.conn.RemoteAddr(), id, actualTx)
@@ -187,6 +193,19 @@ func (h *h3sHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// clientInfo describes the client from its auth request and TLS handshake,
+// e.g. "hysteria/2.4.0 sni=example.com". Returns "" if nothing is known.
+func clientInfo(r *http.Request, conn quic.Connection) string {
+	var parts []string
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		parts = append(parts, ua)
+	}
+	if sni := conn.ConnectionState().TLS.ServerName; sni != "" {
+		parts = append(parts, "sni="+sni)
+	}
+	return strings.Join(parts, " ")
+}
+
 func (h *h3sHandler) ProxyStreamHijacker(ft http3.FrameType, id quic.ConnectionTracingID, stream quic.Stream, err error) (bool, error) {
 	if err != nil || !h.authenticated {
 		return false, nil
@@ -302,8 +321,12 @@ func (io *udpIOImpl) ReceiveMessage() (*protocol.UDPMessage, error) {
 			continue
 		}
 		if io.TrafficLogger != nil {
-			ok := io.TrafficLogger.LogTraffic(io.AuthID, uint64(len(udpMsg.Data)), 0)
-			if !ok {
+			switch trafficVerdictFunc(io.TrafficLogger)(io.AuthID, uint64(len(udpMsg.Data)), 0) {
+			case TrafficAllow:
+			case TrafficThrottle:
+				// Throttled, drop this message and wait for the next
+				continue
+			default:
 				// TrafficLogger requested to disconnect the client
 				_ = io.Conn.CloseWithError(closeErrCodeTrafficLimitReached, "")
 				return nil, errDisconnect
@@ -315,8 +338,12 @@ func (io *udpIOImpl) ReceiveMessage() (*protocol.UDPMessage, error) {
 
 func (io *udpIOImpl) SendMessage(buf []byte, msg *protocol.UDPMessage) error {
 	if io.TrafficLogger != nil {
-		ok := io.TrafficLogger.LogTraffic(io.AuthID, 0, uint64(len(msg.Data)))
-		if !ok {
+		switch trafficVerdictFunc(io.TrafficLogger)(io.AuthID, 0, uint64(len(msg.Data))) {
+		case TrafficAllow:
+		case TrafficThrottle:
+			// Throttled, silent drop
+			return nil
+		default:
 			// TrafficLogger requested to disconnect the client
 			_ = io.Conn.CloseWithError(closeErrCodeTrafficLimitReached, "")
 			return errDisconnect
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"net"
+
+	"github.com/apernet/hysteria/core/v2/server"
+)
+
+var _ server.Authenticator = &ChainAuthenticator{}
+
+// ChainAuthenticator tries each authenticator in order and returns the first success,
+// e.g. a V2RaySocksApiProvider followed by a StaticAuthenticator for break-glass access.
+//
+// The id returned is the one from the authenticator that accepted the client, unchanged.
+// Authenticators in the chain share a single id space: if two of them can return the same id
+// for different users, their traffic, online state and kicks are merged in the traffic logger.
+// Give fallback users ids that don't collide with the ones from earlier authenticators.
+type ChainAuthenticator struct {
+	Authenticators []server.Authenticator
+}
+
+func (a *ChainAuthenticator) Authenticate(addr net.Addr, auth string, tx uint64) (ok bool, id string) {
+	for _, au := range a.Authenticators {
+		if ok, id := au.Authenticate(addr, auth, tx); ok {
+			return true, id
+		}
+	}
+	return false, ""
+}
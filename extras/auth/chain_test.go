@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/apernet/hysteria/core/v2/server"
+)
+
+func TestChainAuthenticator(t *testing.T) {
+	a := &ChainAuthenticator{
+		Authenticators: []server.Authenticator{
+			&PasswordAuthenticator{Password: "panel"},
+			NewStaticAuthenticator([]User{{ID: 1000, UUID: "break-glass"}}),
+		},
+	}
+	tests := []struct {
+		name   string
+		auth   string
+		wantOk bool
+		wantId string
+	}{
+		{name: "first", auth: "panel", wantOk: true, wantId: "user"},
+		{name: "fallback", auth: "break-glass", wantOk: true, wantId: "1000"},
+		{name: "none", auth: "nope", wantOk: false, wantId: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOk, gotId := a.Authenticate(nil, tt.auth, 0)
+			if gotOk != tt.wantOk || gotId != tt.wantId {
+				t.Errorf("Authenticate() = %v, %v, want %v, %v", gotOk, gotId, tt.wantOk, tt.wantId)
+			}
+		})
+	}
+
+	if ok, _ := (&ChainAuthenticator{}).Authenticate(nil, "panel", 0); ok {
+		t.Error("empty chain should reject")
+	}
+}
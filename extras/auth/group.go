@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// groupIndex 用户分组 -> 用户 ID 的索引，在用户列表更新时重建，读取时无需加锁
+type groupIndex struct {
+	m atomic.Pointer[map[string][]string]
+}
+
+// rebuild 根据新的用户列表重建索引，未设置分组的用户不计入
+func (g *groupIndex) rebuild(users map[string]User) {
+	m := make(map[string][]string)
+	for _, user := range users {
+		if user.Group != "" {
+			m[user.Group] = append(m[user.Group], strconv.Itoa(user.ID))
+		}
+	}
+	for _, ids := range m {
+		sort.Strings(ids)
+	}
+	g.m.Store(&m)
+}
+
+// members 返回分组内的用户 ID，分组不存在时返回 nil。返回的切片不可修改
+func (g *groupIndex) members(group string) []string {
+	if m := g.m.Load(); m != nil {
+		return (*m)[group]
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// authLatencySampleRate 每多少次认证采样一次耗时，避免每次都调用 time.Now
+const authLatencySampleRate = 64
+
+// AuthMetrics 认证计数的快照
+type AuthMetrics struct {
+	Attempts uint64 `json:"auth_attempts"`
+	Success  uint64 `json:"auth_success"`
+	Rejected uint64 `json:"auth_rejected"`
+	// LatencyNs 为最近一次采样的认证耗时（纳秒）
+	LatencyNs int64 `json:"auth_latency_ns"`
+}
+
+// authMetrics 认证计数，所有字段均为原子操作，可在认证热路径上使用
+type authMetrics struct {
+	attempts  atomic.Uint64
+	success   atomic.Uint64
+	rejected  atomic.Uint64
+	latencyNs atomic.Int64
+}
+
+// begin 记录一次认证尝试，需要采样耗时时返回开始时间，否则返回零值
+func (m *authMetrics) begin() time.Time {
+	if m.attempts.Add(1)%authLatencySampleRate == 1 {
+		return time.Now()
+	}
+	return time.Time{}
+}
+
+// end 记录认证结果
+func (m *authMetrics) end(start time.Time, ok bool) {
+	if ok {
+		m.success.Add(1)
+	} else {
+		m.rejected.Add(1)
+	}
+	if !start.IsZero() {
+		m.latencyNs.Store(int64(time.Since(start)))
+	}
+}
+
+func (m *authMetrics) snapshot() AuthMetrics {
+	return AuthMetrics{
+		Attempts:  m.attempts.Load(),
+		Success:   m.success.Load(),
+		Rejected:  m.rejected.Load(),
+		LatencyNs: m.latencyNs.Load(),
+	}
+}
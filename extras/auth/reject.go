@@ -0,0 +1,28 @@
+package auth
+
+import "net"
+
+// RejectReason 认证失败的原因，用于日志和统计
+type RejectReason string
+
+const (
+	// RejectEmptyAuth 客户端未提供认证字符串
+	RejectEmptyAuth RejectReason = "empty_auth"
+	// RejectNotLoaded 用户列表尚未加载（面板首次拉取未成功）
+	RejectNotLoaded RejectReason = "not_loaded"
+	// RejectUnknownUser 认证字符串不在用户列表中
+	RejectUnknownUser RejectReason = "unknown_user"
+	// RejectInvalidID 用户存在，但 ID 缺失或不为正数
+	RejectInvalidID RejectReason = "invalid_id"
+)
+
+// RejectFunc 认证失败时的回调，参数为客户端地址和失败原因
+type RejectFunc func(addr net.Addr, reason RejectReason)
+
+// reject 调用认证失败回调（如果设置了），并返回认证失败的结果
+func (f RejectFunc) reject(addr net.Addr, reason RejectReason) (ok bool, id string) {
+	if f != nil {
+		f(addr, reason)
+	}
+	return false, ""
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// processStart 为进程启动时间。配置变化时通过重启进程生效，因此距启动的时间即为距上次重启的时间
+var processStart = time.Now()
+
+// remoteConfWatcher 检查远程配置是否真正变化：ETag 变化后再连续拉取两次内容，
+// 两次内容一致且与之前的内容不同才视为变化，并保证两次重启之间至少间隔 minInterval，
+// 避免 ETag 抖动（如 CDN 异常）导致反复重启
+type remoteConfWatcher struct {
+	client      *http.Client
+	url         string
+	minInterval time.Duration
+	started     time.Time
+	now         func() time.Time
+
+	etag string
+	// hash 为当前生效的配置内容的 SHA-256，首次检查时记录
+	hash string
+}
+
+// check 检查一次远程配置，确认发生变化且可以重启时返回 true
+func (w *remoteConfWatcher) check() (bool, error) {
+	newEtag, err := getResponseEtag(w.client, w.url, w.etag)
+	if err != nil {
+		return false, err
+	}
+	if w.hash == "" {
+		hash, err := w.fetchHash()
+		if err != nil {
+			return false, err
+		}
+		w.etag, w.hash = newEtag, hash
+		return false, nil
+	}
+	if newEtag == w.etag {
+		return false, nil
+	}
+
+	// ETag 变化，连续拉取两次内容确认变化已稳定
+	first, err := w.fetchHash()
+	if err != nil {
+		return false, err
+	}
+	second, err := w.fetchHash()
+	if err != nil {
+		return false, err
+	}
+	if first != second {
+		loopLog.Println("远程配置文件内容不稳定，暂不重启，下次检查时重新确认")
+		return false, nil
+	}
+	if first == w.hash {
+		// 只有 ETag 变化，内容未变
+		loopLog.Println("远程配置文件 ETag 已变化但内容未变，忽略")
+		w.etag = newEtag
+		return false, nil
+	}
+	if w.now().Sub(w.started) < w.minInterval {
+		// 不更新 etag 和 hash，间隔满足后的检查会再次发现变化。
+		// 日志只包含固定的重启时间，推迟期间每次检查输出相同的内容，由 loopLog 去重
+		loopLog.Println("远程配置文件已更改，但距上次重启不足", w.minInterval.String()+"，推迟到",
+			w.started.Add(w.minInterval).Format("2006-01-02 15:04:05"), "之后重启")
+		return false, nil
+	}
+	w.etag, w.hash = newEtag, first
+	return true, nil
+}
+
+// fetchHash 拉取远程配置并返回内容的 SHA-256
+func (w *remoteConfWatcher) fetchHash() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, w.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("拉取远程配置失败，状态码: %s", resp.Status)
+	}
+	body, err := readBody(resp)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteConfWatcher(t *testing.T) {
+	var etag, body atomic.Value
+	etag.Store("1")
+	body.Store("a")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := etag.Load().(string)
+		w.Header().Set("ETag", e)
+		if r.Header.Get("If-None-Match") == e {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer ts.Close()
+
+	now := time.Unix(1700000000, 0)
+	w := &remoteConfWatcher{
+		client:      ts.Client(),
+		url:         ts.URL,
+		minInterval: time.Hour,
+		started:     now,
+		now:         func() time.Time { return now },
+	}
+	check := func() bool {
+		changed, err := w.check()
+		assert.NoError(t, err)
+		return changed
+	}
+
+	assert.False(t, check())
+	assert.False(t, check())
+
+	// The ETag flaps but the content is the same
+	etag.Store("2")
+	assert.False(t, check())
+	assert.Equal(t, "2", w.etag)
+
+	// A real change right after a restart is postponed
+	etag.Store("3")
+	body.Store("b")
+	assert.False(t, check())
+	now = now.Add(time.Hour)
+	assert.True(t, check())
+	assert.False(t, check())
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/apernet/hysteria/core/v2/server"
+)
+
+var _ server.Authenticator = &StaticAuthenticator{}
+
+// userKicker 由支持踢出用户的 TrafficLogger 实现
+type userKicker interface {
+	NewKick(id string) bool
+}
+
+// StaticAuthenticator 使用固定的用户列表认证，适用于不使用面板的小型部署。
+// 认证字符串为用户的 UUID，认证成功时返回的 id 与 V2RaySocksApiProvider 一致，为用户 ID 的十进制字符串。
+// 与 V2RaySocksApiProvider 的默认行为相同，UUID 去除首尾空白并转为小写后匹配。
+type StaticAuthenticator struct {
+	// File 为用户列表文件（JSON 数组，字段与面板返回的用户相同），Reload 时重新读取
+	File string
+	// TrafficLogger 不为空时，Reload 中被移除的用户会被标记为离线并踢出
+	TrafficLogger server.TrafficLogger
+	// OnUpdate 不为空时，每次 Reload 成功后以新增、移除和变更的用户调用
+	OnUpdate func(added, removed, changed []User)
+	// OnReject 不为空时，每次认证失败以客户端地址和失败原因调用，在认证路径上同步执行，不应阻塞
+	OnReject RejectFunc
+
+	users   atomic.Pointer[map[string]User]
+	groups  groupIndex
+	metrics authMetrics
+}
+
+func NewStaticAuthenticator(users []User) *StaticAuthenticator {
+	a := &StaticAuthenticator{}
+	m := usersByUUID(users)
+	a.users.Store(m)
+	a.groups.rebuild(*m)
+	return a
+}
+
+// NewStaticAuthenticatorFromFile 从文件加载用户列表，之后可通过 Reload 重新加载
+func NewStaticAuthenticatorFromFile(file string) (*StaticAuthenticator, error) {
+	users, err := loadUsersFile(file)
+	if err != nil {
+		return nil, err
+	}
+	a := NewStaticAuthenticator(users)
+	a.File = file
+	return a, nil
+}
+
+func loadUsersFile(file string) ([]User, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(bs, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func usersByUUID(users []User) *map[string]User {
+	m := make(map[string]User, len(users))
+	for _, user := range users {
+		m[normalizeUUID(user.UUID)] = user
+	}
+	return &m
+}
+
+// Reload 重新读取用户列表文件并原子替换当前用户列表，不影响已建立的连接。
+// 被移除的用户会被标记为离线并踢出。
+func (a *StaticAuthenticator) Reload() error {
+	if a.File == "" {
+		return errors.New("未配置用户列表文件")
+	}
+	users, err := loadUsersFile(a.File)
+	if err != nil {
+		return err
+	}
+	newUsers := usersByUUID(users)
+	oldUsers := a.users.Swap(newUsers)
+	a.groups.rebuild(*newUsers)
+	if a.OnUpdate != nil {
+		var old map[string]User
+		if oldUsers != nil {
+			old = *oldUsers
+		}
+		a.OnUpdate(diffUsers(old, *newUsers))
+	}
+	if a.TrafficLogger != nil && oldUsers != nil {
+		kicker, _ := a.TrafficLogger.(userKicker)
+		for uuid, user := range *oldUsers {
+			if _, exists := (*newUsers)[uuid]; !exists {
+				id := strconv.Itoa(user.ID)
+				a.TrafficLogger.LogOnlineState(id, false)
+				if kicker != nil {
+					kicker.NewKick(id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (a *StaticAuthenticator) Authenticate(addr net.Addr, auth string, tx uint64) (ok bool, id string) {
+	start := a.metrics.begin()
+	defer func() { a.metrics.end(start, ok) }()
+
+	if auth == "" {
+		return a.OnReject.reject(addr, RejectEmptyAuth)
+	}
+	user, exists := (*a.users.Load())[normalizeUUID(auth)]
+	if !exists {
+		return a.OnReject.reject(addr, RejectUnknownUser)
+	}
+	if ok, id = user.authID(); !ok {
+		return a.OnReject.reject(addr, RejectInvalidID)
+	}
+	return ok, id
+}
+
+// GroupMembers 返回分组内所有用户的 ID
+func (a *StaticAuthenticator) GroupMembers(group string) []string {
+	return a.groups.members(group)
+}
+
+// AuthMetrics 返回认证计数
+func (a *StaticAuthenticator) AuthMetrics() AuthMetrics {
+	return a.metrics.snapshot()
+}
+
+// LimitSource 返回用户限制的来源，固定为 LimitSourceStatic
+func (a *StaticAuthenticator) LimitSource() string {
+	return LimitSourceStatic
+}
+
+// Users 返回用户列表，按用户 ID 排序
+func (a *StaticAuthenticator) Users() []User {
+	return sortedUsers(*a.users.Load())
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := NewStaticAuthenticator([]User{
+		{ID: 1, UUID: "b7e1c2a4-0000-4000-8000-000000000001"},
+		{ID: 2, UUID: "b7e1c2a4-0000-4000-8000-000000000002", DeviceLimit: 3},
+		{UUID: "b7e1c2a4-0000-4000-8000-000000000004"},
+	})
+	var reasons []RejectReason
+	a.OnReject = func(addr net.Addr, reason RejectReason) { reasons = append(reasons, reason) }
+
+	ok, id := a.Authenticate(nil, "b7e1c2a4-0000-4000-8000-000000000002", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "2", id)
+
+	ok, id = a.Authenticate(nil, "b7e1c2a4-0000-4000-8000-000000000003", 0)
+	assert.False(t, ok)
+	assert.Equal(t, "", id)
+
+	ok, _ = a.Authenticate(nil, "", 0)
+	assert.False(t, ok)
+
+	// Users without a valid ID are rejected instead of sharing ID "0"
+	ok, id = a.Authenticate(nil, "b7e1c2a4-0000-4000-8000-000000000004", 0)
+	assert.False(t, ok)
+	assert.Equal(t, "", id)
+	assert.Equal(t, []RejectReason{RejectUnknownUser, RejectEmptyAuth, RejectInvalidID}, reasons)
+
+	// Case and surrounding whitespace are ignored on both sides
+	ok, id = a.Authenticate(nil, " B7E1C2A4-0000-4000-8000-000000000002\n", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "2", id)
+	mixed := NewStaticAuthenticator([]User{{ID: 5, UUID: " B7E1C2A4-0000-4000-8000-00000000000A "}})
+	ok, id = mixed.Authenticate(nil, "b7e1c2a4-0000-4000-8000-00000000000a", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "5", id)
+
+	users := a.Users()
+	assert.Len(t, users, 3)
+	assert.Equal(t, 0, users[0].ID)
+	assert.Equal(t, 1, users[1].ID)
+	assert.Equal(t, 2, users[2].ID)
+}
+
+type testKickLogger struct {
+	offline []string
+	kicked  []string
+}
+
+func (l *testKickLogger) LogTraffic(id string, tx, rx uint64) bool { return true }
+
+func (l *testKickLogger) PushTrafficToV2RaySocksInterval(url string, interval time.Duration) {}
+
+func (l *testKickLogger) PushSystemStatusInterval(url string, interval time.Duration) {}
+
+func (l *testKickLogger) LogOnlineState(id string, online bool) {
+	if !online {
+		l.offline = append(l.offline, id)
+	}
+}
+
+func (l *testKickLogger) NewKick(id string) bool {
+	l.kicked = append(l.kicked, id)
+	return true
+}
+
+func TestStaticAuthenticatorReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(file, []byte(`[{"id":1,"uuid":"aaa"},{"id":2,"uuid":"bbb"}]`), 0o644)
+	assert.NoError(t, err)
+
+	a, err := NewStaticAuthenticatorFromFile(file)
+	assert.NoError(t, err)
+	l := &testKickLogger{}
+	a.TrafficLogger = l
+	var added, removed []User
+	a.OnUpdate = func(a, r, _ []User) { added, removed = a, r }
+
+	ok, _ := a.Authenticate(nil, "bbb", 0)
+	assert.True(t, ok)
+
+	err = os.WriteFile(file, []byte(`[{"id":1,"uuid":"aaa"},{"id":3,"uuid":"ccc"}]`), 0o644)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Reload())
+
+	ok, _ = a.Authenticate(nil, "bbb", 0)
+	assert.False(t, ok)
+	ok, id := a.Authenticate(nil, "ccc", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "3", id)
+	assert.Equal(t, []string{"2"}, l.offline)
+	assert.Equal(t, []string{"2"}, l.kicked)
+	assert.Equal(t, []User{{ID: 3, UUID: "ccc"}}, added)
+	assert.Equal(t, []User{{ID: 2, UUID: "bbb"}}, removed)
+
+	// A broken file keeps the current list
+	err = os.WriteFile(file, []byte(`not json`), 0o644)
+	assert.NoError(t, err)
+	assert.Error(t, a.Reload())
+	ok, _ = a.Authenticate(nil, "ccc", 0)
+	assert.True(t, ok)
+}
+
+func TestStaticAuthenticatorGroups(t *testing.T) {
+	a := NewStaticAuthenticator([]User{
+		{ID: 1, UUID: "b7e1c2a4-0000-4000-8000-000000000001", Group: "basic"},
+		{ID: 2, UUID: "b7e1c2a4-0000-4000-8000-000000000002", Group: "premium"},
+		{ID: 3, UUID: "b7e1c2a4-0000-4000-8000-000000000003", Group: "basic"},
+		{ID: 4, UUID: "b7e1c2a4-0000-4000-8000-000000000004"},
+	})
+	assert.Equal(t, []string{"1", "3"}, a.GroupMembers("basic"))
+	assert.Equal(t, []string{"2"}, a.GroupMembers("premium"))
+	assert.Empty(t, a.GroupMembers("missing"))
+	assert.Empty(t, a.GroupMembers(""))
+}
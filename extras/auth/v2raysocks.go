@@ -1,54 +1,345 @@
 package auth
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apernet/hysteria/core/v2/server"
+	"github.com/apernet/hysteria/extras/v2/utils"
 )
 
 var _ server.Authenticator = &V2RaySocksApiProvider{}
 
+// loopLog 定时任务使用的日志，相同的错误每分钟只输出一次，避免面板故障期间刷屏
+var loopLog = utils.NewLogLimiter(time.Minute)
+
 type V2RaySocksApiProvider struct {
 	Client *http.Client
 	URL    string
 	Etag   string // 添加一个字段用于存储服务器返回的ETag
+	// Jitter 为更新间隔的随机浮动比例（0~1），避免大量节点同时请求面板
+	Jitter float64
+	// InsecureSkipVerify 为 true 时不校验面板的 TLS 证书，仅用于测试自签名证书的面板。
+	// 设置了 Client 时以 Client 的配置为准
+	InsecureSkipVerify bool
+	// Header 为附加到发往面板的请求的请求头（如 API 令牌），设置了 Client 时不生效。
+	// 只附加到 URL 所在主机和 RedirectHosts 中的主机，重定向到其他主机时会被移除
+	Header http.Header
+	// RedirectHosts 为面板请求重定向时仍附加 Header 的其他主机名（如 CDN 或鉴权子域名）
+	RedirectHosts []string
+	// UsersKey 为面板响应中用户列表所在的字段名，为空时使用 "users"。
+	// 面板直接返回用户数组时会自动识别，无需设置
+	UsersKey string
+	// AllowEmpty 为 true 时允许面板返回空用户列表并清空当前用户；默认视为面板故障，保留当前用户列表
+	AllowEmpty bool
+	// MaxShrink 为单次更新允许减少的用户比例（0~1），超过时视为面板故障，保留当前用户列表。为 0 时不限制
+	MaxShrink float64
+	// CaseSensitiveUUID 为 true 时按面板返回的原样匹配 UUID；默认去除首尾空白并转为小写后匹配，
+	// 避免大小写或空白不一致导致认证失败
+	CaseSensitiveUUID bool
+	// OnUpdate 不为空时，每次用户列表更新后以新增、移除和变更的用户调用，
+	// 调用期间持有更新锁，多次更新的回调按顺序执行；回调中不可再触发用户列表更新
+	OnUpdate func(added, removed, changed []User)
+	// OnReject 不为空时，每次认证失败以客户端地址和失败原因调用，在认证路径上同步执行，不应阻塞
+	OnReject RejectFunc
+	// StartupWait 大于 0 时，用户列表首次加载完成前的认证最多等待到 UpdateUsers 启动（或首次认证）后该时长，
+	// 避免进程刚启动时的连接因用户列表尚未加载而失败；超时仍未加载时以 RejectNotLoaded 拒绝，之后的认证不再等待
+	StartupWait time.Duration
+	// Now 获取当前时间，用于记录拉取时间和计算 StartupWait 的截止时间，为 nil 时使用 time.Now
+	Now func() time.Time
+
+	metrics authMetrics
+
+	// users 为当前用户列表（UUID -> User），采用写时复制：
+	// 认证时无锁读取，更新时构建新表后整体替换
+	users atomic.Pointer[map[string]User]
+	// groups 为分组索引，随 users 一起更新
+	groups groupIndex
+	// updateLock 串行化用户列表的更新，并保护 state
+	updateLock sync.Mutex
+	state      userListState
+	// cache 为 state 中缓存状态的快照，每次成功请求面板后更新，供 CacheState 无锁读取
+	cache atomic.Pointer[CacheState]
+	// stale 最近一次更新是否失败（面板不可用或更新被拒绝），此时使用的是之前拉取的用户列表
+	stale atomic.Bool
+	// trafficLogger 为 UpdateUsers 每次更新时使用的 TrafficLogger，可通过 SetTrafficLogger 运行时替换
+	trafficLogger atomic.Pointer[server.TrafficLogger]
+	// client 为 InsecureSkipVerify 或设置了 Header 时创建的 HTTP 客户端
+	client     *http.Client
+	clientOnce sync.Once
+	// loaded 在用户列表首次加载完成时关闭
+	loaded     chan struct{}
+	loadedOnce sync.Once
+	// startupDeadline 为 StartupWait 的截止时间，在 UpdateUsers 启动或首次等待时确定，之后不再延长
+	startupDeadline time.Time
+	startupOnce     sync.Once
+	// done 在 Close 时关闭，通知 UpdateUsers 退出；closed 由 updateLock 保护
+	done     chan struct{}
+	doneOnce sync.Once
+	closed   bool
 }
 
-// 用户列表
-var (
-	usersMap map[string]User
-	lock     sync.Mutex
-)
+// errProviderClosed Close 之后更新用户列表时返回的错误
+var errProviderClosed = errors.New("用户列表更新已停止")
 
 type User struct {
 	ID          int    `json:"id"`
 	UUID        string `json:"uuid"`
 	DeviceLimit int    `json:"dt"`
 	SpeedLimit  int    `json:"st"`
+	// Group 用户所属的分组（套餐、代理商等），用于按分组批量操作
+	Group string `json:"group,omitempty"`
+
+	// Extra 保存面板返回的其他字段（套餐、到期时间、标签等），原样透传
+	Extra map[string]any `json:"-"`
+}
+
+// userKnownFields 为 User 中已声明的 JSON 字段名，其余字段归入 Extra
+var userKnownFields = func() map[string]struct{} {
+	fields := make(map[string]struct{})
+	t := reflect.TypeOf(User{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = struct{}{}
+		}
+	}
+	return fields
+}()
+
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plainUser User
+	var pu plainUser
+	if err := json.Unmarshal(data, &pu); err != nil {
+		return err
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for k := range raw {
+		if _, ok := userKnownFields[k]; ok {
+			delete(raw, k)
+		}
+	}
+	if len(raw) > 0 {
+		pu.Extra = raw
+	}
+	*u = User(pu)
+	return nil
+}
+
+// authID 返回认证通过时使用的用户 ID。面板未返回 id 或 id 不为正数时拒绝认证，
+// 否则这些用户会共用 "0" 等同一个 ID，流量统计会混在一起
+func (u User) authID() (ok bool, id string) {
+	if u.ID <= 0 {
+		loopLog.Println("拒绝认证: 用户 ID 无效:", u.ID)
+		return false, ""
+	}
+	return true, strconv.Itoa(u.ID)
+}
+
+func (u User) MarshalJSON() ([]byte, error) {
+	type plainUser User
+	if len(u.Extra) == 0 {
+		return json.Marshal(plainUser(u))
+	}
+	bs, err := json.Marshal(plainUser(u))
+	if err != nil {
+		return nil, err
+	}
+	var known map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &known); err != nil {
+		return nil, err
+	}
+	m := make(map[string]any, len(u.Extra)+len(known))
+	for k, v := range u.Extra {
+		m[k] = v
+	}
+	for k, v := range known {
+		m[k] = v
+	}
+	return json.Marshal(m)
 }
 
 type ResponseData struct {
 	Users []User `json:"users"`
+	// Version 为面板返回的用户列表版本号，用于锚定增量更新
+	Version string `json:"version"`
+	// Changes 为面板返回的增量变更，不支持增量的面板不返回该字段
+	Changes *UserChanges `json:"changes"`
+
+	// shape 为识别出的响应格式，用于日志
+	shape string
+	// lastModified 为面板返回的 Last-Modified 响应头
+	lastModified string
 }
 
-func getUserList(url string, etag string) ([]User, string, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// UserChanges 用户列表增量变更
+type UserChanges struct {
+	Added   []User   `json:"added"`
+	Updated []User   `json:"updated"`
+	Removed []string `json:"removed"` // 被删除用户的 UUID
+}
+
+// userListState 记录用户列表的缓存状态
+type userListState struct {
+	etag    string
+	version string
+	// shape 为上一次识别出的响应格式，变化时记录日志
+	shape string
+	// lastModified 为面板最近一次返回的 Last-Modified
+	lastModified string
+	// lastFetch、lastChange 为最近一次成功请求面板和用户列表最近一次变化的时间
+	lastFetch  time.Time
+	lastChange time.Time
+	// notModified 最近一次成功请求面板是否返回 304
+	notModified bool
+}
+
+// CacheState 用户列表的缓存状态，用于排查面板修改迟迟不生效的问题。时间为零值时省略
+type CacheState struct {
+	// ETag 为当前保存的 ETag，下次请求时作为 If-None-Match 发送
+	ETag string `json:"etag"`
+	// LastModified 为面板最近一次返回的 Last-Modified
+	LastModified string `json:"last_modified,omitempty"`
+	// LastFetch 为最近一次成功请求面板（包括返回 304）的时间
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	// LastChange 为用户列表最近一次变化的时间
+	LastChange *time.Time `json:"last_change,omitempty"`
+	// NotModified 最近一次成功请求面板是否返回 304
+	NotModified bool `json:"not_modified"`
+}
+
+// cacheState 返回 state 对应的缓存状态，调用方需持有 updateLock
+func (st *userListState) cacheState() *CacheState {
+	cs := &CacheState{ETag: st.etag, LastModified: st.lastModified, NotModified: st.notModified}
+	if !st.lastFetch.IsZero() {
+		t := st.lastFetch
+		cs.LastFetch = &t
+	}
+	if !st.lastChange.IsZero() {
+		t := st.lastChange
+		cs.LastChange = &t
+	}
+	return cs
+}
+
+// defaultUsersKey 面板响应中用户列表的默认字段名
+const defaultUsersKey = "users"
+
+// HTTPClient 返回请求面板时使用的 HTTP 客户端：优先使用 Client；
+// 其次在 InsecureSkipVerify 或设置了 Header 时使用按需创建的客户端，否则使用 http.DefaultClient
+func (v *V2RaySocksApiProvider) HTTPClient() *http.Client {
+	if v.Client != nil {
+		return v.Client
+	}
+	if !v.InsecureSkipVerify && len(v.Header) == 0 {
+		return http.DefaultClient
+	}
+	v.clientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if v.InsecureSkipVerify {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		v.client = &http.Client{
+			Transport:     &headerTransport{base: transport, header: v.Header, hosts: v.trustedHosts()},
+			CheckRedirect: checkPanelRedirect,
+		}
+	})
+	return v.client
+}
+
+// trustedHosts 返回附加 Header 的主机名：URL 所在主机和 RedirectHosts
+func (v *V2RaySocksApiProvider) trustedHosts() map[string]struct{} {
+	hosts := make(map[string]struct{}, len(v.RedirectHosts)+1)
+	if u, err := url.Parse(v.URL); err == nil && u.Hostname() != "" {
+		hosts[strings.ToLower(u.Hostname())] = struct{}{}
+	}
+	for _, h := range v.RedirectHosts {
+		hosts[strings.ToLower(h)] = struct{}{}
+	}
+	return hosts
+}
+
+// headerTransport 为发往受信任主机的请求附加请求头，发往其他主机时移除这些请求头。
+// 重定向产生的请求同样经过这里，因此跨主机重定向到受信任主机时请求头会重新附加，
+// 重定向到其他主机时不会泄露
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+	hosts  map[string]struct{}
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.header) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	_, trusted := t.hosts[strings.ToLower(req.URL.Hostname())]
+	for k, vs := range t.header {
+		if trusted {
+			req.Header[http.CanonicalHeaderKey(k)] = vs
+		} else {
+			req.Header.Del(k)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// maxPanelRedirects 面板请求最多跟随的重定向次数，与 http.Client 的默认值一致
+const maxPanelRedirects = 10
+
+// checkPanelRedirect 记录面板请求的重定向，便于排查重定向后认证失败等问题。
+// 日志中不包含查询参数，避免泄露 URL 中的令牌
+func checkPanelRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxPanelRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxPanelRedirects)
+	}
+	from := via[len(via)-1].URL
+	loopLog.Println("面板请求被重定向:", from.Host+from.Path, "->", req.URL.Host+req.URL.Path)
+	return nil
+}
+
+func getUserList(ctx context.Context, client *http.Client, rawURL string, etag string, version string, usersKey string) (*ResponseData, string, error) {
+	if version != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, "", err
+		}
+		q := u.Query()
+		q.Set("version", version)
+		u.RawQuery = q.Encode()
+		rawURL = u.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
 	if err != nil {
 		return nil, "", err
 	}
 	if etag != "" {
 		req.Header.Set("If-None-Match", etag)
 	}
+	req.Header.Set("Accept-Encoding", "gzip")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
@@ -58,81 +349,327 @@ func getUserList(url string, etag string) ([]User, string, error) {
 		return nil, etag, nil
 	}
 
-	var responseData ResponseData
-	err = json.NewDecoder(resp.Body).Decode(&responseData)
+	body, err := readBody(resp)
 	if err != nil {
 		return nil, "", err
 	}
+	responseData, err := decodeUserList(body, usersKey)
+	if err != nil {
+		return nil, "", err
+	}
+	responseData.lastModified = resp.Header.Get("Last-Modified")
 
 	newEtag := resp.Header.Get("ETag")
-	return responseData.Users, newEtag, nil
+	return responseData, newEtag, nil
 }
 
-func UpdateUsers(url string, interval time.Duration, trafficlogger server.TrafficLogger) {
-	fmt.Println("用户列表自动更新服务已激活")
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// readBody 读取响应体，Content-Encoding 为 gzip 时解压。
+// 请求中显式设置了 Accept-Encoding 后 Go 不会再自动解压，需要自行处理
+func readBody(resp *http.Response) ([]byte, error) {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return io.ReadAll(resp.Body)
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("不支持的 Content-Encoding: %s", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// decodeUserList 解析面板返回的用户列表，支持直接返回的用户数组，以及将用户列表放在 usersKey 字段下的对象。
+// 对象中既没有该字段也没有增量变更时返回错误，避免字段名不匹配时静默得到空列表导致所有用户认证失败
+func decodeUserList(body []byte, usersKey string) (*ResponseData, error) {
+	if usersKey == "" {
+		usersKey = defaultUsersKey
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var users []User
+		if err := json.Unmarshal(body, &users); err != nil {
+			return nil, err
+		}
+		return &ResponseData{Users: users, shape: "数组"}, nil
+	}
 
-	var etag string
+	var responseData ResponseData
+	if err := json.Unmarshal(body, &responseData); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	responseData.shape = fmt.Sprintf("对象（%s 字段）", usersKey)
+	raw, ok := fields[usersKey]
+	if !ok {
+		if responseData.Changes != nil {
+			return &responseData, nil
+		}
+		return nil, fmt.Errorf("面板响应中没有用户列表字段 %q", usersKey)
+	}
+	if usersKey != defaultUsersKey {
+		responseData.Users = nil
+		if err := json.Unmarshal(raw, &responseData.Users); err != nil {
+			return nil, err
+		}
+	}
+	return &responseData, nil
+}
+
+// loadUsers 返回当前用户列表，尚未加载时返回 nil
+func (v *V2RaySocksApiProvider) loadUsers() map[string]User {
+	if m := v.users.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// refresh 拉取一次用户列表，有变化时替换当前用户列表
+func (v *V2RaySocksApiProvider) refresh(trafficlogger server.TrafficLogger) error {
+	_, err := v.update(context.Background(), trafficlogger)
+	return err
+}
+
+// update 拉取一次用户列表，有变化时替换当前用户列表并返回 true。
+// 面板返回增量变更且本地已有版本号时按增量合并，否则整体替换。
+// 持有 updateLock，定时更新和手动重新加载不会同时拉取
+func (v *V2RaySocksApiProvider) update(ctx context.Context, trafficlogger server.TrafficLogger) (changed bool, err error) {
+	v.updateLock.Lock()
+	defer v.updateLock.Unlock()
+	defer func() { v.stale.Store(err != nil) }()
+
+	if v.closed {
+		return false, errProviderClosed
+	}
 
-	// 立即执行一次 getUserList
-	userList, newEtag, err := getUserList(url, etag)
+	st := &v.state
+	responseData, newEtag, err := getUserList(ctx, v.HTTPClient(), v.URL, st.etag, st.version, v.UsersKey)
 	if err != nil {
-		fmt.Println("Error:", err)
-		return // 直接返回，不进入循环
+		return false, err
+	}
+	st.lastFetch = v.now()
+	st.notModified = responseData == nil
+	if responseData != nil && responseData.lastModified != "" {
+		st.lastModified = responseData.lastModified
+	}
+	defer func() { v.cache.Store(st.cacheState()) }()
+	if responseData == nil {
+		// 304 未修改
+		return false, nil
+	}
+	etagChanged := newEtag != "" && newEtag != st.etag
+	versionChanged := responseData.Version != "" && responseData.Version != st.version
+	if !etagChanged && !versionChanged {
+		return false, nil
 	}
 
-	// 处理首次获取的用户列表
-	if newEtag != "" && newEtag != etag {
-		etag = newEtag
+	if responseData.shape != st.shape {
+		loopLog.Println("面板用户列表格式:", responseData.shape)
+		st.shape = responseData.shape
+	}
 
-		lock.Lock()
-		newUsersMap := make(map[string]User)
-		for _, user := range userList {
-			newUsersMap[user.UUID] = user
+	oldUsersMap := v.loadUsers()
+	var newUsersMap map[string]User
+	if responseData.Changes != nil && st.version != "" {
+		newUsersMap = make(map[string]User, len(oldUsersMap))
+		for uuid, user := range oldUsersMap {
+			newUsersMap[uuid] = user
+		}
+		for _, user := range responseData.Changes.Added {
+			newUsersMap[v.uuidKey(user.UUID)] = user
+		}
+		for _, user := range responseData.Changes.Updated {
+			newUsersMap[v.uuidKey(user.UUID)] = user
+		}
+		for _, uuid := range responseData.Changes.Removed {
+			delete(newUsersMap, v.uuidKey(uuid))
+		}
+	} else {
+		newUsersMap = make(map[string]User, len(responseData.Users))
+		for _, user := range responseData.Users {
+			newUsersMap[v.uuidKey(user.UUID)] = user
 		}
-		if trafficlogger != nil {
-			for uuid := range usersMap {
-				if _, exists := newUsersMap[uuid]; !exists {
-					trafficlogger.LogOnlineState(strconv.Itoa(usersMap[uuid].ID), false)
-				}
+	}
+	if err := v.checkShrink(len(oldUsersMap), len(newUsersMap)); err != nil {
+		// 保留当前用户列表，避免面板故障导致所有用户无法认证；不更新 etag，下次重新拉取
+		return false, err
+	}
+	v.users.Store(&newUsersMap)
+	v.groups.rebuild(newUsersMap)
+	if oldUsersMap == nil {
+		// 唤醒等待首次加载的认证
+		close(v.loadedCh())
+	}
+	if v.OnUpdate != nil {
+		v.OnUpdate(diffUsers(oldUsersMap, newUsersMap))
+	}
+	if trafficlogger != nil {
+		for uuid, user := range oldUsersMap {
+			if _, exists := newUsersMap[uuid]; !exists {
+				trafficlogger.LogOnlineState(strconv.Itoa(user.ID), false)
 			}
 		}
+	}
+
+	st.etag = newEtag
+	st.version = responseData.Version
+	st.lastChange = st.lastFetch
+	return true, nil
+}
 
-		usersMap = newUsersMap
-		lock.Unlock()
+// ReloadResult 手动重新加载用户列表的结果
+type ReloadResult struct {
+	// Users 重新加载后的用户数
+	Users int `json:"users"`
+	// Changed 用户列表是否有变化
+	Changed bool `json:"changed"`
+}
+
+// Reload 立即从面板拉取一次用户列表，用于面板修改用户后不等待下一次定时更新。
+// 定时更新正在进行时会等待其完成后再拉取
+func (v *V2RaySocksApiProvider) Reload(ctx context.Context) (ReloadResult, error) {
+	changed, err := v.update(ctx, v.loadTrafficLogger())
+	if err != nil {
+		return ReloadResult{}, err
 	}
+	return ReloadResult{Users: len(v.loadUsers()), Changed: changed}, nil
+}
 
-	for range ticker.C {
-		userList, newEtag, err := getUserList(url, etag)
-		if err != nil {
-			fmt.Println("Error:", err)
-			continue
+// SetTrafficLogger 替换用户列表更新时使用的 TrafficLogger，从下一次更新开始生效，无需重启更新协程
+func (v *V2RaySocksApiProvider) SetTrafficLogger(trafficlogger server.TrafficLogger) {
+	v.trafficLogger.Store(&trafficlogger)
+}
+
+// loadTrafficLogger 返回当前使用的 TrafficLogger，未设置时返回 nil
+func (v *V2RaySocksApiProvider) loadTrafficLogger() server.TrafficLogger {
+	if tl := v.trafficLogger.Load(); tl != nil {
+		return *tl
+	}
+	return nil
+}
+
+// checkShrink 检查一次更新后的用户数是否可疑：变为空（未设置 AllowEmpty），
+// 或减少的比例超过 MaxShrink。可疑时返回错误，调用方应保留当前用户列表
+func (v *V2RaySocksApiProvider) checkShrink(oldCount, newCount int) error {
+	if newCount == 0 && !v.AllowEmpty {
+		if oldCount > 0 {
+			return fmt.Errorf("面板返回的用户列表为空，保留当前的 %d 个用户，请检查面板和响应格式", oldCount)
 		}
+		// 首次加载没有可保留的列表
+		loopLog.Println("警告: 面板返回的用户列表为空，请检查面板和响应格式")
+		return nil
+	}
+	if v.MaxShrink > 0 && oldCount > 0 && newCount < oldCount {
+		if shrink := float64(oldCount-newCount) / float64(oldCount); shrink > v.MaxShrink {
+			return fmt.Errorf("用户数从 %d 减少到 %d（%.0f%%），超过允许的 %.0f%%，保留当前用户列表",
+				oldCount, newCount, shrink*100, v.MaxShrink*100)
+		}
+	}
+	return nil
+}
 
-		if newEtag != "" && newEtag != etag {
-			etag = newEtag
+// UpdateUsers 定时从面板拉取用户列表。trafficlogger 不为空时作为初始的 TrafficLogger，
+// 之后可通过 SetTrafficLogger 替换，每次更新都会重新读取
+func (v *V2RaySocksApiProvider) UpdateUsers(interval time.Duration, trafficlogger server.TrafficLogger) {
+	loopLog.Println("用户列表自动更新服务已激活")
+	if trafficlogger != nil {
+		v.SetTrafficLogger(trafficlogger)
+	}
 
-			lock.Lock()
-			newUsersMap := make(map[string]User)
-			for _, user := range userList {
-				newUsersMap[user.UUID] = user
-			}
-			if trafficlogger != nil {
-				for uuid := range usersMap {
-					if _, exists := newUsersMap[uuid]; !exists {
-						trafficlogger.LogOnlineState(strconv.Itoa(usersMap[uuid].ID), false)
-					}
-				}
-			}
+	v.startupDeadlineAt()
+
+	// 立即执行一次 getUserList，失败时在之后的定时更新中重试
+	if err := v.refresh(v.loadTrafficLogger()); err != nil {
+		if errors.Is(err, errProviderClosed) {
+			return
+		}
+		loopLog.Println("Error:", err)
+	}
+
+	ticker := utils.NewJitterTicker(interval, v.Jitter)
+	defer ticker.Stop()
 
-			usersMap = newUsersMap
-			lock.Unlock()
+	for {
+		select {
+		case <-ticker.C:
+		case <-v.doneCh():
+			return
 		}
+		if err := v.refresh(v.loadTrafficLogger()); err != nil {
+			if errors.Is(err, errProviderClosed) {
+				return
+			}
+			loopLog.Println("Error:", err)
+			continue
+		}
+	}
+}
+
+// doneCh 返回 Close 时关闭的通道
+func (v *V2RaySocksApiProvider) doneCh() chan struct{} {
+	v.doneOnce.Do(func() { v.done = make(chan struct{}) })
+	return v.done
+}
+
+// loadedCh 返回用户列表首次加载完成时关闭的通道
+func (v *V2RaySocksApiProvider) loadedCh() chan struct{} {
+	v.loadedOnce.Do(func() { v.loaded = make(chan struct{}) })
+	return v.loaded
+}
+
+// now 返回当前时间，设置了 Now 时使用 Now
+func (v *V2RaySocksApiProvider) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// startupDeadlineAt 返回 StartupWait 的截止时间，首次调用时确定
+func (v *V2RaySocksApiProvider) startupDeadlineAt() time.Time {
+	v.startupOnce.Do(func() { v.startupDeadline = v.now().Add(v.StartupWait) })
+	return v.startupDeadline
+}
+
+// waitLoaded 在设置了 StartupWait 时等待用户列表首次加载，返回加载后的用户列表，超时时返回 nil。
+// 所有认证共用同一个截止时间，首次加载失败后截止时间之后的认证不再等待
+func (v *V2RaySocksApiProvider) waitLoaded() map[string]User {
+	if v.StartupWait <= 0 {
+		return nil
+	}
+	wait := v.startupDeadlineAt().Sub(v.now())
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-v.loadedCh():
+		return v.loadUsers()
+	case <-timer.C:
+		return nil
 	}
 }
 
-func getResponseEtag(url string, etag string) (string, error) {
+// Close 停止 UpdateUsers 的定时更新并等待正在进行的更新完成，之后的 Reload 返回错误。
+// 已加载的用户列表保留，认证不受影响。可重复调用
+func (v *V2RaySocksApiProvider) Close() error {
+	v.updateLock.Lock()
+	defer v.updateLock.Unlock()
+
+	if !v.closed {
+		v.closed = true
+		close(v.doneCh())
+	}
+	return nil
+}
+
+func getResponseEtag(client *http.Client, url string, etag string) (string, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", err
@@ -141,8 +678,9 @@ func getResponseEtag(url string, etag string) (string, error) {
 	if etag != "" {
 		req.Header.Set("If-None-Match", etag)
 	}
+	req.Header.Set("Accept-Encoding", "gzip")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -156,50 +694,180 @@ func getResponseEtag(url string, etag string) (string, error) {
 	return newEtag, nil
 }
 
-func CheckRemoteConf(url string, interval time.Duration) {
-	fmt.Println("远程配置文件监控服务已激活")
-	ticker := time.NewTicker(interval)
+// CheckRemoteConf 定时检查远程配置是否变化，变化时重启进程。jitter 为检查间隔的随机浮动比例，
+// client 为 nil 时使用 http.DefaultClient。ETag 变化后会再拉取两次内容确认变化已稳定，
+// 且距上次重启（进程启动）不足 minRestartInterval 时推迟重启，避免上游抖动导致反复重启
+func CheckRemoteConf(url string, interval time.Duration, jitter float64, client *http.Client, minRestartInterval time.Duration) {
+	loopLog.Println("远程配置文件监控服务已激活")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ticker := utils.NewJitterTicker(interval, jitter)
 	defer ticker.Stop()
 
-	var etag string
+	w := &remoteConfWatcher{
+		client:      client,
+		url:         url,
+		minInterval: minRestartInterval,
+		started:     processStart,
+		now:         time.Now,
+	}
 
 	for range ticker.C {
-		newEtag, err := getResponseEtag(url, etag)
+		changed, err := w.check()
 		if err != nil {
-			fmt.Println("Error:", err)
+			loopLog.Println("Error:", err)
 			continue
 		}
-		// 如果etag不同，则进行相应的操作
-		if etag != "" && newEtag != etag {
-			fmt.Println("远程配置文件已更改，程序即将重启...")
+		if changed {
+			loopLog.Println("远程配置文件已更改，程序即将重启...")
 			// 创建一个重新启动的命令
 			cmd := exec.Command(os.Args[0], os.Args[1:]...) // os.Args[0] 是当前程序的路径，os.Args[1:] 是传递给程序的参数
 
 			// 启动新进程
 			err := cmd.Start()
 			if err != nil {
-				fmt.Println("启动新进程失败:", err)
+				loopLog.Println("启动新进程失败:", err)
 				return
 			}
 
 			// 退出当前程序
 			os.Exit(0)
-		} else {
-			// 更新etag值
-			etag = newEtag
 		}
 	}
 }
 
+// SelfTest 拉取一次用户列表，检查面板是否可达且返回的数据可以解析。
+// 不会修改当前的用户列表。
+func (v *V2RaySocksApiProvider) SelfTest(ctx context.Context) error {
+	responseData, _, err := getUserList(ctx, v.HTTPClient(), v.URL, "", "", v.UsersKey)
+	if err != nil {
+		return err
+	}
+	if responseData == nil {
+		return errors.New("面板返回 304，但请求未携带 ETag")
+	}
+	return nil
+}
+
+// Users 返回当前用户列表的快照，按用户 ID 排序
+func (v *V2RaySocksApiProvider) Users() []User {
+	return sortedUsers(v.loadUsers())
+}
+
+// diffUsers 比较新旧用户表，返回新增、移除和字段有变化的用户，均按用户 ID 排序
+func diffUsers(oldUsers, newUsers map[string]User) (added, removed, changed []User) {
+	for uuid, user := range newUsers {
+		old, exists := oldUsers[uuid]
+		if !exists {
+			added = append(added, user)
+		} else if !reflect.DeepEqual(old, user) {
+			changed = append(changed, user)
+		}
+	}
+	for uuid, user := range oldUsers {
+		if _, exists := newUsers[uuid]; !exists {
+			removed = append(removed, user)
+		}
+	}
+	for _, users := range [][]User{added, removed, changed} {
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	}
+	return added, removed, changed
+}
+
+// sortedUsers 将用户表转为按用户 ID 排序的列表
+func sortedUsers(m map[string]User) []User {
+	users := make([]User, 0, len(m))
+	for _, user := range m {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// Validate 检查配置是否有效，返回所有无效配置项的汇总错误，便于启动时尽早失败
+func (v *V2RaySocksApiProvider) Validate() error {
+	var errs []error
+	if err := utils.ValidateHTTPURL(v.URL); err != nil {
+		errs = append(errs, fmt.Errorf("URL: %w", err))
+	}
+	if err := utils.ValidateFraction(v.Jitter); err != nil {
+		errs = append(errs, fmt.Errorf("Jitter: %w", err))
+	}
+	if err := utils.ValidateFraction(v.MaxShrink); err != nil {
+		errs = append(errs, fmt.Errorf("MaxShrink: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// GroupMembers 返回分组内所有用户的 ID
+func (v *V2RaySocksApiProvider) GroupMembers(group string) []string {
+	return v.groups.members(group)
+}
+
+// AuthMetrics 返回认证计数
+func (v *V2RaySocksApiProvider) AuthMetrics() AuthMetrics {
+	return v.metrics.snapshot()
+}
+
+// 用户限制的来源，由 LimitSource 返回
+const (
+	LimitSourcePanel  = "panel"  // 最近一次从面板成功更新的用户列表
+	LimitSourceCache  = "cache"  // 最近一次更新失败，沿用之前从面板拉取的用户列表
+	LimitSourceStatic = "static" // 配置文件中的固定用户列表
+)
+
+// LimitSource 返回当前用户列表（及其中的限速、设备数限制）的来源：
+// 最近一次更新成功时为 LimitSourcePanel，失败时为 LimitSourceCache
+func (v *V2RaySocksApiProvider) LimitSource() string {
+	if v.stale.Load() {
+		return LimitSourceCache
+	}
+	return LimitSourcePanel
+}
+
+// CacheState 返回用户列表的缓存状态，尚未成功请求过面板时返回零值。
+// 不等待正在进行的更新，返回的是最近一次成功请求面板后的状态
+func (v *V2RaySocksApiProvider) CacheState() CacheState {
+	if cs := v.cache.Load(); cs != nil {
+		return *cs
+	}
+	return CacheState{}
+}
+
 // 验证代码
 func (v *V2RaySocksApiProvider) Authenticate(addr net.Addr, auth string, tx uint64) (ok bool, id string) {
+	start := v.metrics.begin()
+	defer func() { v.metrics.end(start, ok) }()
 
-	// 获取判断连接用户是否在用户列表内
-	lock.Lock()
-	defer lock.Unlock()
+	// 获取判断连接用户是否在用户列表内，无锁读取当前用户列表
+	users := v.loadUsers()
+	if users == nil {
+		users = v.waitLoaded()
+	}
+	if users == nil {
+		return v.OnReject.reject(addr, RejectNotLoaded)
+	}
+	user, exists := users[v.uuidKey(auth)]
+	if !exists {
+		return v.OnReject.reject(addr, RejectUnknownUser)
+	}
+	if ok, id = user.authID(); !ok {
+		return v.OnReject.reject(addr, RejectInvalidID)
+	}
+	return ok, id
+}
 
-	if user, exists := usersMap[auth]; exists {
-		return true, strconv.Itoa(user.ID)
+// uuidKey 返回 UUID 在用户列表中的键，未设置 CaseSensitiveUUID 时按 normalizeUUID 规范化
+func (v *V2RaySocksApiProvider) uuidKey(uuid string) string {
+	if v.CaseSensitiveUUID {
+		return uuid
 	}
-	return false, ""
+	return normalizeUUID(uuid)
+}
+
+// normalizeUUID 去除 UUID 的首尾空白并转为小写，避免大小写或空白不一致导致认证失败
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.TrimSpace(uuid))
 }
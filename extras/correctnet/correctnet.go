@@ -90,3 +90,14 @@ func HTTPListenAndServe(address string, handler http.Handler) error {
 	defer listener.Close()
 	return http.Serve(listener, handler)
 }
+
+// HTTPServerListenAndServe is like HTTPListenAndServe, but serves with srv so
+// that its timeouts and other settings apply. srv.Addr is ignored.
+func HTTPServerListenAndServe(address string, srv *http.Server) error {
+	listener, err := Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return srv.Serve(listener)
+}
@@ -0,0 +1,439 @@
+package trafficlogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// BacklogMode 面板长时间无法提交时对积压流量的处理方式
+type BacklogMode int
+
+const (
+	// BacklogRetain 一直保留积压的流量（默认）
+	BacklogRetain BacklogMode = iota
+	// BacklogCap 只保留流量最高的 MaxUsers 个用户，其余丢弃
+	BacklogCap
+	// BacklogSpill 将积压的流量写入 SpillFile 并从内存中清除，提交恢复后再读回
+	BacklogSpill
+)
+
+const (
+	defaultBacklogMaxFailures = 10
+	defaultBacklogMaxUsers    = 10000
+)
+
+// BacklogPolicy 持续提交失败时的积压处理策略。
+// 连续失败 MaxFailures 次或持续失败 MaxDuration 后按 Mode 处理积压的流量，之后每次失败都会再次处理
+type BacklogPolicy struct {
+	Mode        BacklogMode
+	MaxFailures int
+	MaxDuration time.Duration
+	// MaxUsers Mode 为 BacklogCap 时保留的最大用户数
+	MaxUsers int
+	// SpillFile Mode 为 BacklogSpill 时追加写入的文件，每次溢出写入一行。每次提交时读回并一并提交，
+	// 面板接受后才从文件中删除，提交失败或进程退出时仍保留在文件中
+	SpillFile string
+	// MaxSpillSize 溢出文件的最大字节数，超过时先压缩文件，仍然放不下的流量保留在内存中。默认不限制
+	MaxSpillSize int64
+	// MaxSpillAge 溢出文件中记录的最长保留时间，读回时丢弃更早的记录。默认不限制
+	MaxSpillAge time.Duration
+}
+
+// ParseBacklogMode 解析配置中的积压处理方式，空字符串视为 retain
+func ParseBacklogMode(s string) (BacklogMode, error) {
+	switch s {
+	case "", "retain":
+		return BacklogRetain, nil
+	case "cap":
+		return BacklogCap, nil
+	case "spill":
+		return BacklogSpill, nil
+	default:
+		return 0, fmt.Errorf("unsupported backlog mode %q", s)
+	}
+}
+
+// pushHealth 流量提交的健康状态，由 Mutex 保护
+type pushHealth struct {
+	failures     int
+	failingSince time.Time
+}
+
+// recordPushResult 记录一次提交的结果，持续失败时按积压策略处理。调用方需持有 pushLock
+func (s *trafficStatsServerImpl) recordPushResult(err error, now time.Time) {
+	s.Mutex.Lock()
+	if err == nil {
+		s.pushHealth = pushHealth{}
+	} else {
+		if s.pushHealth.failures == 0 {
+			s.pushHealth.failingSince = now
+		}
+		s.pushHealth.failures++
+	}
+	health := s.pushHealth
+	s.Mutex.Unlock()
+
+	p := s.backlog
+	if err == nil || p.Mode == BacklogRetain {
+		return
+	}
+	if (p.MaxFailures <= 0 || health.failures < p.MaxFailures) &&
+		(p.MaxDuration <= 0 || now.Sub(health.failingSince) < p.MaxDuration) {
+		return
+	}
+	switch p.Mode {
+	case BacklogCap:
+		s.capBacklog(p.MaxUsers)
+	case BacklogSpill:
+		if err := s.spillBacklog(now); err != nil {
+			s.logger.Println("流量记录写入溢出文件失败:", err)
+		}
+	}
+}
+
+// capBacklog 只保留流量最高的 maxUsers 个用户和被踢出后尚未提交的用户，其余丢弃
+func (s *trafficStatsServerImpl) capBacklog(maxUsers int) {
+	keep := s.topTraffic(maxUsers, func(u TopUser) uint64 { return u.Total })
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if len(s.StatsMap) <= maxUsers {
+		return
+	}
+	kept := make(map[string]*trafficStatsEntry, len(keep))
+	for _, u := range keep {
+		if entry, ok := s.StatsMap[u.ID]; ok {
+			kept[u.ID] = entry
+		}
+	}
+	// 被踢出的用户的剩余流量不会再增加，也不能再从连接中补回，不参与裁剪
+	for id := range s.kickedUnpushed {
+		if entry, ok := s.StatsMap[id]; ok {
+			kept[id] = entry
+		}
+	}
+	var dropped uint64
+	for id, entry := range s.StatsMap {
+		if _, ok := kept[id]; !ok {
+			dropped += entry.Tx + entry.Rx
+			delete(s.firstSeen, id)
+		}
+	}
+	s.logger.Println(fmt.Sprintf("流量提交持续失败，丢弃 %d 个用户共 %d 字节的积压流量", len(s.StatsMap)-len(kept), dropped))
+	s.StatsMap = kept
+}
+
+// spillRecord 溢出文件中的一行，记录一次写入的时间和流量，以及其中被踢出后尚未提交的用户
+type spillRecord struct {
+	Time    int64                        `json:"t"`
+	Traffic map[string]trafficStatsEntry `json:"traffic"`
+	Kicked  []string                     `json:"kicked,omitempty"`
+}
+
+// spilledTraffic 溢出文件中所有有效记录合并后的结果
+type spilledTraffic struct {
+	traffic map[string]trafficStatsEntry
+	// firstSeen 用户 ID -> 包含该用户的最早一条记录的时间
+	firstSeen map[string]time.Time
+	kicked    map[string]struct{}
+	// oldest 最早一条有效记录的时间
+	oldest time.Time
+	// dropped 文件中有被跳过的无效或过期记录
+	dropped bool
+}
+
+// readSpill 逐行读取溢出文件并合并为每个用户的流量。
+// 无法解析的行（例如写入时进程退出留下的半行）和超过 MaxSpillAge 的记录会被跳过并记录日志。
+// 文件不存在时返回 nil
+func (s *trafficStatsServerImpl) readSpill(now time.Time) (*spilledTraffic, error) {
+	bs, err := os.ReadFile(s.backlog.SpillFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	spilled := &spilledTraffic{
+		traffic:   make(map[string]trafficStatsEntry),
+		firstSeen: make(map[string]time.Time),
+		kicked:    make(map[string]struct{}),
+	}
+	var corrupt, expired int
+	var expiredBytes uint64
+	for _, line := range bytes.Split(bs, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var rec spillRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Traffic == nil {
+			corrupt++
+			continue
+		}
+		t := time.Unix(rec.Time, 0)
+		if s.backlog.MaxSpillAge > 0 && now.Sub(t) > s.backlog.MaxSpillAge {
+			expired++
+			for _, stats := range rec.Traffic {
+				expiredBytes += stats.Tx + stats.Rx
+			}
+			continue
+		}
+		if spilled.oldest.IsZero() || t.Before(spilled.oldest) {
+			spilled.oldest = t
+		}
+		for id, stats := range rec.Traffic {
+			e := spilled.traffic[id]
+			e.Tx += stats.Tx
+			e.Rx += stats.Rx
+			spilled.traffic[id] = e
+			if first, ok := spilled.firstSeen[id]; !ok || t.Before(first) {
+				spilled.firstSeen[id] = t
+			}
+		}
+		for _, id := range rec.Kicked {
+			spilled.kicked[id] = struct{}{}
+		}
+	}
+	spilled.dropped = corrupt > 0 || expired > 0
+	if corrupt > 0 {
+		s.logger.Println(fmt.Sprintf("溢出文件中有 %d 行无法解析，已跳过", corrupt))
+	}
+	if expired > 0 {
+		s.logger.Println(fmt.Sprintf("溢出文件中有 %d 条记录超过保留时间，丢弃共 %d 字节的流量", expired, expiredBytes))
+	}
+	return spilled, nil
+}
+
+// spilledKicked 返回 snapshot 中被踢出后尚未提交的用户，写入溢出文件以便读回后继续保留标记
+func (s *trafficStatsServerImpl) spilledKicked(snapshot map[string]trafficStatsEntry) []string {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	var kicked []string
+	for id := range snapshot {
+		if _, ok := s.kickedUnpushed[id]; ok {
+			kicked = append(kicked, id)
+		}
+	}
+	sort.Strings(kicked)
+	return kicked
+}
+
+// spillBacklog 将当前积压的流量追加写入溢出文件，写入成功后从内存中扣除。
+// 追加后文件会超过 MaxSpillSize 时先压缩文件（合并所有记录并丢弃无效和过期的记录），
+// 压缩后仍然放不下时流量保留在内存中
+func (s *trafficStatsServerImpl) spillBacklog(now time.Time) error {
+	snapshot := s.snapshotTraffic()
+	if len(snapshot) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(spillRecord{Time: now.Unix(), Traffic: snapshot, Kicked: s.spilledKicked(snapshot)})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if maxSize := s.backlog.MaxSpillSize; maxSize > 0 {
+		size, err := s.spillSize()
+		if err != nil {
+			return err
+		}
+		if size+int64(len(line)) > maxSize {
+			if size, err = s.compactSpill(now); err != nil {
+				return err
+			}
+			if size+int64(len(line)) > maxSize {
+				return fmt.Errorf("spill file would exceed %d bytes, keeping traffic in memory", maxSize)
+			}
+		}
+	}
+	f, err := os.OpenFile(s.backlog.SpillFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	// 上次写入时进程退出可能留下没有换行的半行，先补上换行，避免新记录与其拼接成无法解析的一行
+	if fi, statErr := f.Stat(); statErr == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	s.deductTraffic(snapshot)
+	return nil
+}
+
+// spillSize 返回溢出文件的大小，文件不存在时返回 0
+func (s *trafficStatsServerImpl) spillSize() (int64, error) {
+	fi, err := os.Stat(s.backlog.SpillFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// compactSpill 将溢出文件中的有效记录合并为一行重新写入，记录时间取最早的一条，返回压缩后的大小
+func (s *trafficStatsServerImpl) compactSpill(now time.Time) (int64, error) {
+	spilled, err := s.readSpill(now)
+	if err != nil || spilled == nil {
+		return 0, err
+	}
+	return s.writeSpill(spilled.oldest, spilled.traffic, spilled.kicked)
+}
+
+// writeSpill 用一条记录替换溢出文件的内容，traffic 为空时删除文件，返回写入后的大小。
+// 先写入临时文件再重命名，写入过程中进程退出不会破坏原文件
+func (s *trafficStatsServerImpl) writeSpill(t time.Time, traffic map[string]trafficStatsEntry, kicked map[string]struct{}) (int64, error) {
+	if len(traffic) == 0 {
+		if err := os.Remove(s.backlog.SpillFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	rec := spillRecord{Time: t.Unix(), Traffic: traffic}
+	for id := range kicked {
+		if _, ok := traffic[id]; ok {
+			rec.Kicked = append(rec.Kicked, id)
+		}
+	}
+	sort.Strings(rec.Kicked)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	tmp := s.backlog.SpillFile + ".tmp"
+	if err := os.WriteFile(tmp, line, 0o600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, s.backlog.SpillFile); err != nil {
+		return 0, err
+	}
+	return int64(len(line)), nil
+}
+
+// restoreSpill 将溢出文件中的流量读回内存，随本次提交一并提交。文件保留到 settleSpill 确认提交结果后再更新，
+// 读回后进程退出或提交失败都不会丢失这部分流量。firstSeen 取溢出时的记录时间，被踢出的用户恢复 kickedUnpushed 标记。
+// 没有溢出文件时返回 nil，调用方需持有 pushLock
+func (s *trafficStatsServerImpl) restoreSpill(now time.Time) (*spilledTraffic, error) {
+	spilled, err := s.readSpill(now)
+	if err != nil || spilled == nil {
+		return nil, err
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, stats := range spilled.traffic {
+		entry, ok := s.StatsMap[id]
+		if !ok {
+			entry = &trafficStatsEntry{}
+			s.StatsMap[id] = entry
+		}
+		entry.Tx += stats.Tx
+		entry.Rx += stats.Rx
+		if first, ok := s.firstSeen[id]; !ok || spilled.firstSeen[id].Before(first) {
+			s.firstSeen[id] = spilled.firstSeen[id]
+		}
+		if _, ok := spilled.kicked[id]; ok {
+			s.kickedUnpushed[id] = struct{}{}
+		}
+	}
+	return spilled, nil
+}
+
+// settleSpill 在提交结束（已扣除被接受的流量）后处理 restoreSpill 读回的流量：每个用户仍留在内存中的流量
+// 不超过读回的部分时视为尚未提交，从内存移回溢出文件；读回的流量全部提交后删除文件。
+// 提交失败时全部移回，文件中没有无效或过期记录时内容不变。调用方需持有 pushLock
+func (s *trafficStatsServerImpl) settleSpill(restored *spilledTraffic) {
+	if restored == nil {
+		return
+	}
+	remaining := make(map[string]trafficStatsEntry)
+	changed := restored.dropped
+	s.Mutex.Lock()
+	for id, r := range restored.traffic {
+		var keep trafficStatsEntry
+		if entry, ok := s.StatsMap[id]; ok {
+			keep = trafficStatsEntry{Tx: min(r.Tx, entry.Tx), Rx: min(r.Rx, entry.Rx)}
+			entry.Tx -= keep.Tx
+			entry.Rx -= keep.Rx
+			if entry.Tx == 0 && entry.Rx == 0 {
+				delete(s.StatsMap, id)
+				delete(s.firstSeen, id)
+			}
+		}
+		if keep != r {
+			changed = true
+		}
+		if keep.Tx > 0 || keep.Rx > 0 {
+			remaining[id] = keep
+		}
+	}
+	s.Mutex.Unlock()
+	if !changed {
+		return
+	}
+	if _, err := s.writeSpill(restored.oldest, remaining, restored.kicked); err != nil {
+		s.logger.Println("更新溢出文件失败:", err)
+	}
+}
+
+// healthResponse GET /healthz 的返回结果
+type healthResponse struct {
+	OK                  bool       `json:"ok"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	FailingSince        *time.Time `json:"failing_since,omitempty"`
+	BacklogUsers        int        `json:"backlog_users"`
+	BacklogBytes        uint64     `json:"backlog_bytes"`
+	// Paused 流量统计是否已暂停
+	Paused bool `json:"paused"`
+	// KickQueueDepth、KickNotificationsDropped 踢出通知队列中等待的通知数和因队列已满丢弃的通知数，
+	// 仅在启用 WithKickQueue 时返回
+	KickQueueDepth           *int    `json:"kick_queue_depth,omitempty"`
+	KickNotificationsDropped *uint64 `json:"kick_notifications_dropped,omitempty"`
+}
+
+// getHealth 返回流量提交的健康状态和尚未提交的积压流量，提交持续失败时返回 503
+func (s *trafficStatsServerImpl) getHealth(w http.ResponseWriter, r *http.Request) {
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	health := s.pushHealth
+	result := healthResponse{OK: health.failures == 0, ConsecutiveFailures: health.failures, Paused: s.paused.Load()}
+	if health.failures > 0 {
+		result.FailingSince = &health.failingSince
+	}
+	result.BacklogUsers = len(s.StatsMap)
+	for _, entry := range s.StatsMap {
+		result.BacklogBytes += entry.Tx + entry.Rx
+	}
+	s.Mutex.RUnlock()
+	if q := s.kickQueue; q != nil {
+		depth, dropped := len(q.ch), q.dropped.Load()
+		result.KickQueueDepth, result.KickNotificationsDropped = &depth, &dropped
+	}
+
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !result.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(jb)
+}
@@ -0,0 +1,173 @@
+package trafficlogger
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFlakyPanel(t *testing.T, fail *bool) *httptest.Server {
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(panel.Close)
+	return panel
+}
+
+func TestBacklogCap(t *testing.T) {
+	fail := true
+	panel := newFlakyPanel(t, &fail)
+	s := newTestServer(WithBacklogPolicy(BacklogPolicy{Mode: BacklogCap, MaxFailures: 2, MaxUsers: 2}))
+	for i := 1; i <= 5; i++ {
+		s.LogTraffic(strconv.Itoa(i), uint64(i), 0)
+	}
+
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, s.StatsMap, 5)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, s.StatsMap, 2)
+	assert.Contains(t, s.StatsMap, "5")
+	assert.Contains(t, s.StatsMap, "4")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"consecutive_failures":2`)
+	assert.Contains(t, rec.Body.String(), `"backlog_bytes":9`)
+
+	fail = false
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// A push with nothing to send also clears the failure state
+	fail = true
+	s.LogTraffic("1", 1, 0)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	s.StatsMap = make(map[string]*trafficStatsEntry)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestBacklogSpill(t *testing.T) {
+	fail := true
+	panel := newFlakyPanel(t, &fail)
+	file := filepath.Join(t.TempDir(), "spill.json")
+	s := newTestServer(WithBacklogPolicy(BacklogPolicy{Mode: BacklogSpill, MaxFailures: 1, SpillFile: file}))
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	s.LogTraffic("1", 1, 2)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	s.LogTraffic("1", 10, 20)
+	s.NewKick("1")
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+	bs, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"t\":1000,\"traffic\":{\"1\":{\"tx\":1,\"rx\":2}}}\n{\"t\":1000,\"traffic\":{\"1\":{\"tx\":10,\"rx\":20}},\"kicked\":[\"1\"]}\n", string(bs))
+
+	// Restored traffic keeps when it was first seen and whether the user was kicked,
+	// and goes back to the file untouched when it is not pushed
+	now = time.Unix(2000, 0)
+	restored, err := s.restoreSpill(now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*trafficStatsEntry{"1": {Tx: 11, Rx: 22}}, s.StatsMap)
+	assert.Equal(t, time.Unix(1000, 0), s.firstSeen["1"])
+	assert.Contains(t, s.kickedUnpushed, "1")
+	s.settleSpill(restored)
+	assert.Empty(t, s.StatsMap)
+	after, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, string(bs), string(after))
+
+	// A failed push keeps the spilled traffic in the file
+	s.LogTraffic("2", 1, 1)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+	spilled, err := s.readSpill(now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]trafficStatsEntry{"1": {Tx: 11, Rx: 22}, "2": {Tx: 1, Rx: 1}}, spilled.traffic)
+
+	// Spilled traffic is pushed together with new traffic once the panel recovers,
+	// and the file is removed only after the push succeeds
+	fail = false
+	s.LogTraffic("3", 1, 1)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBacklogSpillIdleRestart(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+	file := filepath.Join(t.TempDir(), "spill.json")
+	require.NoError(t, os.WriteFile(file, []byte("{\"t\":1000,\"traffic\":{\"1\":{\"tx\":5,\"rx\":5}}}\n"), 0o600))
+
+	// Spilled traffic is pushed after a restart even when the node has no new traffic
+	s := newTestServer(WithBacklogPolicy(BacklogPolicy{Mode: BacklogSpill, MaxFailures: 1, SpillFile: file}))
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":5,"d":5}]`, pushed)
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBacklogSpillLimits(t *testing.T) {
+	fail := true
+	panel := newFlakyPanel(t, &fail)
+	file := filepath.Join(t.TempDir(), "spill.json")
+	s := newTestServer(WithBacklogPolicy(BacklogPolicy{
+		Mode: BacklogSpill, MaxFailures: 1, SpillFile: file,
+		MaxSpillSize: 110, MaxSpillAge: time.Hour,
+	}))
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	// A half-written line left by a crash is skipped and does not swallow the next record
+	require.NoError(t, os.WriteFile(file, []byte("{\"t\":1000,\"traffic\":{\"1\":{\"tx\":5,\"rx\":5}}}\n{\"t\":9"), 0o600))
+	s.LogTraffic("2", 1, 1)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+	spilled, err := s.readSpill(now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]trafficStatsEntry{"1": {Tx: 5, Rx: 5}, "2": {Tx: 1, Rx: 1}}, spilled.traffic)
+
+	// The file is compacted when it would grow past the limit, and traffic that
+	// still does not fit stays in memory
+	now = now.Add(time.Minute)
+	s.LogTraffic("3", 1, 1)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+	bs, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(bs), 110)
+	s.LogTraffic("1234567890123456789", 1, 1)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, s.StatsMap, 1)
+
+	// Records older than MaxSpillAge are dropped when the panel recovers
+	now = now.Add(2 * time.Hour)
+	fail = false
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
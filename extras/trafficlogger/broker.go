@@ -0,0 +1,202 @@
+package trafficlogger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// BrokerKind 消息队列的类型
+type BrokerKind int
+
+const (
+	// BrokerRedis 通过 Redis PUBLISH 发布到频道
+	BrokerRedis BrokerKind = iota
+	// BrokerNATS 通过 NATS PUB 发布到主题
+	BrokerNATS
+)
+
+// ParseBrokerKind 解析配置中的消息队列类型
+func ParseBrokerKind(s string) (BrokerKind, error) {
+	switch s {
+	case "redis":
+		return BrokerRedis, nil
+	case "nats":
+		return BrokerNATS, nil
+	default:
+		return 0, fmt.Errorf("unsupported broker %q", s)
+	}
+}
+
+// defaultBrokerTimeout ctx 没有截止时间时连接和发布的超时时间
+const defaultBrokerTimeout = 10 * time.Second
+
+// BrokerSink 将流量数据发布到 Redis 频道或 NATS 主题，供事件驱动的计费系统直接消费，无需轮询 HTTP 接口。
+// 默认每次提交发布一条消息，内容与向面板提交的 JSON 数组相同；PerEntry 为 true 时每个用户发布一条消息，
+// 内容为单个用户的 JSON 对象。每次提交建立一个新连接，发布完成后关闭，不支持 TLS
+type BrokerSink struct {
+	Kind BrokerKind
+	// Addr 为消息队列的地址，例如 127.0.0.1:6379 或 127.0.0.1:4222
+	Addr string
+	// Subject 为 Redis 频道名或 NATS 主题
+	Subject string
+	// Username、Password 不为空时用于认证：Redis 发送 AUTH，NATS 在 CONNECT 中携带
+	Username string
+	Password string
+	// PerEntry 为 true 时每个用户发布一条消息
+	PerEntry bool
+	// NumberFormat 为流量数值的编码方式，默认为 NumberFormatInt64
+	NumberFormat NumberFormat
+	// Dialer 为 nil 时使用默认的 net.Dialer
+	Dialer *net.Dialer
+}
+
+func (k *BrokerSink) Push(ctx context.Context, entries []TrafficPushEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	messages, err := k.encode(entries)
+	if err != nil {
+		return err
+	}
+	dialer := k.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultBrokerTimeout)
+		defer cancel()
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", k.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if k.Kind == BrokerNATS {
+		return k.publishNATS(rw, messages)
+	}
+	return k.publishRedis(rw, messages)
+}
+
+// encode 按 PerEntry 将流量数据编码为一条或多条消息
+func (k *BrokerSink) encode(entries []TrafficPushEntry) ([][]byte, error) {
+	if !k.PerEntry {
+		jb, err := encodeEntries(entries, k.NumberFormat, "")
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{jb}, nil
+	}
+	messages := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		jb, err := json.Marshal(newEncodedEntry(e, k.NumberFormat, ""))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, jb)
+	}
+	return messages, nil
+}
+
+// publishRedis 以 RESP 协议依次发送 AUTH 和 PUBLISH 命令，并逐个检查回复
+func (k *BrokerSink) publishRedis(rw *bufio.ReadWriter, messages [][]byte) error {
+	var commands [][][]byte
+	if k.Password != "" {
+		auth := [][]byte{[]byte("AUTH"), []byte(k.Password)}
+		if k.Username != "" {
+			auth = [][]byte{[]byte("AUTH"), []byte(k.Username), []byte(k.Password)}
+		}
+		commands = append(commands, auth)
+	}
+	for _, msg := range messages {
+		commands = append(commands, [][]byte{[]byte("PUBLISH"), []byte(k.Subject), msg})
+	}
+	// 命令一次性写出（pipeline），再按顺序读取回复
+	for _, args := range commands {
+		fmt.Fprintf(rw, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(rw, "$%d\r\n", len(arg))
+			_, _ = rw.Write(arg)
+			_, _ = rw.WriteString("\r\n")
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	for range commands {
+		line, err := readBrokerLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "-") {
+			return errors.New("redis: " + line[1:])
+		}
+	}
+	return nil
+}
+
+// publishNATS 发送 CONNECT 和 PUB，最后以 PING 确认服务器已处理前面的所有命令
+func (k *BrokerSink) publishNATS(rw *bufio.ReadWriter, messages [][]byte) error {
+	connect := map[string]any{"verbose": false, "pedantic": false, "name": "hysteria-trafficlogger"}
+	if k.Username != "" {
+		connect["user"] = k.Username
+	}
+	if k.Password != "" {
+		connect["pass"] = k.Password
+	}
+	jb, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	_, _ = rw.WriteString("CONNECT ")
+	_, _ = rw.Write(jb)
+	_, _ = rw.WriteString("\r\n")
+	for _, msg := range messages {
+		fmt.Fprintf(rw, "PUB %s %d\r\n", k.Subject, len(msg))
+		_, _ = rw.Write(msg)
+		_, _ = rw.WriteString("\r\n")
+	}
+	_, _ = rw.WriteString("PING\r\n")
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := readBrokerLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(line[len("-ERR"):]))
+		case line == "PING":
+			_, _ = rw.WriteString("PONG\r\n")
+			if err := rw.Flush(); err != nil {
+				return err
+			}
+		}
+		// 连接时服务器发送的 INFO 和 +OK 等其他消息忽略
+	}
+}
+
+// readBrokerLine 读取一行以 \r\n 结尾的回复
+func readBrokerLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
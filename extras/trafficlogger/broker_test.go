@@ -0,0 +1,115 @@
+package trafficlogger
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroker accepts a single connection and passes it to serve, returning the address
+func fakeBroker(t *testing.T, serve func(r *bufio.Reader, w net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(bufio.NewReader(conn), conn)
+	}()
+	return l.Addr().String()
+}
+
+// readRESP reads a RESP array of bulk strings
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := readBrokerLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := readBrokerLine(r); err != nil {
+			return nil, err
+		}
+		arg, err := readBrokerLine(r)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg
+	}
+	return args, nil
+}
+
+func TestBrokerSinkRedis(t *testing.T) {
+	commands := make(chan []string, 10)
+	addr := fakeBroker(t, func(r *bufio.Reader, w net.Conn) {
+		for {
+			args, err := readRESP(r)
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- args
+			if args[0] == "AUTH" {
+				_, _ = io.WriteString(w, "+OK\r\n")
+			} else {
+				_, _ = io.WriteString(w, ":1\r\n")
+			}
+		}
+	})
+
+	sink := &BrokerSink{Kind: BrokerRedis, Addr: addr, Subject: "traffic", Password: "pw", PerEntry: true}
+	require.NoError(t, sink.Push(context.Background(), []TrafficPushEntry{{UserID: 1, U: 2, D: 3}, {UserID: 4, U: 5, D: 6}}))
+	assert.Equal(t, []string{"AUTH", "pw"}, <-commands)
+	assert.Equal(t, []string{"PUBLISH", "traffic", `{"uid":1,"u":2,"d":3}`}, <-commands)
+	assert.Equal(t, []string{"PUBLISH", "traffic", `{"uid":4,"u":5,"d":6}`}, <-commands)
+
+	// Error replies fail the push
+	addr = fakeBroker(t, func(r *bufio.Reader, w net.Conn) {
+		_, _ = readRESP(r)
+		_, _ = io.WriteString(w, "-NOAUTH Authentication required.\r\n")
+	})
+	sink = &BrokerSink{Kind: BrokerRedis, Addr: addr, Subject: "traffic"}
+	assert.Error(t, sink.Push(context.Background(), []TrafficPushEntry{{UserID: 1}}))
+}
+
+func TestBrokerSinkNATS(t *testing.T) {
+	lines := make(chan string, 10)
+	addr := fakeBroker(t, func(r *bufio.Reader, w net.Conn) {
+		_, _ = io.WriteString(w, "INFO {}\r\n")
+		for {
+			line, err := readBrokerLine(r)
+			if err != nil {
+				return
+			}
+			lines <- line
+			if line == "PING" {
+				_, _ = io.WriteString(w, "PONG\r\n")
+			}
+		}
+	})
+
+	sink := &BrokerSink{Kind: BrokerNATS, Addr: addr, Subject: "node.traffic"}
+	require.NoError(t, sink.Push(context.Background(), []TrafficPushEntry{{UserID: 1, U: 2, D: 3}}))
+	assert.True(t, strings.HasPrefix(<-lines, "CONNECT {"))
+	assert.Equal(t, "PUB node.traffic 23", <-lines)
+	assert.Equal(t, `[{"uid":1,"u":2,"d":3}]`, <-lines)
+	assert.Equal(t, "PING", <-lines)
+}
+
+func TestBrokerSinkValidate(t *testing.T) {
+	assert.NoError(t, (&BrokerSink{Kind: BrokerNATS, Addr: "127.0.0.1:4222", Subject: "traffic"}).Validate())
+	assert.Error(t, (&BrokerSink{Kind: BrokerNATS, Addr: "127.0.0.1", Subject: "traffic"}).Validate())
+	assert.Error(t, (&BrokerSink{Kind: BrokerRedis, Addr: "127.0.0.1:6379"}).Validate())
+	assert.Error(t, (&BrokerSink{Kind: BrokerRedis, Addr: "127.0.0.1:6379", Subject: "a b"}).Validate())
+}
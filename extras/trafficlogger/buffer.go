@@ -0,0 +1,178 @@
+package trafficlogger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/v2/server"
+)
+
+// defaultTrafficShards 流量缓冲的默认分片数，不同用户的流量大概率落在不同分片，互不争用
+const defaultTrafficShards = 64
+
+// bufferedTraffic 缓冲中单个用户尚未合并的流量
+type bufferedTraffic struct {
+	tx, rx uint64
+	// last 最近一次有流量的时间，为零值表示缓冲期间没有流量
+	last time.Time
+	// counted 为 false 时只更新最近流量时间，不合并到 StatsMap（暂停统计期间）
+	counted bool
+}
+
+// trafficShard 流量缓冲的一个分片，由各自的锁保护
+type trafficShard struct {
+	sync.Mutex
+	m map[string]*bufferedTraffic
+}
+
+// trafficBuffer 按用户 ID 分片的流量缓冲，LogTraffic 只锁定所在分片。
+// 读取流量的路径（GET /traffic、提交、排行、在线等）会先遍历所有分片合并到 StatsMap，
+// 因此读到的数据与不分片时一致；设置了合并间隔时还会定期合并
+type trafficBuffer struct {
+	shards []trafficShard
+}
+
+func newTrafficBuffer(n int) *trafficBuffer {
+	b := &trafficBuffer{shards: make([]trafficShard, n)}
+	for i := range b.shards {
+		b.shards[i].m = make(map[string]*bufferedTraffic)
+	}
+	return b
+}
+
+// shard 返回用户 ID 所在的分片（FNV-1a 哈希）
+func (b *trafficBuffer) shard(id string) *trafficShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return &b.shards[h%uint32(len(b.shards))]
+}
+
+// add 将流量累加到缓冲，last 为零值表示没有产生流量
+func (b *trafficBuffer) add(id string, tx, rx uint64, last time.Time) {
+	b.update(id, func(e *bufferedTraffic) {
+		e.tx += tx
+		e.rx += rx
+		e.counted = true
+		if !last.IsZero() {
+			e.last = last
+		}
+	})
+}
+
+// touch 只更新最近流量时间，用于暂停统计期间仍需判断空闲的情况
+func (b *trafficBuffer) touch(id string, last time.Time) {
+	b.update(id, func(e *bufferedTraffic) { e.last = last })
+}
+
+// update 在分片锁内修改用户的缓冲记录，没有时新建
+func (b *trafficBuffer) update(id string, fn func(e *bufferedTraffic)) {
+	sh := b.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+
+	e, ok := sh.m[id]
+	if !ok {
+		e = &bufferedTraffic{}
+		sh.m[id] = e
+	}
+	fn(e)
+}
+
+// drain 取出所有分片中缓冲的流量并清空缓冲
+func (b *trafficBuffer) drain() map[string]*bufferedTraffic {
+	drained := make(map[string]*bufferedTraffic)
+	for i := range b.shards {
+		sh := &b.shards[i]
+		sh.Lock()
+		m := sh.m
+		if len(m) > 0 {
+			sh.m = make(map[string]*bufferedTraffic)
+		}
+		sh.Unlock()
+		for id, e := range m {
+			drained[id] = e
+		}
+	}
+	return drained
+}
+
+// logTrafficBuffered 启用流量缓冲时的 LogTrafficVerdict：踢出名单为空时不获取 Mutex，
+// 否则以读锁检查踢出名单，仅命中时才获取写锁；流量累加到分片缓冲中，由 flushTrafficBuffer 合并
+func (s *trafficStatsServerImpl) logTrafficBuffered(id string, tx, rx uint64) server.TrafficVerdict {
+	if s.kickPending.Load() && s.consumeKick(id) {
+		return server.TrafficKick
+	}
+
+	var last time.Time
+	if tx > 0 || rx > 0 {
+		last = s.now()
+	}
+	// 暂停期间不累计流量，但与不缓冲时一样更新最近流量时间，避免活跃用户被空闲踢出
+	if s.paused.Load() {
+		if !last.IsZero() {
+			s.buffer.touch(id, last)
+		}
+		return server.TrafficAllow
+	}
+	s.buffer.add(id, tx, rx, last)
+	return server.TrafficAllow
+}
+
+// consumeKick 用户在踢出名单中时将其移出并返回 true
+func (s *trafficStatsServerImpl) consumeKick(id string) bool {
+	s.Mutex.RLock()
+	_, kicked := s.KickMap[id]
+	s.Mutex.RUnlock()
+	if !kicked {
+		return false
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if _, kicked = s.KickMap[id]; kicked {
+		delete(s.KickMap, id)
+		s.updateKickPending()
+	}
+	return kicked
+}
+
+// flushTrafficBuffer 将缓冲的流量合并到 StatsMap、LifetimeMap 和最近流量时间，未启用缓冲时不做任何事。
+// 调用方不能持有 Mutex
+func (s *trafficStatsServerImpl) flushTrafficBuffer() {
+	if s.buffer == nil {
+		return
+	}
+	drained := s.buffer.drain()
+	if len(drained) == 0 {
+		return
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, e := range drained {
+		if e.counted {
+			s.addTraffic(id, e.tx, e.rx)
+		}
+		if e.last.After(s.lastTraffic[id]) {
+			s.lastTraffic[id] = e.last
+		}
+	}
+}
+
+// flushTrafficBufferInterval 定期合并缓冲的流量
+func (s *trafficStatsServerImpl) flushTrafficBufferInterval() {
+	ticker := time.NewTicker(s.bufferInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.flushTrafficBuffer()
+	}
+}
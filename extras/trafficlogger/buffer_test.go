@@ -0,0 +1,120 @@
+package trafficlogger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficBuffer(t *testing.T) {
+	s := newTestServer(WithTrafficBuffer(time.Hour))
+	assert.True(t, s.LogTraffic("1", 1, 2))
+	assert.True(t, s.LogTraffic("1", 10, 20))
+	assert.True(t, s.LogTraffic("2", 0, 0))
+	assert.Empty(t, s.StatsMap)
+
+	s.flushTrafficBuffer()
+	assert.Equal(t, trafficStatsEntry{Tx: 11, Rx: 22}, *s.StatsMap["1"])
+	assert.Equal(t, trafficStatsEntry{Tx: 11, Rx: 22}, *s.LifetimeMap["1"])
+	assert.Equal(t, trafficStatsEntry{}, *s.StatsMap["2"])
+	assert.Contains(t, s.lastTraffic, "1")
+	assert.NotContains(t, s.lastTraffic, "2")
+
+	// Kicks are still applied immediately, and only once
+	s.NewKick("1")
+	assert.Equal(t, server.TrafficKick, s.LogTrafficVerdict("1", 1, 1))
+	assert.Equal(t, server.TrafficAllow, s.LogTrafficVerdict("1", 1, 1))
+	s.flushTrafficBuffer()
+	assert.Equal(t, trafficStatsEntry{Tx: 12, Rx: 23}, *s.StatsMap["1"])
+	assert.False(t, s.kickPending.Load())
+
+	// While paused, nothing is buffered, but kicks are still applied
+	s.Pause()
+	s.NewKick("3")
+	assert.True(t, s.kickPending.Load())
+	assert.Equal(t, server.TrafficAllow, s.LogTrafficVerdict("4", 1, 1))
+	assert.Equal(t, server.TrafficKick, s.LogTrafficVerdict("3", 1, 1))
+	assert.False(t, s.kickPending.Load())
+	s.flushTrafficBuffer()
+	assert.NotContains(t, s.StatsMap, "3")
+	assert.NotContains(t, s.StatsMap, "4")
+}
+
+func TestTrafficBufferPausedIdle(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithTrafficBuffer(time.Hour)}} {
+		var kicked []string
+		s := newTestServer(append(opts, WithOnKick(func(id, reason string) {
+			kicked = append(kicked, id)
+		}))...)
+		s.idleTimeout = time.Minute
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		s.LogOnlineState("1", true)
+		s.LogTraffic("1", 1, 1)
+
+		// Users that keep sending traffic while paused are not idle, with or without the buffer
+		s.Pause()
+		now = now.Add(50 * time.Second)
+		s.LogTraffic("1", 1, 1)
+		now = now.Add(50 * time.Second)
+		s.reapIdle(now)
+		assert.Empty(t, kicked)
+		assert.Equal(t, trafficStatsEntry{Tx: 1, Rx: 1}, *s.StatsMap["1"])
+	}
+}
+
+func TestTrafficShards(t *testing.T) {
+	s := newTestServer(WithTrafficShards(4))
+	require.NotNil(t, s.buffer)
+	assert.Len(t, s.buffer.shards, 4)
+	for i := 0; i < 100; i++ {
+		s.LogTraffic(strconv.Itoa(i), 1, 2)
+	}
+
+	// Reads merge all shards first
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/top?n=1&by=rx", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, s.StatsMap, 100)
+	assert.Equal(t, 100, len(s.snapshotTraffic()))
+
+	assert.Nil(t, newTestServer(WithTrafficShards(1)).buffer)
+	assert.Len(t, newTestServer(WithTrafficShards(8), WithTrafficBuffer(time.Hour)).buffer.shards, 8)
+	assert.Len(t, newTestServer(WithTrafficBuffer(time.Hour), WithTrafficShards(8)).buffer.shards, 8)
+	// An unset shard count does not turn off a buffer enabled by WithTrafficBuffer, whatever the order
+	assert.Len(t, newTestServer(WithTrafficBuffer(time.Hour), WithTrafficShards(0)).buffer.shards, defaultTrafficShards)
+}
+
+// BenchmarkLogTraffic 对比多个连接并发调用 LogTraffic 时，直接写入 StatsMap 与启用流量缓冲的开销，
+// 差距随 -cpu 增大而明显
+func BenchmarkLogTraffic(b *testing.B) {
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	for _, bm := range []struct {
+		name string
+		opts []Option
+	}{
+		{"direct", nil},
+		{"buffered", []Option{WithTrafficBuffer(time.Second)}},
+		{"sharded-256", []Option{WithTrafficShards(256)}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			s := newTestServer(bm.opts...)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					s.LogTraffic(ids[i%len(ids)], 1500, 1500)
+					i++
+				}
+			})
+		})
+	}
+}
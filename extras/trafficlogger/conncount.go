@@ -0,0 +1,60 @@
+package trafficlogger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// connCountCache 缓存最近一次的连接数采样，枚举系统所有连接的开销较大，按 connCountInterval 重新采样
+type connCountCache struct {
+	sync.Mutex
+	tcp, udp int
+	// at 最近一次成功采样的时间，为零值表示尚未采样
+	at time.Time
+}
+
+// countConnections 统计节点上已建立的 TCP 连接数和 UDP 套接字数（UDP 没有连接状态）
+func countConnections() (tcp, udp int, err error) {
+	tcpConns, err := net.Connections("tcp")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, c := range tcpConns {
+		if c.Status == "ESTABLISHED" {
+			tcp++
+		}
+	}
+	udpConns, err := net.Connections("udp")
+	if err != nil {
+		return 0, 0, err
+	}
+	return tcp, len(udpConns), nil
+}
+
+// sampleConnCounts 在启用连接数统计时返回连接数，距上次采样不足 connCountInterval 时返回缓存的值。
+// 采样失败时记录日志并沿用上一次的值；未启用或从未成功采样时返回 nil。调用方不应持有 Mutex，
+// 以免枚举连接期间阻塞流量统计
+func (s *trafficStatsServerImpl) sampleConnCounts() (tcp, udp *int) {
+	if s.connCountInterval <= 0 {
+		return nil, nil
+	}
+	c := &s.connCounts
+	c.Lock()
+	defer c.Unlock()
+
+	now := s.now()
+	if c.at.IsZero() || now.Sub(c.at) >= s.connCountInterval {
+		if t, u, err := s.connCounter(); err != nil {
+			s.logger.Println("获取连接数失败:", err)
+		} else {
+			c.tcp, c.udp, c.at = t, u, now
+		}
+	}
+	if c.at.IsZero() {
+		return nil, nil
+	}
+	t, u := c.tcp, c.udp
+	return &t, &u
+}
@@ -0,0 +1,65 @@
+package trafficlogger
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// cpuSampler 根据相邻两次 CPU 时间采样计算使用率。上一次的采样由 mu 保护，
+// 定时提交与 POST /system/flush 等同时采集时，每次计算都基于一致的前后两次采样，
+// 不会因交错更新得到错误或为负的差值
+type cpuSampler struct {
+	times func() (cpu.TimesStat, error)
+
+	mu   sync.Mutex
+	last cpu.TimesStat
+	// percent 上一次计算的使用率，两次采样之间没有经过时间时沿用
+	percent float64
+}
+
+// cpuSamples 进程内共用的 CPU 采样
+var cpuSamples = &cpuSampler{times: readCPUTimes}
+
+// readCPUTimes 读取所有 CPU 合计的时间
+func readCPUTimes() (cpu.TimesStat, error) {
+	times, err := cpu.Times(false)
+	if err != nil {
+		return cpu.TimesStat{}, err
+	}
+	if len(times) == 0 {
+		return cpu.TimesStat{}, errors.New("no cpu times")
+	}
+	return times[0], nil
+}
+
+// cpuBusy 返回 CPU 时间中的总时间和空闲时间。Guest 已计入 User，不重复累加
+func cpuBusy(t cpu.TimesStat) (total, idle float64) {
+	idle = t.Idle + t.Iowait
+	total = t.User + t.System + t.Nice + t.Irq + t.Softirq + t.Steal + idle
+	return total, idle
+}
+
+// sample 采样一次，返回与上一次采样之间的 CPU 使用率（0~100）。首次采样与全零比较，即开机以来的平均值
+func (c *cpuSampler) sample() (float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.times()
+	if err != nil {
+		return 0, err
+	}
+	total1, idle1 := cpuBusy(c.last)
+	total2, idle2 := cpuBusy(t)
+	c.last = t
+
+	total, idle := total2-total1, idle2-idle1
+	if total <= 0 {
+		// 两次采样之间没有经过时间，或计数器回绕（如从休眠恢复），沿用上一次的值
+		return c.percent, nil
+	}
+	busy := min(max(total-idle, 0), total)
+	c.percent = busy / total * 100
+	return c.percent, nil
+}
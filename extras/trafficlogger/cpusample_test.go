@@ -0,0 +1,41 @@
+package trafficlogger
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPUSampler(t *testing.T) {
+	var mu sync.Mutex
+	var clock float64
+	c := &cpuSampler{times: func() (cpu.TimesStat, error) {
+		// Every read advances 4s of CPU time, 1s of it busy
+		mu.Lock()
+		defer mu.Unlock()
+		clock++
+		return cpu.TimesStat{User: clock, Idle: 3 * clock}, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p, err := c.sample()
+				assert.NoError(t, err)
+				assert.Equal(t, float64(25), p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Counters going backwards keep the previous value instead of a negative rate
+	c.times = func() (cpu.TimesStat, error) { return cpu.TimesStat{User: 1, Idle: 1}, nil }
+	p, err := c.sample()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(25), p)
+}
@@ -0,0 +1,122 @@
+package trafficlogger
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxIngestBodySize /ingest 请求体的最大长度
+const maxIngestBodySize = 8 << 20
+
+// FleetUserTraffic 单个用户的流量，格式与 GET /traffic 相同
+type FleetUserTraffic struct {
+	Tx uint64 `json:"tx"`
+	Rx uint64 `json:"rx"`
+}
+
+// FleetReport 节点通过 POST /ingest 上报给汇总节点的数据
+type FleetReport struct {
+	Node    string                      `json:"node"`
+	Status  SystemStatus                `json:"status"`
+	Traffic map[string]FleetUserTraffic `json:"traffic"`
+}
+
+// FleetNode /fleet 中单个节点的最近一次上报
+type FleetNode struct {
+	FleetReport
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FleetTotals /fleet 中所有节点流量的合计
+type FleetTotals struct {
+	Nodes int    `json:"nodes"`
+	Users int    `json:"users"`
+	Tx    uint64 `json:"tx"`
+	Rx    uint64 `json:"rx"`
+}
+
+// FleetView GET /fleet 的返回结果
+type FleetView struct {
+	Nodes  []FleetNode `json:"nodes"`
+	Totals FleetTotals `json:"totals"`
+}
+
+// fleetStore 汇总节点保存的各节点上报，节点数超过 maxNodes 时淘汰最久未上报的节点
+type fleetStore struct {
+	mu       sync.Mutex
+	maxNodes int
+	nodes    map[string]FleetNode
+}
+
+func newFleetStore(maxNodes int) *fleetStore {
+	return &fleetStore{
+		maxNodes: maxNodes,
+		nodes:    make(map[string]FleetNode),
+	}
+}
+
+func (f *fleetStore) put(report FleetReport, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.nodes[report.Node]; !ok && len(f.nodes) >= f.maxNodes {
+		var stalest string
+		for id, n := range f.nodes {
+			if stalest == "" || n.UpdatedAt.Before(f.nodes[stalest].UpdatedAt) {
+				stalest = id
+			}
+		}
+		delete(f.nodes, stalest)
+	}
+	f.nodes[report.Node] = FleetNode{FleetReport: report, UpdatedAt: now}
+}
+
+// view 返回按节点 ID 排序的各节点上报及合计，同一用户在多个节点上的流量分别计入
+func (f *fleetStore) view() FleetView {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v := FleetView{Nodes: make([]FleetNode, 0, len(f.nodes))}
+	users := make(map[string]struct{})
+	for _, n := range f.nodes {
+		v.Nodes = append(v.Nodes, n)
+		for id, stats := range n.Traffic {
+			users[id] = struct{}{}
+			v.Totals.Tx += stats.Tx
+			v.Totals.Rx += stats.Rx
+		}
+	}
+	sort.Slice(v.Nodes, func(i, j int) bool { return v.Nodes[i].Node < v.Nodes[j].Node })
+	v.Totals.Nodes = len(v.Nodes)
+	v.Totals.Users = len(users)
+	return v
+}
+
+// ingest 接收其他节点上报的系统状态和流量，同一节点的新上报覆盖旧上报
+func (s *trafficStatsServerImpl) ingest(w http.ResponseWriter, r *http.Request) {
+	var report FleetReport
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngestBodySize)).Decode(&report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Node == "" {
+		http.Error(w, "missing node", http.StatusBadRequest)
+		return
+	}
+	s.fleet.put(report, s.now())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *trafficStatsServerImpl) getFleet(w http.ResponseWriter, r *http.Request) {
+	jb, err := json.Marshal(s.fleet.view())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
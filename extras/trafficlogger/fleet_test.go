@@ -0,0 +1,40 @@
+package trafficlogger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFleet(t *testing.T) {
+	s := newTestServer(WithFleetCollector(2))
+	ingest := func(body string) int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, ingest(`{"node":"a","status":{"cpu":"1%"},"traffic":{"1":{"tx":1,"rx":2},"2":{"tx":3,"rx":4}}}`))
+	assert.Equal(t, http.StatusOK, ingest(`{"node":"b","traffic":{"1":{"tx":10,"rx":20}}}`))
+	assert.Equal(t, http.StatusBadRequest, ingest(`{"traffic":{}}`))
+
+	v := s.fleet.view()
+	assert.Equal(t, FleetTotals{Nodes: 2, Users: 2, Tx: 14, Rx: 26}, v.Totals)
+	assert.Equal(t, "a", v.Nodes[0].Node)
+	assert.Equal(t, "1%", v.Nodes[0].Status.Cpu)
+
+	// The stalest node is evicted when the bound is reached
+	s.fleet.nodes["a"] = FleetNode{FleetReport: s.fleet.nodes["a"].FleetReport, UpdatedAt: time.Now().Add(time.Minute)}
+	assert.Equal(t, http.StatusOK, ingest(`{"node":"c"}`))
+	v = s.fleet.view()
+	assert.Len(t, v.Nodes, 2)
+	assert.Equal(t, "a", v.Nodes[0].Node)
+	assert.Equal(t, "c", v.Nodes[1].Node)
+
+	s = newTestServer()
+	assert.Equal(t, http.StatusNotFound, ingest(`{"node":"a"}`))
+}
@@ -2,21 +2,40 @@ package trafficlogger
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apernet/hysteria/core/v2/server"
-	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/apernet/hysteria/extras/v2/auth"
+	"github.com/apernet/hysteria/extras/v2/utils"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
+// loopLog 定时任务使用的日志，相同的错误每分钟只输出一次，避免面板故障期间刷屏
+var loopLog = utils.NewLogLimiter(time.Minute)
+
+// defaultSecurityHeaders 默认附加到所有响应的安全相关响应头
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Content-Security-Policy": "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'",
+	"Referrer-Policy":         "no-referrer",
+}
+
 const (
 	indexHTML = `<!DOCTYPE html><html lang="en"><head> <meta charset="UTF-8"> <meta name="viewport" content="width=device-width, initial-scale=1.0"> <title>Hysteria Traffic Stats API Server</title> <style>body{font-family: Arial, sans-serif; display: flex; justify-content: center; align-items: center; height: 100vh; margin: 0; padding: 0; background-color: #f4f4f4;}.container{padding: 20px; background-color: #fff; box-shadow: 0 4px 6px rgba(0, 0, 0, 0.1); border-radius: 5px;}</style></head><body> <div class="container"> <p>This is a Hysteria Traffic Stats API server.</p><p>Check the documentation for usage.</p></div></body></html>`
 )
@@ -25,8 +44,23 @@ const (
 // to provide a simple HTTP API to get the traffic stats per user.
 type TrafficStatsServer interface {
 	server.TrafficLogger
+	server.TrafficVerdictLogger
 	http.Handler
 	PushSystemStatusInterval(url string, interval time.Duration)
+	SelfTest(ctx context.Context) error
+	// Validate 检查配置是否有效，返回所有无效配置项的汇总错误
+	Validate() error
+	// Pause 和 Resume 暂停、恢复流量累计，暂停期间踢出等处理不受影响
+	Pause()
+	Resume()
+	// Drain 停止所有定时任务并提交剩余的流量，用于退出前的收尾
+	Drain(ctx context.Context) error
+	// ReadAndResetUser 原子地读取并清零单个用户尚未提交的流量，用户没有流量记录时 ok 为 false
+	ReadAndResetUser(id string) (tx, rx uint64, ok bool)
+	// MergeTraffic 将外部来源（面板、备份等）的流量累加到尚未提交的流量上，用于迁移节点和崩溃恢复
+	MergeTraffic(traffic map[string]TrafficStats)
+	// ResetOnline 清除所有用户的在线状态和保留名额，不会断开连接
+	ResetOnline()
 }
 
 // trafficStatsServerImpl 用于管理系统状态提交的结构体
@@ -34,8 +68,203 @@ type trafficStatsServerImpl struct {
 	Mutex     sync.RWMutex
 	StatsMap  map[string]*trafficStatsEntry
 	OnlineMap map[string]int
-	KickMap   map[string]struct{}
+	KickMap   map[string]time.Time // 用户 ID -> 加入踢出名单的时间
 	Secret    string
+
+	// LifetimeMap 用户 ID -> 节点启动以来的累计流量，提交和清除操作都不会修改
+	LifetimeMap map[string]*trafficStatsEntry
+
+	// lastTraffic 用户 ID -> 最近一次产生流量的时间，用于按流量判断在线状态
+	lastTraffic map[string]time.Time
+	// firstSeen 用户 ID -> StatsMap 中的记录创建的时间，即本统计周期内首次产生流量的时间，
+	// 随 StatsMap 中的记录一起清除
+	firstSeen map[string]time.Time
+	// kickedUnpushed 被踢出后尚未成功提交剩余流量的用户 ID。这些用户可能已从用户列表中移除，
+	// 提交时不按未知用户处理，积压裁剪时也保留，确保最后的流量至少提交一次
+	kickedUnpushed map[string]struct{}
+
+	// requestSem 限制耗时 GET 接口的并发数，为 nil 时不限制
+	requestSem chan struct{}
+	// userProvider 提供认证层的用户列表，为 nil 时不提供 /users 接口
+	userProvider UserProvider
+	// trafficPushURL 流量提交地址，用于自检和手动提交
+	trafficPushURL string
+	// statusPushLock 保证同一时间只有一次系统状态提交
+	statusPushLock sync.Mutex
+	// systemStatusURL 系统状态提交地址，用于 POST /system/flush
+	systemStatusURL string
+	// pushLock 保证同一时间只有一次流量提交，避免定时提交与手动提交重复提交同一份流量。
+	// 提交在复制和扣除流量之间不持有 Mutex，清空流量的操作（/traffic?clear=true 等）也需持有 pushLock，
+	// 否则同一份流量会被提交和清空两次返回，扣除时还会误扣清空后新产生的流量
+	pushLock sync.Mutex
+	// pushBackoffUntil 面板返回 429 后暂停提交的截止时间，由 pushLock 保护
+	pushBackoffUntil time.Time
+	// sinks 除面板外的其他流量提交目标
+	sinks []registeredSink
+	// jitter 定时提交间隔的随机浮动比例
+	jitter float64
+	// kickTTL 踢出名单的保留时间，超时未被消费的记录会被清理，为 0 时永不过期
+	kickTTL time.Duration
+	// securityHeaders 附加到所有响应的响应头，为空时不附加
+	securityHeaders map[string]string
+	// numberFormat 向面板提交流量时数值字段的编码方式
+	numberFormat NumberFormat
+	// idPrefix 向面板提交时附加到用户 ID 前的前缀，StatsMap 中的键不受影响
+	idPrefix string
+	// slowPushThreshold 流量提交耗时超过该值时记录警告日志，为 0 时不记录
+	slowPushThreshold time.Duration
+	// percentPrecision 提交系统状态时百分比保留的小数位数
+	percentPrecision int
+	// reconnectGrace 会话断开后保留在线名额的时间，期间重新连接的会话复用该名额，为 0 时立即释放
+	reconnectGrace time.Duration
+	// graceSlots 用户 ID -> 处于保留期的在线名额，由 Mutex 保护
+	graceSlots map[string][]*graceSlot
+	// querySignature 是否允许 GET 请求使用查询参数签名代替 Authorization 请求头
+	querySignature bool
+	// querySignatureMaxAge 查询签名的 expires 最多可以比当前时间晚多久，超过时拒绝
+	querySignatureMaxAge time.Duration
+	// routeMetrics 按接口统计的请求指标，通过 GET /metrics 提供
+	routeMetrics *routeMetrics
+	// replayGuard 不为 nil 时修改类请求（非 GET）需要携带不重复的 nonce 和时间戳
+	replayGuard *replayGuard
+	// requireAck 向面板提交流量时是否要求面板确认
+	requireAck bool
+	// requestTimeout 单个请求的处理时限，到期后请求的 context 被取消，为 0 时不限制
+	requestTimeout time.Duration
+	// trustedProxies 受信任的反向代理网段，仅当直接连接的对端在其中时才采用 X-Forwarded-For 中的客户端地址
+	trustedProxies utils.TrustedProxies
+	// partialAccept 是否按面板返回的 accepted 列表只清除被接受的用户的流量
+	partialAccept bool
+	// sortPushEntries 提交前是否按用户 ID 排序
+	sortPushEntries bool
+	// maxPushSize 单次向面板提交的数据的最大字节数，超过时分批提交，为 0 时不限制
+	maxPushSize int
+	// unknownUserPolicy 提交时对已不在用户列表中的用户的处理方式，需要 userProvider
+	unknownUserPolicy UnknownUserPolicy
+	// unknownUserBucket unknownUserPolicy 为 UnknownUserBucket 时合并提交使用的用户 ID
+	unknownUserBucket int64
+	// pushConcurrency 同时向多少个目标提交流量，不大于 1 时依次提交
+	pushConcurrency int
+	// sessionTimeMode 会话时长的统计方式，为 SessionTimeOff 时不统计
+	sessionTimeMode SessionTimeMode
+	// pushSessionTime 是否在流量提交中附带会话时长
+	pushSessionTime bool
+	// pushLimits 是否在流量提交中附带用户的限速和设备数限制，需要 userProvider
+	pushLimits bool
+	// sessionTime 用户 ID -> 截至 sessionSince 的累计会话时长
+	sessionTime map[string]time.Duration
+	// sessionSince 用户 ID -> 在线会话数最近一次变化的时间，仅包含在线用户
+	sessionSince map[string]time.Time
+	// sessionPushed 用户 ID -> 已提交给面板的会话时长
+	sessionPushed map[string]time.Duration
+	// idleTimeout 在线用户超过该时间没有流量时被踢出，为 0 时不启用
+	idleTimeout time.Duration
+	// granularity 提交流量的计量粒度（字节），为 0 时按字节提交
+	granularity uint64
+	// maxEntryValue 单次提交中每个用户上传、下载流量的最大值，为 0 时不限制
+	maxEntryValue uint64
+	// kickMarksOffline 为 true 时加入踢出名单即清除用户的在线状态，否则等连接实际断开
+	kickMarksOffline bool
+	// onKick 用户被加入踢出名单时的回调，参数为用户 ID 和踢出原因
+	onKick func(id, reason string)
+	// onPush 每次成功提交流量后的回调
+	onPush func(result PushResult)
+	// onKickBatch 不为 nil 时一次踢出的所有用户合并为一次回调，参数为用户 ID 列表和踢出原因
+	onKickBatch func(ids []string, reason string)
+	// kickSem 限制同时执行的踢出回调数，为 nil 时不限制
+	kickSem chan struct{}
+	// kickQueue 不为 nil 时 OnKick 回调通过该队列异步调用
+	kickQueue *kickQueue
+	// thresholds 系统状态的告警阈值，超过时调用 onThreshold
+	thresholds Thresholds
+	// onThreshold 系统状态超过阈值时的回调，参数为指标名称（Metric* 常量）和使用率
+	onThreshold func(metric string, value float64)
+	// nodeName 节点名称，附加到提交的系统状态和流量中，为空时不附加
+	nodeName string
+	// fleet 汇总模式下保存的其他节点上报，为 nil 时不提供 /ingest 和 /fleet 接口
+	fleet *fleetStore
+	// backlog 持续提交失败时的积压处理策略
+	backlog BacklogPolicy
+	// pushHealth 流量提交的健康状态，由 Mutex 保护
+	pushHealth pushHealth
+	// clientInfo 用户 ID -> 最近一次上线的客户端信息，为 nil 时不记录
+	clientInfo map[string]string
+	// indexPath 返回首页的路径，默认为 "/"
+	indexPath string
+	// emptyPathAsIndex 是否将空路径视为首页（反向代理去掉挂载前缀后可能得到空路径）
+	emptyPathAsIndex bool
+	// httpClient 提交系统状态和流量时使用的 HTTP 客户端，为 nil 时使用 http.DefaultClient
+	httpClient *http.Client
+	// now 返回当前时间，测试时可替换
+	now func() time.Time
+	// logger 运行日志的输出
+	logger Logger
+	// sysInfo 采集系统状态
+	sysInfo func() (SystemInfo, error)
+	// systemStatusDisabled 为 true 时完全关闭系统状态监控，不采集也不提交
+	systemStatusDisabled bool
+	// staleMetrics 检测系统状态是否连续多次完全相同
+	staleMetrics staleMetrics
+	// cpuWarmup 构造后多久内提交系统状态时先等待，使首个 CPU 使用率覆盖足够长的采样区间
+	cpuWarmup time.Duration
+	// createdAt 构造时间，即 CPU 预采样的时间
+	createdAt time.Time
+	// connCountInterval 连接数的采样间隔，为 0 时不统计连接数
+	connCountInterval time.Duration
+	// connCounter 统计连接数
+	connCounter func() (tcp, udp int, err error)
+	// connCounts 最近一次的连接数采样
+	connCounts connCountCache
+	// done 在 Drain 时关闭，通知所有定时任务退出
+	done      chan struct{}
+	closeOnce sync.Once
+	// pushMode 提交增量还是累计值
+	pushMode PushMode
+	// buffer 分片的流量缓冲，为 nil 时 LogTraffic 直接写入 StatsMap
+	buffer *trafficBuffer
+	// bufferInterval 流量缓冲定期合并到 StatsMap 的间隔，为 0 时只在读取时合并
+	bufferInterval time.Duration
+	// trafficShards 流量缓冲的分片数，与 bufferInterval 一起在应用所有选项后决定是否创建 buffer
+	trafficShards int
+	// paused 为 true 时暂停累计流量，LogTraffic 只判断是否踢出
+	paused atomic.Bool
+	// kickPending 踢出名单不为空，启用流量缓冲时 LogTraffic 据此无锁跳过踢出检查，修改 KickMap 后由 updateKickPending 同步
+	kickPending atomic.Bool
+}
+
+// graceSlot 会话断开后暂时保留的在线名额
+type graceSlot struct {
+	timer *time.Timer
+}
+
+// Logger 运行日志的输出，*log.Logger 和 *utils.LogLimiter 均满足该接口
+type Logger interface {
+	Println(v ...any)
+}
+
+// UserProvider 提供认证层当前的用户列表
+type UserProvider interface {
+	Users() []auth.User
+}
+
+// GroupProvider 由支持用户分组的用户列表来源实现，用于按分组踢出和查询流量
+type GroupProvider interface {
+	GroupMembers(group string) []string
+}
+
+// AuthMetricsProvider 由提供认证计数的用户列表来源实现，用于 /auth/status 接口
+type AuthMetricsProvider interface {
+	AuthMetrics() auth.AuthMetrics
+}
+
+// LimitSourceProvider 由可以说明用户限制来源的用户列表来源实现，用于 /users/limits 接口
+type LimitSourceProvider interface {
+	LimitSource() string
+}
+
+// CacheStateProvider 由缓存面板用户列表的用户列表来源实现，用于 /auth/etag 接口
+type CacheStateProvider interface {
+	CacheState() auth.CacheState
 }
 
 type trafficStatsEntry struct {
@@ -43,10 +272,18 @@ type trafficStatsEntry struct {
 	Rx uint64 `json:"rx"`
 }
 
+// TrafficPushEntry 单个用户的流量数据。U、D 为 uint64，不再截断为 int64，按配置的 NumberFormat 编码；
+// 注意：此前这两个字段为 int64，实现了 TrafficSink 的外部代码读取它们时需要相应调整
 type TrafficPushEntry struct {
-	UserID int64 `json:"uid"`
-	U      int64 `json:"u"`
-	D      int64 `json:"d"`
+	UserID int64  `json:"uid"`
+	U      uint64 `json:"u"`
+	D      uint64 `json:"d"`
+	// SessionSeconds 自上次提交以来的会话时长（秒），仅在启用 WithSessionTime 的提交选项时附带
+	SessionSeconds uint64 `json:"session_seconds,omitempty"`
+	// SpeedLimit、DeviceLimit 用户列表中该用户的限速和设备数限制，仅在启用 WithPushLimits 时附带，
+	// 为指针以便区分未附带和限制为 0
+	SpeedLimit  *int `json:"st,omitempty"`
+	DeviceLimit *int `json:"dt,omitempty"`
 }
 
 type TrafficPushRequest struct {
@@ -59,192 +296,727 @@ type SystemStatus struct {
 	Mem    string `json:"mem"`
 	Disk   string `json:"disk"`
 	Uptime uint64 `json:"uptime"`
+	// ProcessUptime 进程运行时间（秒），从 TrafficStatsServer 构造时开始计算。
+	// 容器中 Uptime 为宿主机的运行时间，可据此区分进程（容器）重启和宿主机重启
+	ProcessUptime uint64 `json:"process_uptime"`
+	// 未经格式化的使用率，便于程序处理；字符串字段保留用于兼容
+	CpuPercent  float64 `json:"cpu_percent"`
+	MemPercent  float64 `json:"mem_percent"`
+	DiskPercent float64 `json:"disk_percent"`
+	// Namespace 为配置的用户 ID 前缀，便于面板区分来自不同集群的数据
+	Namespace string `json:"namespace,omitempty"`
+	// Node 为配置的节点名称，多个节点提交到同一地址时用于区分来源
+	Node string `json:"node,omitempty"`
+	// TCPConnections、UDPConnections 节点上已建立的 TCP 连接数和 UDP 套接字数，仅在启用连接数统计时提交
+	TCPConnections *int `json:"tcp_connections,omitempty"`
+	UDPConnections *int `json:"udp_connections,omitempty"`
+	// Failed 采集失败的指标（cpu、mem、disk、uptime），这些指标的字符串字段为空、数值字段为 0，
+	// 不代表实际使用率；全部采集成功时省略
+	Failed []string `json:"failed,omitempty"`
+	// Errors 采集失败的指标及原因，全部采集成功时为空
+	Errors string `json:"errors,omitempty"`
 }
 
+// NewTrafficStatsServer 创建只设置访问密钥的 TrafficStatsServer，等同于 NewTrafficStatsServerWithOptions(WithSecret(secret))
 func NewTrafficStatsServer(secret string) TrafficStatsServer {
-	return &trafficStatsServerImpl{
-		StatsMap:  make(map[string]*trafficStatsEntry),
-		KickMap:   make(map[string]struct{}),
-		OnlineMap: make(map[string]int),
-		Secret:    secret,
+	return NewTrafficStatsServerWithOptions(WithSecret(secret))
+}
+
+// NewTrafficStatsServerWithOptions 根据给定的选项创建 TrafficStatsServer
+func NewTrafficStatsServerWithOptions(opts ...Option) TrafficStatsServer {
+	s := &trafficStatsServerImpl{
+		StatsMap:             make(map[string]*trafficStatsEntry),
+		LifetimeMap:          make(map[string]*trafficStatsEntry),
+		lastTraffic:          make(map[string]time.Time),
+		firstSeen:            make(map[string]time.Time),
+		kickedUnpushed:       make(map[string]struct{}),
+		routeMetrics:         newRouteMetrics(),
+		KickMap:              make(map[string]time.Time),
+		OnlineMap:            make(map[string]int),
+		securityHeaders:      defaultSecurityHeaders,
+		querySignatureMaxAge: defaultQuerySignatureMaxAge,
+		indexPath:            "/",
+		now:                  time.Now,
+		logger:               loopLog,
+		sysInfo:              ReadSystemInfo,
+		graceSlots:           make(map[string][]*graceSlot),
+		sessionTime:          make(map[string]time.Duration),
+		sessionSince:         make(map[string]time.Time),
+		sessionPushed:        make(map[string]time.Duration),
+		connCounter:          countConnections,
+		done:                 make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.createdAt = s.now()
+	// 缓冲在应用所有选项后创建，结果与 WithTrafficShards、WithTrafficBuffer 的顺序无关
+	if s.trafficShards > 1 {
+		s.buffer = newTrafficBuffer(s.trafficShards)
+	} else if s.bufferInterval > 0 {
+		s.buffer = newTrafficBuffer(defaultTrafficShards)
 	}
+	if !s.systemStatusDisabled {
+		primeCPUSample()
+	}
+	if s.kickTTL > 0 {
+		go s.expireKicksInterval()
+	}
+	if s.kickQueue != nil && (s.onKick != nil || s.onKickBatch != nil) {
+		for i := 0; i < max(cap(s.kickSem), 1); i++ {
+			go s.runKickQueue()
+		}
+	}
+	if s.buffer != nil && s.bufferInterval > 0 {
+		go s.flushTrafficBufferInterval()
+	}
+	if s.idleTimeout > 0 {
+		go s.reapIdleInterval()
+	}
+	return s
 }
 
-// GetSystemInfo 获取系统状态信息
-func GetSystemInfo() (Cpu string, Mem string, Disk string, Uptime uint64, err error) {
+// SystemInfo 未经格式化的系统状态信息，百分比字段保留完整精度
+type SystemInfo struct {
+	CpuPercent  float64
+	MemPercent  float64
+	DiskPercent float64
+	Uptime      uint64
+	// Failed 采集失败的指标（Metric* 常量），这些指标的值为零值，不代表实际使用率
+	Failed []string
+}
+
+// failed 判断指标是否采集失败
+func (info SystemInfo) failed(metric string) bool {
+	return slices.Contains(info.Failed, metric)
+}
+
+var primeCPUOnce sync.Once
+
+// primeCPUSample 进行一次丢弃结果的 CPU 采样。CPU 使用率为与上一次采样之间的平均值，
+// 首次调用没有上一次可比较，结果通常是进程启动以来的值（表现为 0 或异常的高峰）。
+// 构造时预采样后，第一次提交的 CPU 使用率即为构造以来的平均值
+func primeCPUSample() {
+	primeCPUOnce.Do(func() {
+		_, _ = cpuSamples.sample()
+	})
+}
+
+// waitCPUWarmup 构造后不足 cpuWarmup 时等待到期，避免采样区间过短导致 CPU 使用率失真
+func (s *trafficStatsServerImpl) waitCPUWarmup() {
+	if wait := s.createdAt.Add(s.cpuWarmup).Sub(s.now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// ReadSystemInfo 读取系统状态信息，获取失败的字段为零值并记录在 Failed 中。
+// CPU 使用率为与上一次调用之间的平均值，首个值的采样区间从 TrafficStatsServer 构造时开始。可以并发调用
+func ReadSystemInfo() (info SystemInfo, err error) {
 	errorString := ""
 
-	cpuPercent, err := cpu.Percent(0, false)
-	if len(cpuPercent) > 0 && err == nil {
-		Cpu = fmt.Sprintf("%.0f%%", cpuPercent[0])
+	cpuPercent, err := cpuSamples.sample()
+	if err == nil {
+		info.CpuPercent = cpuPercent
 	} else {
-		Cpu = "0%"
 		errorString += fmt.Sprintf("获取CPU使用率失败: %s ", err)
+		info.Failed = append(info.Failed, MetricCPU)
 	}
 
 	memUsage, err := mem.VirtualMemory()
 	if err != nil {
 		errorString += fmt.Sprintf("获取内存使用率失败: %s ", err)
+		info.Failed = append(info.Failed, MetricMem)
 	} else {
-		Mem = fmt.Sprintf("%.0f%%", memUsage.UsedPercent)
+		info.MemPercent = memUsage.UsedPercent
 	}
 
 	diskUsage, err := disk.Usage("/")
 	if err != nil {
 		errorString += fmt.Sprintf("获取磁盘使用率失败: %s ", err)
+		info.Failed = append(info.Failed, MetricDisk)
 	} else {
-		Disk = fmt.Sprintf("%.0f%%", diskUsage.UsedPercent)
+		info.DiskPercent = diskUsage.UsedPercent
 	}
 
 	uptime, err := host.Uptime()
 	if err != nil {
 		errorString += fmt.Sprintf("获取系统运行时间失败: %s ", err)
+		info.Failed = append(info.Failed, MetricUptime)
 	} else {
-		Uptime = uptime
+		info.Uptime = uptime
 	}
 
 	if errorString != "" {
-		err = fmt.Errorf(errorString)
+		err = errors.New(errorString)
+	}
+
+	return info, err
+}
+
+// formatPercent 将百分比格式化为保留 precision 位小数的字符串，如 "12.3%"
+func formatPercent(v float64, precision int) string {
+	return fmt.Sprintf("%.*f%%", max(precision, 0), v)
+}
+
+// formatMetric 格式化指标的使用率，采集失败时返回空字符串，与实际为 0% 的指标区分
+func (info SystemInfo) formatMetric(metric string, v float64, precision int) string {
+	if info.failed(metric) {
+		return ""
+	}
+	return formatPercent(v, precision)
+}
+
+// GetSystemInfo 获取系统状态信息，百分比取整，采集失败的指标为空字符串
+func GetSystemInfo() (Cpu string, Mem string, Disk string, Uptime uint64, err error) {
+	info, err := ReadSystemInfo()
+	return info.formatMetric(MetricCPU, info.CpuPercent, 0), info.formatMetric(MetricMem, info.MemPercent, 0),
+		info.formatMetric(MetricDisk, info.DiskPercent, 0), info.Uptime, err
+}
+
+// systemStatus 根据系统状态信息构造提交给面板的数据
+func (s *trafficStatsServerImpl) systemStatus(info SystemInfo) SystemStatus {
+	return SystemStatus{
+		Cpu:           info.formatMetric(MetricCPU, info.CpuPercent, s.percentPrecision),
+		Mem:           info.formatMetric(MetricMem, info.MemPercent, s.percentPrecision),
+		Disk:          info.formatMetric(MetricDisk, info.DiskPercent, s.percentPrecision),
+		Uptime:        info.Uptime,
+		ProcessUptime: uint64(s.now().Sub(s.createdAt) / time.Second),
+		CpuPercent:    info.CpuPercent,
+		MemPercent:    info.MemPercent,
+		DiskPercent:   info.DiskPercent,
+		Namespace:     s.idPrefix,
+		Node:          s.nodeName,
+		Failed:        info.Failed,
 	}
+}
 
-	return Cpu, Mem, Disk, Uptime, err
+// collectSystemStatus 采集系统状态。部分指标采集失败时仍返回其余指标，失败原因记录在 Errors 中。
+// 采集可能较慢，不持有 Mutex，避免阻塞 LogTraffic
+func (s *trafficStatsServerImpl) collectSystemStatus() SystemStatus {
+	info, err := s.checkStaleMetrics(s.sysInfo())
+	status := s.systemStatus(info)
+	if err != nil {
+		status.Errors = strings.TrimSpace(err.Error())
+		s.logger.Println("系统状态部分采集失败:", status.Errors)
+	}
+	return status
 }
 
-// PushSystemStatusInterval 定期提交系统状态
+// PushSystemStatusInterval 定期提交系统状态。通过 WithSystemStatus 关闭系统状态监控时直接返回
 func (s *trafficStatsServerImpl) PushSystemStatusInterval(url string, interval time.Duration) {
-	fmt.Println("系统状态监控已启动")
+	if s.systemStatusDisabled {
+		s.logger.Println("系统状态监控已关闭")
+		return
+	}
+	s.logger.Println("系统状态监控已启动")
 
-	ticker := time.NewTicker(interval)
+	ticker := utils.NewJitterTicker(interval, s.jitter)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
 		if err := s.PushSystemStatus(url); err != nil {
-			fmt.Println("系统状态信息提交失败:", err)
+			s.logger.Println("系统状态信息提交失败:", err)
 		}
 	}
 }
 
-// PushSystemStatus 向指定的URL提交系统状态信息
+// client 返回提交时使用的 HTTP 客户端
+func (s *trafficStatsServerImpl) client() *http.Client {
+	if s.httpClient != nil {
+		return s.httpClient
+	}
+	return http.DefaultClient
+}
+
+// PushSystemStatus 向指定的URL提交系统状态信息，部分指标采集失败时照常提交其余指标
 func (s *trafficStatsServerImpl) PushSystemStatus(url string) error {
-	s.Mutex.Lock()         // 写锁，阻止其他操作的并发访问
-	defer s.Mutex.Unlock() // 确保在函数退出时释放写锁
+	_, err := s.pushSystemStatus(url)
+	return err
+}
 
-	cpu, mem, disk, uptime, err := GetSystemInfo()
-	if err != nil {
-		return err
-	}
+// errSystemStatusDisabled 关闭系统状态监控后提交系统状态时返回的错误
+var errSystemStatusDisabled = errors.New("system status monitoring is disabled")
 
-	status := SystemStatus{
-		Cpu:    cpu,
-		Mem:    mem,
-		Disk:   disk,
-		Uptime: uptime,
+// pushSystemStatus 采集并提交系统状态，返回采集到的系统状态。
+// 定时提交与 POST /system/flush 通过 statusPushLock 串行执行，不会同时提交
+func (s *trafficStatsServerImpl) pushSystemStatus(url string) (SystemStatus, error) {
+	if s.systemStatusDisabled {
+		return SystemStatus{}, errSystemStatusDisabled
 	}
+	s.statusPushLock.Lock()
+	defer s.statusPushLock.Unlock()
+
+	s.waitCPUWarmup()
+	tcpConns, udpConns := s.sampleConnCounts()
+
+	status := s.collectSystemStatus()
+	status.TCPConnections, status.UDPConnections = tcpConns, udpConns
+
+	// 先于提交检查阈值，面板不可用时本地告警照常触发
+	s.checkThresholds(status)
 
 	// 将请求对象转换为 JSON
 	jsonData, err := json.Marshal(status)
 	if err != nil {
-		return err
+		return status, err
 	}
 
 	// 发起 HTTP 请求并提交数据
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := s.client().Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return err
+		return status, err
 	}
 	defer resp.Body.Close()
 
 	// 检查 HTTP 响应状态，处理错误等
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("HTTP请求失败，状态码: " + resp.Status)
+		return status, errors.New("HTTP请求失败，状态码: " + resp.Status)
 	}
 
-	return nil
+	return status, nil
 }
 
 // PushTrafficToV2RaySocksInterval 定时提交用户流量情况
 func (s *trafficStatsServerImpl) PushTrafficToV2RaySocksInterval(url string, interval time.Duration) {
-	fmt.Println("用户流量情况监控已启动")
+	s.logger.Println("用户流量情况监控已启动")
 
-	ticker := time.NewTicker(interval)
+	ticker := utils.NewJitterTicker(interval, s.jitter)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
 		if err := s.PushTrafficToV2RaySocks(url); err != nil {
-			fmt.Println("用户流量信息提交失败:", err)
+			s.logger.Println("用户流量信息提交失败:", err)
 		}
 	}
 }
 
-// PushTrafficToV2RaySocks 向v2raysocks 提交用户流量使用情况
+// PushTrafficToV2RaySocks 向v2raysocks 提交用户流量使用情况，同时提交到其他已注册的目标
 func (s *trafficStatsServerImpl) PushTrafficToV2RaySocks(url string) error {
-	s.Mutex.Lock()         // 写锁，阻止其他操作 StatsMap 的并发访问
-	defer s.Mutex.Unlock() // 确保在函数退出时释放写锁
+	_, err := s.pushTraffic(context.Background(), url)
+	return err
+}
+
+// pushTraffic 提交流量并返回提交的用户数，与其他提交互斥执行
+func (s *trafficStatsServerImpl) pushTraffic(ctx context.Context, url string) (int, error) {
+	s.pushLock.Lock()
+	defer s.pushLock.Unlock()
+
+	s.pruneLastTraffic(s.now())
+
+	// 面板限流期间不提交，流量保留到限流结束后再提交
+	if wait := s.pushBackoffUntil.Sub(s.now()); wait > 0 {
+		return 0, fmt.Errorf("面板限流中，将在 %s 后重试", wait.Round(time.Second))
+	}
+
+	// 溢出到磁盘的流量随本次提交一并提交，提交结束后根据结果更新溢出文件
+	var restored *spilledTraffic
+	if s.backlog.Mode == BacklogSpill {
+		var err error
+		if restored, err = s.restoreSpill(s.now()); err != nil {
+			s.logger.Println("读取溢出的流量记录失败:", err)
+		}
+	}
+	settled := false
+	settle := func() {
+		if !settled {
+			settled = true
+			s.settleSpill(restored)
+		}
+	}
+	defer settle()
+
+	// 复制一份流量记录，提交期间不持有锁，避免阻塞 LogTraffic
+	snapshot := s.snapshotTraffic()
+	if s.maxEntryValue > 0 {
+		snapshot = s.capTraffic(snapshot)
+	}
+	if s.granularity > 0 {
+		snapshot = s.roundTraffic(snapshot)
+	}
+	// 累计模式下提交有新流量的用户的累计值，本地记录的清除方式不变
+	values := snapshot
+	if s.pushMode == PushModeCumulative {
+		values = s.lifetimeTraffic(snapshot)
+	}
 
 	// 创建一个请求对象并填充数据
 	request := TrafficPushRequest{
 		Data: []TrafficPushEntry{},
 	}
-	for id, stats := range s.StatsMap {
+	known := s.knownUserIDs()
+	if known != nil {
+		// 被踢出的用户即使已从用户列表中移除，剩余的流量也照常提交
+		for id := range s.kickedUsersUnpushed() {
+			known[id] = true
+		}
+	}
+	limits := s.userLimits()
+	// sources 记录每个提交的用户 ID 对应的本地记录，部分接受时只扣除被接受的部分
+	sources := make(map[int64][]string)
+	var bucket *TrafficPushEntry
+	var sessions, pushedSessions map[string]time.Duration
+	if s.pushSessionTime {
+		sessions = s.unpushedSessionTime(s.now())
+		pushedSessions = make(map[string]time.Duration)
+	}
+	for id, stats := range values {
 		userID, err := strconv.ParseInt(id, 10, 64) // 假设 id 是字符串类型，需要转换为 int64
+		if known != nil && (err != nil || !known[id]) {
+			// 已不存在的用户，按配置丢弃或归入统一的 ID 下，丢弃的流量同样会被扣除
+			if s.unknownUserPolicy == UnknownUserBucket {
+				if bucket == nil {
+					bucket = &TrafficPushEntry{UserID: s.unknownUserBucket}
+				}
+				bucket.U += stats.Tx
+				bucket.D += stats.Rx
+				sources[s.unknownUserBucket] = append(sources[s.unknownUserBucket], id)
+			}
+			continue
+		}
 		if err != nil {
-			return err
+			return 0, err
 		}
-		request.Data = append(request.Data, TrafficPushEntry{
+		entry := TrafficPushEntry{
 			UserID: userID,
-			U:      int64(stats.Tx),
-			D:      int64(stats.Rx),
-		})
+			U:      stats.Tx,
+			D:      stats.Rx,
+		}
+		if d, ok := sessions[id]; ok {
+			entry.SessionSeconds = uint64(d / time.Second)
+			pushedSessions[id] = d
+		}
+		if user, ok := limits[id]; ok {
+			entry.SpeedLimit, entry.DeviceLimit = &user.SpeedLimit, &user.DeviceLimit
+		}
+		sources[userID] = append(sources[userID], id)
+		request.Data = append(request.Data, entry)
 	}
-	// 如果不存在数据则跳过
+	if bucket != nil {
+		request.Data = append(request.Data, *bucket)
+	}
+	if s.sortPushEntries {
+		sort.Slice(request.Data, func(i, j int) bool { return request.Data[i].UserID < request.Data[j].UserID })
+	}
+	// 如果不存在数据则跳过，视为一次成功的提交，清除之前的失败状态
 	if len(request.Data) == 0 {
-		return nil
+		s.deductTraffic(snapshot)
+		settle()
+		s.recordPushResult(nil, s.now())
+		return 0, nil
 	}
 
-	// 将请求对象转换为 JSON
-	jsonData, err := json.Marshal(request.Data)
+	s.logOverflowEntries(request.Data)
+
+	primary := &HTTPJSONSink{
+		Client:         s.httpClient,
+		URL:            url,
+		NumberFormat:   s.numberFormat,
+		IDPrefix:       s.idPrefix,
+		Node:           s.nodeName,
+		RequireAck:     s.requireAck,
+		PartialAccept:  s.partialAccept,
+		MaxPayloadSize: s.maxPushSize,
+		Logger:         s.logger,
+		Now:            s.now,
+	}
+	sinks := append([]registeredSink{{sink: primary, required: true}}, s.sinks...)
+	start := s.now()
+	err := pushToSinks(ctx, sinks, request.Data, s.pushConcurrency, s.logger)
+	elapsed := s.now().Sub(start)
+	s.logSlowPush(elapsed, request.Data)
+	var rl *RateLimitedError
+	if errors.As(err, &rl) {
+		s.pushBackoffUntil = s.now().Add(rl.RetryAfter)
+	}
+	pushed := len(request.Data)
+	delivered := request.Data
+	if rejected, ok := partialRejected(err); ok {
+		// 面板只接受了部分用户，或分批提交中途失败，未被接受的流量保留到下次重试，其余照常扣除
+		for uid := range rejected {
+			for _, id := range sources[uid] {
+				delete(snapshot, id)
+				delete(pushedSessions, id)
+			}
+		}
+		pushed -= len(rejected)
+		delivered = make([]TrafficPushEntry, 0, pushed)
+		for _, entry := range request.Data {
+			if !rejected[entry.UserID] {
+				delivered = append(delivered, entry)
+			}
+		}
+		s.logger.Println(len(rejected), "个用户的流量未被面板接受，将在下次提交时重试:", err)
+		err = nil
+	}
 	if err != nil {
-		return err
+		// 先将读回的流量移回溢出文件，积压处理不会重复写入
+		settle()
+		s.recordPushResult(err, s.now())
+		return 0, err
 	}
 
-	// 发起 HTTP 请求并提交数据
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Println(resp)
-		return err
+	// 扣除已提交的流量，提交期间新增的流量保留到下次提交
+	s.deductTraffic(snapshot)
+	s.markSessionTimePushed(pushedSessions)
+	settle()
+	s.recordPushResult(nil, s.now())
+
+	if s.onPush != nil {
+		s.onPush(PushResult{Time: start, Duration: elapsed, Entries: delivered})
 	}
-	defer resp.Body.Close()
+	return pushed, nil
+}
 
-	// 检查 HTTP 响应状态，处理错误等
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("HTTP request failed with status code: " + resp.Status)
+// PushResult 一次成功提交的结果，作为 OnPush 回调的参数
+type PushResult struct {
+	// Time 开始提交的时间
+	Time time.Time
+	// Duration 提交的耗时
+	Duration time.Duration
+	// Entries 面板已接受的流量数据，部分接受时不包含被拒绝的用户
+	Entries []TrafficPushEntry
+}
+
+// UnknownUserPolicy 提交流量时对已不在用户列表中的用户的处理方式
+type UnknownUserPolicy int
+
+const (
+	// UnknownUserSend 原样提交（默认）
+	UnknownUserSend UnknownUserPolicy = iota
+	// UnknownUserDrop 丢弃这些用户的流量
+	UnknownUserDrop
+	// UnknownUserBucket 将这些用户的流量合并到一个指定的用户 ID 下提交
+	UnknownUserBucket
+)
+
+// ParseUnknownUserPolicy 解析配置中的未知用户处理方式，空字符串视为 send
+func ParseUnknownUserPolicy(s string) (UnknownUserPolicy, error) {
+	switch s {
+	case "", "send":
+		return UnknownUserSend, nil
+	case "drop":
+		return UnknownUserDrop, nil
+	case "bucket":
+		return UnknownUserBucket, nil
+	default:
+		return 0, fmt.Errorf("unsupported unknown user policy %q", s)
+	}
+}
+
+// knownUserIDs 返回当前用户列表中的用户 ID 集合。
+// 未配置未知用户处理方式或没有用户列表来源时返回 nil，表示不做过滤
+func (s *trafficStatsServerImpl) knownUserIDs() map[string]bool {
+	if s.unknownUserPolicy == UnknownUserSend || s.userProvider == nil {
+		return nil
+	}
+	users := s.userProvider.Users()
+	known := make(map[string]bool, len(users))
+	for _, user := range users {
+		known[strconv.Itoa(user.ID)] = true
+	}
+	return known
+}
+
+// userLimits 返回用户 ID -> 用户列表中的用户，用于在提交中附带限速和设备数限制。
+// 未启用 pushLimits 或没有用户列表来源时返回 nil
+func (s *trafficStatsServerImpl) userLimits() map[string]auth.User {
+	if !s.pushLimits || s.userProvider == nil {
+		return nil
+	}
+	users := s.userProvider.Users()
+	limits := make(map[string]auth.User, len(users))
+	for _, user := range users {
+		limits[strconv.Itoa(user.ID)] = user
+	}
+	return limits
+}
+
+// logSlowPush 提交耗时超过 slowPushThreshold 时记录警告日志，包含提交的用户数和数据大小
+func (s *trafficStatsServerImpl) logSlowPush(elapsed time.Duration, entries []TrafficPushEntry) {
+	if s.slowPushThreshold <= 0 || elapsed < s.slowPushThreshold {
+		return
+	}
+	// 仅在慢提交时重新编码以计算数据大小，正常提交不产生额外开销
+	size := 0
+	if jb, err := encodeEntries(entries, s.numberFormat, s.idPrefix); err == nil {
+		size = len(jb)
+	}
+	s.logger.Println(fmt.Sprintf("警告: 流量信息提交耗时 %s，超过阈值 %s（用户数: %d，数据大小: %d 字节）",
+		elapsed, s.slowPushThreshold, len(entries), size))
+}
+
+// logOverflowEntries 统计流量数值超出 int64 范围的用户，有则记录一条日志。
+// 这些数值在按 NumberFormatInt64 编码的目标中会被截断为 math.MaxInt64
+func (s *trafficStatsServerImpl) logOverflowEntries(entries []TrafficPushEntry) {
+	overflow := 0
+	for _, e := range entries {
+		if e.U > math.MaxInt64 || e.D > math.MaxInt64 {
+			overflow++
+		}
+	}
+	if overflow > 0 {
+		s.logger.Println(overflow, "个用户的流量数值超出 int64 范围，按 int64 编码的提交目标会将其截断")
+	}
+}
+
+// snapshotTraffic 复制当前的流量记录
+func (s *trafficStatsServerImpl) snapshotTraffic() map[string]trafficStatsEntry {
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	snapshot := make(map[string]trafficStatsEntry, len(s.StatsMap))
+	for id, stats := range s.StatsMap {
+		snapshot[id] = *stats
+	}
+	return snapshot
+}
+
+// capTraffic 将每个用户的上传、下载流量分别限制在 maxEntryValue 以内，
+// 只扣除提交的部分，超出的部分留在 StatsMap 中分多次提交
+func (s *trafficStatsServerImpl) capTraffic(snapshot map[string]trafficStatsEntry) map[string]trafficStatsEntry {
+	capped := make(map[string]trafficStatsEntry, len(snapshot))
+	for id, stats := range snapshot {
+		capped[id] = trafficStatsEntry{Tx: min(stats.Tx, s.maxEntryValue), Rx: min(stats.Rx, s.maxEntryValue)}
+	}
+	return capped
+}
+
+// roundTraffic 将每个用户的流量向下取整到 granularity 的整数倍，取整后为零的用户不提交。
+// 只扣除取整后的部分，余数留在 StatsMap 中计入下次提交；被踢出的用户不再产生流量，按原值提交
+func (s *trafficStatsServerImpl) roundTraffic(snapshot map[string]trafficStatsEntry) map[string]trafficStatsEntry {
+	kicked := s.kickedUsersUnpushed()
+	g := s.granularity
+	rounded := make(map[string]trafficStatsEntry, len(snapshot))
+	for id, stats := range snapshot {
+		if _, ok := kicked[id]; !ok {
+			stats = trafficStatsEntry{Tx: stats.Tx / g * g, Rx: stats.Rx / g * g}
+		}
+		if stats.Tx > 0 || stats.Rx > 0 {
+			rounded[id] = stats
+		}
+	}
+	return rounded
+}
+
+// lifetimeTraffic 返回 ids 中各用户的累计流量
+func (s *trafficStatsServerImpl) lifetimeTraffic(ids map[string]trafficStatsEntry) map[string]trafficStatsEntry {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	lifetime := make(map[string]trafficStatsEntry, len(ids))
+	for id := range ids {
+		if stats, ok := s.LifetimeMap[id]; ok {
+			lifetime[id] = *stats
+		}
+	}
+	return lifetime
+}
+
+// deductTraffic 从流量记录中扣除已提交的部分，扣除后为零的记录直接删除
+func (s *trafficStatsServerImpl) deductTraffic(pushed map[string]trafficStatsEntry) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, p := range pushed {
+		entry, ok := s.StatsMap[id]
+		if !ok {
+			delete(s.kickedUnpushed, id)
+			continue
+		}
+		entry.Tx -= min(entry.Tx, p.Tx)
+		entry.Rx -= min(entry.Rx, p.Rx)
+		if entry.Tx == 0 && entry.Rx == 0 {
+			delete(s.StatsMap, id)
+			delete(s.firstSeen, id)
+			delete(s.kickedUnpushed, id)
+		}
+	}
+}
+
+// pruneLastTraffic 删除早于 maxActiveWindow 和 idleTimeout 的流量时间，避免 lastTraffic 无限增长。
+// 在线用户的记录保留，用于判断空闲时间
+func (s *trafficStatsServerImpl) pruneLastTraffic(now time.Time) {
+	retention := max(maxActiveWindow, s.idleTimeout)
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, t := range s.lastTraffic {
+		if _, online := s.OnlineMap[id]; !online && now.Sub(t) > retention {
+			delete(s.lastTraffic, id)
+		}
 	}
+}
 
-	// 清空流量记录
-	s.StatsMap = make(map[string]*trafficStatsEntry)
+// kickedUsersUnpushed 返回被踢出后尚未成功提交剩余流量的用户，已没有流量记录的用户不再保留
+func (s *trafficStatsServerImpl) kickedUsersUnpushed() map[string]struct{} {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
 
-	return nil
+	for id := range s.kickedUnpushed {
+		if _, ok := s.StatsMap[id]; !ok {
+			delete(s.kickedUnpushed, id)
+		}
+	}
+	return maps.Clone(s.kickedUnpushed)
 }
 
 func (s *trafficStatsServerImpl) LogTraffic(id string, tx, rx uint64) (ok bool) {
+	return s.LogTrafficVerdict(id, tx, rx) == server.TrafficAllow
+}
+
+// LogTrafficVerdict 记录流量并返回对该连接的处理结果，被踢出的用户返回 TrafficKick
+func (s *trafficStatsServerImpl) LogTrafficVerdict(id string, tx, rx uint64) server.TrafficVerdict {
+	if s.buffer != nil {
+		return s.logTrafficBuffered(id, tx, rx)
+	}
+
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
-	_, ok = s.KickMap[id]
-	if ok {
+	if _, ok := s.KickMap[id]; ok {
 		delete(s.KickMap, id)
-		return false
+		s.updateKickPending()
+		return server.TrafficKick
+	}
+
+	if !s.paused.Load() {
+		s.addTraffic(id, tx, rx)
+	}
+	if tx > 0 || rx > 0 {
+		s.lastTraffic[id] = s.now()
 	}
+	return server.TrafficAllow
+}
 
+// addTraffic 将流量累加到 StatsMap 和 LifetimeMap，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) addTraffic(id string, tx, rx uint64) {
 	entry, ok := s.StatsMap[id]
 	if !ok {
 		entry = &trafficStatsEntry{}
 		s.StatsMap[id] = entry
+		s.firstSeen[id] = s.now()
 	}
 	entry.Tx += tx
 	entry.Rx += rx
 
-	return true
+	lifetime, ok := s.LifetimeMap[id]
+	if !ok {
+		lifetime = &trafficStatsEntry{}
+		s.LifetimeMap[id] = lifetime
+	}
+	lifetime.Tx += tx
+	lifetime.Rx += rx
 }
 
 // LogOnlineStateChanged updates the online state to the online map.
@@ -253,97 +1025,1048 @@ func (s *trafficStatsServerImpl) LogOnlineState(id string, online bool) {
 	defer s.Mutex.Unlock()
 
 	if online {
-		s.OnlineMap[id]++
-	} else {
-		s.OnlineMap[id]--
-		if s.OnlineMap[id] <= 0 {
-			delete(s.OnlineMap, id)
+		// 重新上线（包括在保留期内重连）时从现在开始计算空闲时间，避免离线前留下的流量时间使其立即被空闲踢出
+		if _, ok := s.lastTraffic[id]; ok && (s.OnlineMap[id] == 0 || len(s.graceSlots[id]) > 0) {
+			s.lastTraffic[id] = s.now()
+		}
+		// 复用保留期内的名额，在线数不变
+		if slots := s.graceSlots[id]; len(slots) > 0 {
+			slots[len(slots)-1].timer.Stop()
+			s.setGraceSlots(id, slots[:len(slots)-1])
+			return
 		}
+		s.setOnline(id, s.OnlineMap[id]+1)
+	} else if s.reconnectGrace > 0 {
+		// 保留名额，超时后再释放。回调需要获取 Mutex，因此一定在追加完成后才会执行
+		slot := &graceSlot{}
+		slot.timer = time.AfterFunc(s.reconnectGrace, func() { s.releaseGraceSlot(id, slot) })
+		s.graceSlots[id] = append(s.graceSlots[id], slot)
+	} else {
+		s.decOnline(id)
 	}
 }
 
-func (s *trafficStatsServerImpl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if s.Secret != "" && r.Header.Get("Authorization") != s.Secret {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
-	if r.Method == http.MethodGet && r.URL.Path == "/" {
-		_, _ = w.Write([]byte(indexHTML))
-		return
-	}
-	if r.Method == http.MethodGet && r.URL.Path == "/traffic" {
-		s.getTraffic(w, r)
-		return
-	}
-	if r.Method == http.MethodPost && r.URL.Path == "/kick" {
-		s.kick(w, r)
-		return
-	}
-	if r.Method == http.MethodGet && r.URL.Path == "/online" {
-		s.getOnline(w, r)
+// isIndexPath 判断请求路径是否为首页
+func (s *trafficStatsServerImpl) isIndexPath(path string) bool {
+	return path == s.indexPath || (path == "" && s.emptyPathAsIndex)
+}
+
+// LogClientInfo 记录用户最近一次上线时的客户端信息（版本、SNI 等），在 /online?detail=true 中返回。
+// 未启用 WithClientInfo 或用户已离线时忽略
+func (s *trafficStatsServerImpl) LogClientInfo(id, info string) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if s.clientInfo == nil || s.OnlineMap[id] <= 0 {
 		return
 	}
-	http.NotFound(w, r)
+	s.clientInfo[id] = info
 }
 
-func (s *trafficStatsServerImpl) getTraffic(w http.ResponseWriter, r *http.Request) {
-	bClear, _ := strconv.ParseBool(r.URL.Query().Get("clear"))
-	var jb []byte
-	var err error
-	if bClear {
-		s.Mutex.Lock()
-		jb, err = json.Marshal(s.StatsMap)
-		s.StatsMap = make(map[string]*trafficStatsEntry)
-		s.Mutex.Unlock()
+// decOnline 将用户的在线会话数减一，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) decOnline(id string) {
+	s.setOnline(id, s.OnlineMap[id]-1)
+}
+
+// setOnline 设置用户的在线会话数，不大于 0 时删除，并累计会话时长，调用方需持有 Mutex。
+// OnlineMap 的所有修改都应经过这里，以保证会话时长的统计准确
+func (s *trafficStatsServerImpl) setOnline(id string, n int) {
+	s.accountSessionTime(id, s.now())
+	if n <= 0 {
+		delete(s.OnlineMap, id)
+		delete(s.sessionSince, id)
+		delete(s.clientInfo, id)
 	} else {
-		s.Mutex.RLock()
-		jb, err = json.Marshal(s.StatsMap)
-		s.Mutex.RUnlock()
+		s.OnlineMap[id] = n
 	}
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+}
+
+// setGraceSlots 更新用户的保留名额列表，为空时删除，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) setGraceSlots(id string, slots []*graceSlot) {
+	if len(slots) == 0 {
+		delete(s.graceSlots, id)
+	} else {
+		s.graceSlots[id] = slots
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_, _ = w.Write(jb)
 }
 
-func (s *trafficStatsServerImpl) getOnline(w http.ResponseWriter, r *http.Request) {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
+// releaseGraceSlot 保留期结束且名额未被复用时释放该名额
+func (s *trafficStatsServerImpl) releaseGraceSlot(id string, slot *graceSlot) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
 
-	jb, err := json.Marshal(s.OnlineMap)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	slots := s.graceSlots[id]
+	for i, sl := range slots {
+		if sl == slot {
+			s.setGraceSlots(id, append(slots[:i:i], slots[i+1:]...))
+			s.decOnline(id)
+			return
+		}
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_, _ = w.Write(jb)
+	// 名额已被重新连接的会话复用或已被清除
 }
 
-func (s *trafficStatsServerImpl) kick(w http.ResponseWriter, r *http.Request) {
-	var ids []string
-	err := json.NewDecoder(r.Body).Decode(&ids)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+// ResetOnline 清除所有用户的在线会话数和保留名额，用于与清空流量一起完全重置统计。
+// 仍然连接的会话不会被断开，断开时也不会使在线数变为负数，但在重新连接前不再计为在线
+func (s *trafficStatsServerImpl) ResetOnline() {
 	s.Mutex.Lock()
-	for _, id := range ids {
-		s.KickMap[id] = struct{}{}
+	defer s.Mutex.Unlock()
+
+	s.resetOnline()
+}
+
+// resetOnline 清除所有用户的在线状态和保留名额，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) resetOnline() {
+	for id := range s.graceSlots {
+		s.clearGraceSlots(id)
 	}
-	s.Mutex.Unlock()
+	for id := range s.OnlineMap {
+		s.setOnline(id, 0)
+	}
+}
 
-	w.WriteHeader(http.StatusOK)
+// clearGraceSlots 取消用户所有处于保留期的名额，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) clearGraceSlots(id string) {
+	for _, slot := range s.graceSlots[id] {
+		slot.timer.Stop()
+	}
+	delete(s.graceSlots, id)
 }
 
-// 踢出用户名单
+// ServeHTTP 处理请求，并按接口记录请求数、状态码和耗时
+func (s *trafficStatsServerImpl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := s.now()
+	rec := &statusRecorder{ResponseWriter: w}
+	s.serveHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	s.routeMetrics.observe(s.metricPath(r), rec.status, s.now().Sub(start))
+}
+
+func (s *trafficStatsServerImpl) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	for k, v := range s.securityHeaders {
+		w.Header().Set(k, v)
+	}
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if wantPretty(r) {
+		pw := &prettyResponseWriter{ResponseWriter: w}
+		defer pw.flush()
+		w = pw
+	}
+	if s.Secret != "" && !s.validAuthorization(r) && !s.validQuerySignature(r) {
+		s.logger.Println("拒绝未授权的请求:", s.trustedProxies.ClientIP(r), r.Method, r.URL.Path)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.replayGuard != nil && r.Method != http.MethodGet {
+		if err := s.replayGuard.check(r, s.now()); err != nil {
+			s.logger.Println("拒绝可能被重放的请求:", s.trustedProxies.ClientIP(r), r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method == http.MethodGet && s.isIndexPath(r.URL.Path) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(indexHTML))
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/traffic" {
+		s.limitConcurrency(s.getTraffic)(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/traffic/top" {
+		s.limitConcurrency(s.getTopTraffic)(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/traffic/user" {
+		s.getUserTraffic(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/traffic/user/consume" {
+		s.consumeUserTraffic(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/traffic/lifetime" {
+		s.limitConcurrency(s.getLifetimeTraffic)(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/traffic/pause" {
+		s.setPaused(w, true)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/traffic/resume" {
+		s.setPaused(w, false)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/traffic/flush" {
+		s.flushTraffic(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/system/flush" {
+		s.flushSystemStatus(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/kick" {
+		s.kick(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/disconnect" {
+		s.disconnect(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/online/duration" && s.sessionTimeMode != SessionTimeOff {
+		s.limitConcurrency(s.getSessionDuration)(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/online" {
+		s.limitConcurrency(s.getOnline)(w, r)
+		return
+	}
+	if s.fleet != nil {
+		if r.Method == http.MethodPost && r.URL.Path == "/ingest" {
+			s.ingest(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/fleet" {
+			s.limitConcurrency(s.getFleet)(w, r)
+			return
+		}
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/users/live" {
+		s.limitConcurrency(s.getLiveUsers)(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/users/ids" {
+		s.getUserIDs(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/users/limits" && s.userProvider != nil {
+		s.getUserLimits(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/metrics" {
+		s.getMetrics(w)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/healthz" {
+		s.getHealth(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/selftest" {
+		s.getSelfTest(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/auth/status" {
+		if mp, ok := s.userProvider.(AuthMetricsProvider); ok {
+			s.getAuthStatus(w, mp)
+			return
+		}
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/auth/etag" {
+		if cp, ok := s.userProvider.(CacheStateProvider); ok {
+			s.getAuthETag(w, cp)
+			return
+		}
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/auth/reload" {
+		if rl, ok := s.userProvider.(Reloader); ok {
+			s.reloadUsers(w, r, rl)
+			return
+		}
+	}
+	if gp, ok := s.userProvider.(GroupProvider); ok {
+		if r.Method == http.MethodPost && r.URL.Path == "/kick/group" {
+			s.kickGroup(w, r, gp)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/traffic/group" {
+			s.limitConcurrency(func(w http.ResponseWriter, r *http.Request) {
+				s.getGroupTraffic(w, r, gp)
+			})(w, r)
+			return
+		}
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/users" && s.userProvider != nil {
+		s.limitConcurrency(s.getUsers)(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// requestDone 请求已超时或客户端已断开时返回 503 并返回 true，调用方应放弃后续的耗时操作
+func requestDone(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.Context().Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
+
+// limitConcurrency 限制耗时接口的并发请求数，超出限制时直接返回 429
+func (s *trafficStatsServerImpl) limitConcurrency(h http.HandlerFunc) http.HandlerFunc {
+	if s.requestSem == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.requestSem <- struct{}{}:
+			defer func() { <-s.requestSem }()
+			h(w, r)
+		default:
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+		}
+	}
+}
+
+// getTraffic 返回尚未提交的流量。clear=true 时同时清空流量记录，但不影响在线状态（清空计费数据不应让用户掉线）；
+// 需要完全重置时同时指定 reset_online=true，在同一次加锁中清除所有用户的在线状态，效果同 ResetOnline。
+// reset_online 只能与 clear 一起使用
+func (s *trafficStatsServerImpl) getTraffic(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bClear, _ := strconv.ParseBool(q.Get("clear"))
+	resetOnline, _ := strconv.ParseBool(q.Get("reset_online"))
+	if resetOnline && !bClear {
+		http.Error(w, "reset_online requires clear=true", http.StatusBadRequest)
+		return
+	}
+	detail := q.Get("detail") == "true"
+	format := q.Get("format")
+	var contentType string
+	switch format {
+	case "", "json":
+		contentType = "application/json; charset=utf-8"
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	default:
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	s.flushTrafficBuffer()
+	// 客户端已断开或请求已超时时不再编码，尤其不能在无法返回数据的情况下清除流量
+	if requestDone(w, r) {
+		return
+	}
+	// 锁内只复制数据，编码和写出在锁外逐条进行，避免大量用户时长时间持锁和一次性分配整个响应。
+	// 清空时等待正在进行的提交完成
+	if bClear {
+		s.pushLock.Lock()
+	}
+	records := s.trafficSnapshot(bClear, resetOnline)
+	if bClear {
+		s.pushLock.Unlock()
+	}
+	w.Header().Set("Content-Type", contentType)
+	var err error
+	if format == "csv" {
+		err = writeTrafficCSV(w, records)
+	} else {
+		err = writeTrafficJSON(w, records, detail)
+	}
+	if err != nil {
+		s.logger.Println("流量数据写出失败:", err)
+	}
+}
+
+// TrafficDetail /traffic?detail=true 中单个用户的流量，FirstSeen 为本统计周期内首次产生流量的时间，未知时省略
+type TrafficDetail struct {
+	Tx        uint64     `json:"tx"`
+	Rx        uint64     `json:"rx"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+}
+
+// UserTraffic 单个用户尚未提交的流量、在线会话数和最近一次产生流量的时间
+type UserTraffic struct {
+	ID       string     `json:"id"`
+	Tx       uint64     `json:"tx"`
+	Rx       uint64     `json:"rx"`
+	Sessions int        `json:"sessions"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// FirstSeen 本统计周期内首次产生流量的时间
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+}
+
+// getUserTraffic 返回单个用户的流量和在线状态，节点上没有该用户的任何记录时返回 404
+func (s *trafficStatsServerImpl) getUserTraffic(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	stats, hasStats := s.StatsMap[id]
+	_, hasLifetime := s.LifetimeMap[id]
+	result := UserTraffic{ID: id, Sessions: s.OnlineMap[id]}
+	if hasStats {
+		result.Tx, result.Rx = stats.Tx, stats.Rx
+		if t, ok := s.firstSeen[id]; ok {
+			result.FirstSeen = &t
+		}
+	}
+	if t, ok := s.lastTraffic[id]; ok {
+		result.LastSeen = &t
+	}
+	s.Mutex.RUnlock()
+	if !hasStats && !hasLifetime && result.Sessions == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// ReadAndResetUser 原子地读取并清零单个用户尚未提交的流量，读取与清零之间产生的流量不会丢失，
+// 会计入新的记录。正在提交流量时等待提交完成，避免同一份流量既被提交又被读取。用户没有流量记录时 ok 为 false
+func (s *trafficStatsServerImpl) ReadAndResetUser(id string) (tx, rx uint64, ok bool) {
+	s.pushLock.Lock()
+	defer s.pushLock.Unlock()
+	s.flushTrafficBuffer()
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	entry, ok := s.StatsMap[id]
+	if !ok {
+		return 0, 0, false
+	}
+	delete(s.StatsMap, id)
+	delete(s.firstSeen, id)
+	return entry.Tx, entry.Rx, true
+}
+
+// TrafficStats 单个用户的上传、下载流量
+type TrafficStats struct {
+	Tx uint64 `json:"tx"`
+	Rx uint64 `json:"rx"`
+}
+
+// MergeTraffic 将 traffic 中每个用户的流量累加到 StatsMap 中已有的记录上，没有记录时新建。
+// 合并的流量不计入 LifetimeMap 和在线状态，暂停统计时也会合并
+func (s *trafficStatsServerImpl) MergeTraffic(traffic map[string]TrafficStats) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, stats := range traffic {
+		if stats.Tx == 0 && stats.Rx == 0 {
+			continue
+		}
+		entry, ok := s.StatsMap[id]
+		if !ok {
+			entry = &trafficStatsEntry{}
+			s.StatsMap[id] = entry
+			s.firstSeen[id] = s.now()
+		}
+		entry.Tx += stats.Tx
+		entry.Rx += stats.Rx
+	}
+}
+
+// consumedTraffic POST /traffic/user/consume 的返回结果
+type consumedTraffic struct {
+	ID string `json:"id"`
+	Tx uint64 `json:"tx"`
+	Rx uint64 `json:"rx"`
+}
+
+// consumeUserTraffic 读取并清零单个用户的流量，用于按用户精确计费；没有流量记录时返回零
+func (s *trafficStatsServerImpl) consumeUserTraffic(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	result := consumedTraffic{ID: id}
+	result.Tx, result.Rx, _ = s.ReadAndResetUser(id)
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// getLifetimeTraffic 返回节点启动以来各用户的累计流量
+func (s *trafficStatsServerImpl) getLifetimeTraffic(w http.ResponseWriter, r *http.Request) {
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	jb, err := json.Marshal(s.LifetimeMap)
+	s.Mutex.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// defaultActiveWindow /online?mode=active 未指定 window 时的时间窗口
+const defaultActiveWindow = time.Minute
+
+// maxActiveWindow /online?mode=active 允许的最大时间窗口，更早的流量时间不再保留
+const maxActiveWindow = time.Hour
+
+func (s *trafficStatsServerImpl) getOnline(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var online map[string]int
+	switch q.Get("mode") {
+	case "", "session":
+		s.Mutex.RLock()
+		online = maps.Clone(s.OnlineMap)
+		s.Mutex.RUnlock()
+	case "active":
+		window := defaultActiveWindow
+		if v := q.Get("window"); v != "" {
+			var err error
+			window, err = time.ParseDuration(v)
+			if err != nil || window <= 0 || window > maxActiveWindow {
+				http.Error(w, "invalid window", http.StatusBadRequest)
+				return
+			}
+		}
+		online = s.activeUsers(s.now(), window)
+	default:
+		http.Error(w, "invalid mode", http.StatusBadRequest)
+		return
+	}
+
+	var v any = online
+	if q.Get("detail") == "true" {
+		v = s.onlineDetail(online)
+	}
+	jb, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// OnlineDetail /online?detail=true 中单个用户的在线信息，客户端信息未知时省略
+type OnlineDetail struct {
+	Sessions int    `json:"sessions"`
+	Client   string `json:"client,omitempty"`
+}
+
+// onlineDetail 为在线用户附加最近一次上线时记录的客户端信息
+func (s *trafficStatsServerImpl) onlineDetail(online map[string]int) map[string]OnlineDetail {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	detail := make(map[string]OnlineDetail, len(online))
+	for id, n := range online {
+		detail[id] = OnlineDetail{Sessions: n, Client: s.clientInfo[id]}
+	}
+	return detail
+}
+
+// activeUsers 返回最近 window 内有流量的用户，格式与 OnlineMap 相同，
+// 值为在线会话数（会话事件缺失时至少为 1），不依赖内核上报的会话事件
+func (s *trafficStatsServerImpl) activeUsers(now time.Time, window time.Duration) map[string]int {
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	active := make(map[string]int)
+	for id, t := range s.lastTraffic {
+		if now.Sub(t) <= window {
+			active[id] = max(s.OnlineMap[id], 1)
+		}
+	}
+	return active
+}
+
+// LiveUser 合并流量记录与在线状态后的单个用户实时信息
+type LiveUser struct {
+	ID       string `json:"id"`
+	Tx       uint64 `json:"tx"`
+	Rx       uint64 `json:"rx"`
+	Sessions int    `json:"sessions"`
+}
+
+// liveUsers 在同一次读锁中对 StatsMap 和 OnlineMap 做外连接，缺失的一侧以零值填充，结果按 ID 排序
+func (s *trafficStatsServerImpl) liveUsers() []LiveUser {
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	users := make([]LiveUser, 0, max(len(s.StatsMap), len(s.OnlineMap)))
+	for id, stats := range s.StatsMap {
+		users = append(users, LiveUser{
+			ID:       id,
+			Tx:       stats.Tx,
+			Rx:       stats.Rx,
+			Sessions: s.OnlineMap[id],
+		})
+	}
+	for id, sessions := range s.OnlineMap {
+		if _, ok := s.StatsMap[id]; ok {
+			continue
+		}
+		users = append(users, LiveUser{ID: id, Sessions: sessions})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+func (s *trafficStatsServerImpl) getLiveUsers(w http.ResponseWriter, r *http.Request) {
+	jb, err := json.Marshal(s.liveUsers())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// userIDs 返回有流量（source 为 traffic）、在线（online）或两者之一（both）的用户 ID，按 ID 排序
+func (s *trafficStatsServerImpl) userIDs(source string) []string {
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	ids := make([]string, 0, max(len(s.StatsMap), len(s.OnlineMap)))
+	if source != "online" {
+		for id := range s.StatsMap {
+			ids = append(ids, id)
+		}
+	}
+	if source != "traffic" {
+		for id := range s.OnlineMap {
+			if _, ok := s.StatsMap[id]; ok && source == "both" {
+				continue
+			}
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// getUserIDs 处理 GET /users/ids?source=traffic|online|both，只返回用户 ID 数组，source 默认为 both
+func (s *trafficStatsServerImpl) getUserIDs(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	switch source {
+	case "":
+		source = "both"
+	case "traffic", "online", "both":
+	default:
+		http.Error(w, "source must be traffic, online or both", http.StatusBadRequest)
+		return
+	}
+	jb, err := json.Marshal(s.userIDs(source))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+func (s *trafficStatsServerImpl) getUsers(w http.ResponseWriter, r *http.Request) {
+	jb, err := json.Marshal(s.userProvider.Users())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// userLimitsResponse GET /users/limits 的返回结果
+type userLimitsResponse struct {
+	ID          string `json:"id"`
+	SpeedLimit  int    `json:"speed_limit"`
+	DeviceLimit int    `json:"device_limit"`
+	// Source 限制的来源（auth.LimitSource* 常量），用户列表来源无法说明时省略
+	Source string `json:"source,omitempty"`
+}
+
+// getUserLimits 处理 GET /users/limits?id=<id>，返回认证层当前对该用户生效的限速和设备数限制及其来源，
+// 用于排查面板修改的限制未生效的问题。节点不执行流量配额，不返回配额。用户不在用户列表中时返回 404
+func (s *trafficStatsServerImpl) getUserLimits(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	var result *userLimitsResponse
+	for _, user := range s.userProvider.Users() {
+		if strconv.Itoa(user.ID) == id {
+			result = &userLimitsResponse{ID: id, SpeedLimit: user.SpeedLimit, DeviceLimit: user.DeviceLimit}
+			break
+		}
+	}
+	if result == nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if lp, ok := s.userProvider.(LimitSourceProvider); ok {
+		result.Source = lp.LimitSource()
+	}
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+func (s *trafficStatsServerImpl) getAuthStatus(w http.ResponseWriter, mp AuthMetricsProvider) {
+	jb, err := json.Marshal(mp.AuthMetrics())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// getAuthETag 返回用户列表当前保存的 ETag、Last-Modified、最近一次成功拉取的时间和是否返回 304，
+// 用于排查面板修改迟迟不生效的问题
+func (s *trafficStatsServerImpl) getAuthETag(w http.ResponseWriter, cp CacheStateProvider) {
+	jb, err := json.Marshal(cp.CacheState())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+func (s *trafficStatsServerImpl) kick(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	err := json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := s.now()
+	s.Mutex.Lock()
+	for _, id := range ids {
+		s.queueKick(id, now)
+	}
+	s.Mutex.Unlock()
+	s.notifyKick(ids, KickReasonAPI)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// flushResponse /traffic/flush 的返回结果
+type flushResponse struct {
+	OK      bool   `json:"ok"`
+	Entries int    `json:"entries"`
+	Error   string `json:"error,omitempty"`
+}
+
+// flushTraffic 立即向面板提交一次流量，若定时提交正在进行则等待其完成后再提交剩余流量
+func (s *trafficStatsServerImpl) flushTraffic(w http.ResponseWriter, r *http.Request) {
+	if s.trafficPushURL == "" {
+		http.Error(w, "traffic push is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	n, err := s.pushTraffic(context.Background(), s.trafficPushURL)
+	result := flushResponse{OK: err == nil, Entries: n}
+	status := http.StatusOK
+	if err != nil {
+		result.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(jb)
+}
+
+// systemFlushResponse /system/flush 的返回结果
+type systemFlushResponse struct {
+	OK     bool         `json:"ok"`
+	Status SystemStatus `json:"status"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// flushSystemStatus 立即采集并提交一次系统状态，返回采集到的系统状态和提交结果。
+// 若定时提交正在进行则等待其完成后再提交
+func (s *trafficStatsServerImpl) flushSystemStatus(w http.ResponseWriter, r *http.Request) {
+	if s.systemStatusDisabled {
+		http.Error(w, errSystemStatusDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if s.systemStatusURL == "" {
+		http.Error(w, "system status push is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	status, err := s.pushSystemStatus(s.systemStatusURL)
+	result := systemFlushResponse{OK: err == nil, Status: status}
+	code := http.StatusOK
+	if err != nil {
+		result.Error = err.Error()
+		code = http.StatusBadGateway
+	}
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write(jb)
+}
+
+// countResponse /disconnect、/kick/group 等批量操作的返回结果
+type countResponse struct {
+	Count int `json:"count"`
+}
+
+// disconnect 在同一次加锁中将用户加入踢出名单并清除其在线状态，
+// 返回原本处于在线状态的用户数，使 /online 在管理员断开用户后立即准确
+func (s *trafficStatsServerImpl) disconnect(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	err := json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := s.now()
+	count := 0
+	s.Mutex.Lock()
+	for _, id := range ids {
+		s.markKicked(id, now)
+		s.clearGraceSlots(id)
+		if _, ok := s.OnlineMap[id]; ok {
+			s.setOnline(id, 0)
+			count++
+		}
+	}
+	s.Mutex.Unlock()
+	s.notifyKick(ids, KickReasonDisconnect)
+
+	jb, err := json.Marshal(countResponse{Count: count})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// kickGroup 踢出请求体中列出的各分组内的所有用户，返回踢出的用户数
+func (s *trafficStatsServerImpl) kickGroup(w http.ResponseWriter, r *http.Request, gp GroupProvider) {
+	var groups []string
+	err := json.NewDecoder(r.Body).Decode(&groups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := s.now()
+	var kicked []string
+	s.Mutex.Lock()
+	for _, group := range groups {
+		for _, id := range gp.GroupMembers(group) {
+			s.queueKick(id, now)
+			kicked = append(kicked, id)
+		}
+	}
+	s.Mutex.Unlock()
+	s.notifyKick(kicked, KickReasonGroup)
+
+	jb, err := json.Marshal(countResponse{Count: len(kicked)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// getGroupTraffic 返回分组内有流量记录的用户的流量
+func (s *trafficStatsServerImpl) getGroupTraffic(w http.ResponseWriter, r *http.Request, gp GroupProvider) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing group name", http.StatusBadRequest)
+		return
+	}
+	members := gp.GroupMembers(name)
+	stats := make(map[string]trafficStatsEntry, len(members))
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	for _, id := range members {
+		if entry, ok := s.StatsMap[id]; ok {
+			stats[id] = *entry
+		}
+	}
+	s.Mutex.RUnlock()
+
+	jb, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
+
+// 踢出用户名单
 func (s *trafficStatsServerImpl) NewKick(id string) bool {
 	s.Mutex.Lock()
-	s.KickMap[id] = struct{}{}
+	s.queueKick(id, s.now())
 	s.Mutex.Unlock()
+	s.notifyKick([]string{id}, KickReasonAuth)
 	return true
 }
 
+// queueKick 将用户加入踢出名单，调用方需持有 Mutex。
+// 默认用户在连接实际断开前仍计为在线；启用 kickMarksOffline 时立即清除在线状态和保留名额
+func (s *trafficStatsServerImpl) queueKick(id string, now time.Time) {
+	s.markKicked(id, now)
+	if !s.kickMarksOffline {
+		return
+	}
+	s.clearGraceSlots(id)
+	if _, ok := s.OnlineMap[id]; ok {
+		s.setOnline(id, 0)
+	}
+}
+
+// markKicked 将用户加入踢出名单，并保留其尚未提交的流量直到成功提交，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) markKicked(id string, now time.Time) {
+	s.KickMap[id] = now
+	s.updateKickPending()
+	// 启用流量缓冲时流量可能尚未合并到 StatsMap，没有流量的用户在提交时再移除
+	s.kickedUnpushed[id] = struct{}{}
+}
+
+// 踢出原因，作为 OnKick 回调的参数
+const (
+	KickReasonAPI        = "api"        // POST /kick
+	KickReasonDisconnect = "disconnect" // POST /disconnect
+	KickReasonGroup      = "group"      // POST /kick/group
+	KickReasonAuth       = "auth"       // 认证层通过 NewKick 踢出，如用户被移除
+	KickReasonIdle       = "idle"       // 空闲超时
+)
+
+// notifyKick 通知被踢出的用户，调用时不持有 Mutex。设置了 OnKickBatch 时一次踢出只通知一次，
+// 否则对每个用户调用 OnKick。启用了通知队列时只入队，由 runKickQueue 异步调用
+func (s *trafficStatsServerImpl) notifyKick(ids []string, reason string) {
+	if len(ids) == 0 || (s.onKick == nil && s.onKickBatch == nil) {
+		return
+	}
+	if s.onKickBatch != nil {
+		if s.kickQueue == nil {
+			s.deliverKick(kickEvent{ids: ids, reason: reason})
+		} else if !s.kickQueue.enqueue(kickEvent{ids: ids, reason: reason}) {
+			s.logger.Println(fmt.Sprintf("踢出通知队列已满，丢弃 %d 个用户的通知: %s", len(ids), reason))
+		}
+		return
+	}
+	for _, id := range ids {
+		e := kickEvent{ids: []string{id}, reason: reason}
+		if s.kickQueue == nil {
+			s.deliverKick(e)
+		} else if !s.kickQueue.enqueue(e) {
+			s.logger.Println("踢出通知队列已满，丢弃通知:", id, reason)
+		}
+	}
+}
+
+// deliverKick 调用踢出回调，同时执行的回调数超过 kickSem 的容量时等待
+func (s *trafficStatsServerImpl) deliverKick(e kickEvent) {
+	if s.kickSem != nil {
+		s.kickSem <- struct{}{}
+		defer func() { <-s.kickSem }()
+	}
+	if s.onKickBatch != nil {
+		s.onKickBatch(e.ids, e.reason)
+		return
+	}
+	for _, id := range e.ids {
+		s.onKick(id, e.reason)
+	}
+}
+
+// reapIdleInterval 定期踢出空闲超过 idleTimeout 的在线用户
+func (s *trafficStatsServerImpl) reapIdleInterval() {
+	ticker := time.NewTicker(max(s.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.reapIdle(s.now())
+	}
+}
+
+// reapIdle 将最近一次产生流量距今超过 idleTimeout 的在线用户加入踢出名单并清除其在线状态，
+// 释放其占用的在线名额。从未产生流量的用户无法判断空闲时间，不会被踢出
+func (s *trafficStatsServerImpl) reapIdle(now time.Time) {
+	var idle []string
+	s.flushTrafficBuffer()
+	s.Mutex.Lock()
+	for id := range s.OnlineMap {
+		if t, ok := s.lastTraffic[id]; ok && now.Sub(t) > s.idleTimeout {
+			idle = append(idle, id)
+		}
+	}
+	for _, id := range idle {
+		s.markKicked(id, now)
+		s.clearGraceSlots(id)
+		s.setOnline(id, 0)
+	}
+	s.Mutex.Unlock()
+	s.notifyKick(idle, KickReasonIdle)
+}
+
+// expireKicksInterval 定期清理超过 kickTTL 仍未被消费的踢出记录，
+// 避免从未重连的用户一直留在踢出名单中
+func (s *trafficStatsServerImpl) expireKicksInterval() {
+	ticker := time.NewTicker(max(s.kickTTL/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.expireKicks(s.now())
+	}
+}
+
+func (s *trafficStatsServerImpl) expireKicks(now time.Time) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, t := range s.KickMap {
+		if now.Sub(t) > s.kickTTL {
+			delete(s.KickMap, id)
+		}
+	}
+	s.updateKickPending()
+}
+
+// updateKickPending 根据 KickMap 是否为空更新 kickPending，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) updateKickPending() {
+	s.kickPending.Store(len(s.KickMap) > 0)
+}
+
 // 确保 trafficStatsServerImpl 实现了 TrafficStatsServer 接口
 var _ TrafficStatsServer = &trafficStatsServerImpl{}
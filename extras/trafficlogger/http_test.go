@@ -0,0 +1,1089 @@
+package trafficlogger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/extras/v2/auth"
+	"github.com/apernet/hysteria/extras/v2/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(opts ...Option) *trafficStatsServerImpl {
+	return NewTrafficStatsServerWithOptions(opts...).(*trafficStatsServerImpl)
+}
+
+func TestKickExpiry(t *testing.T) {
+	s := newTestServer()
+	s.kickTTL = time.Minute
+
+	now := time.Now()
+	s.KickMap["1"] = now.Add(-2 * time.Minute)
+	s.KickMap["2"] = now.Add(-30 * time.Second)
+	s.expireKicks(now)
+
+	assert.Equal(t, map[string]time.Time{"2": now.Add(-30 * time.Second)}, s.KickMap)
+
+	// A pending kick is still consumed by the next LogTraffic
+	assert.False(t, s.LogTraffic("2", 1, 1))
+	assert.True(t, s.LogTraffic("2", 1, 1))
+	assert.Empty(t, s.KickMap)
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	s := newTestServer()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+	assert.NotEqual(t, "", rec.Header().Get("Content-Security-Policy"))
+
+	s = newTestServer(WithSecret("secret"), WithSecurityHeaders(false))
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("X-Frame-Options"))
+}
+
+func TestUnauthorizedClientIP(t *testing.T) {
+	proxies, err := utils.ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	logger := &testLogger{}
+	s := newTestServer(WithSecret("secret"), WithTrustedProxies(proxies), WithLogger(logger))
+
+	for _, remote := range []string{"10.0.0.1:1000", "1.2.3.4:1000"} {
+		r := httptest.NewRequest(http.MethodGet, "/traffic", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", "5.6.7.8")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.Equal(t, []string{
+		"拒绝未授权的请求: 5.6.7.8 GET /traffic",
+		"拒绝未授权的请求: 1.2.3.4 GET /traffic",
+	}, logger.lines)
+}
+
+func TestDisconnect(t *testing.T) {
+	s := newTestServer()
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("2", true)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/disconnect", strings.NewReader(`["1","3"]`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"count":1}`, rec.Body.String())
+	assert.Equal(t, map[string]int{"2": 1}, s.OnlineMap)
+	assert.Len(t, s.KickMap, 2)
+
+	// A late offline report from the core must not resurrect the entry
+	s.LogOnlineState("1", false)
+	assert.Equal(t, map[string]int{"2": 1}, s.OnlineMap)
+}
+
+func TestKickMarksOffline(t *testing.T) {
+	// By default a kicked user stays online until the connection is dropped
+	s := newTestServer()
+	s.LogOnlineState("1", true)
+	s.NewKick("1")
+	assert.Equal(t, map[string]int{"1": 1}, s.OnlineMap)
+
+	s = newTestServer(WithKickMarksOffline(true))
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("2", true)
+	s.NewKick("1")
+	s.NewKick("3")
+	assert.Equal(t, map[string]int{"2": 1}, s.OnlineMap)
+
+	// The kick is still applied on the next LogTraffic
+	assert.False(t, s.LogTraffic("1", 1, 1))
+}
+
+func TestLiveUsers(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("1", 10, 20)
+	s.LogTraffic("2", 30, 40)
+	s.LogOnlineState("2", true)
+	s.LogOnlineState("3", true)
+	s.LogOnlineState("3", true)
+
+	assert.Equal(t, []LiveUser{
+		{ID: "1", Tx: 10, Rx: 20},
+		{ID: "2", Tx: 30, Rx: 40, Sessions: 1},
+		{ID: "3", Sessions: 2},
+	}, s.liveUsers())
+}
+
+func TestUserIDs(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("1", 10, 20)
+	s.LogTraffic("2", 30, 40)
+	s.LogOnlineState("2", true)
+	s.LogOnlineState("3", true)
+
+	assert.Equal(t, []string{"1", "2"}, s.userIDs("traffic"))
+	assert.Equal(t, []string{"2", "3"}, s.userIDs("online"))
+	assert.Equal(t, []string{"1", "2", "3"}, s.userIDs("both"))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/ids", nil))
+	assert.Equal(t, `["1","2","3"]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/ids?source=all", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFlushTraffic(t *testing.T) {
+	var pushed []string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = append(pushed, string(b))
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithTrafficPushURL(panel.URL))
+	s.LogTraffic("1", 10, 20)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/traffic/flush", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"ok":true,"entries":1}`, rec.Body.String())
+	assert.Equal(t, []string{`[{"uid":1,"u":10,"d":20}]`}, pushed)
+	assert.Empty(t, s.StatsMap)
+
+	s = newTestServer()
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/traffic/flush", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestFlushSystemStatus(t *testing.T) {
+	var pushed []string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = append(pushed, string(b))
+	}))
+	defer panel.Close()
+
+	s := newTestServer(
+		WithSystemStatusURL(panel.URL),
+		WithSystemInfo(func() (SystemInfo, error) { return SystemInfo{CpuPercent: 5, Uptime: 7}, nil }),
+	)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/system/flush", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var result systemFlushResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.True(t, result.OK)
+	assert.Equal(t, "5%", result.Status.Cpu)
+	assert.Equal(t, uint64(7), result.Status.Uptime)
+	require.Len(t, pushed, 1)
+	assert.Contains(t, pushed[0], `"cpu":"5%"`)
+
+	s = newTestServer()
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/system/flush", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestFormatPercent(t *testing.T) {
+	assert.Equal(t, "13%", formatPercent(12.8, 0))
+	assert.Equal(t, "12.8%", formatPercent(12.8, 1))
+	assert.Equal(t, "12.34%", formatPercent(12.3406, 2))
+	assert.Equal(t, "13%", formatPercent(12.8, -1))
+}
+
+func TestSystemStatus(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(WithPercentPrecision(1), WithClock(func() time.Time { return now }))
+	status := s.systemStatus(SystemInfo{CpuPercent: 12.34, MemPercent: 50, DiskPercent: 99.99, Uptime: 60})
+	jb, err := json.Marshal(status)
+	require.NoError(t, err)
+	assert.Equal(t, `{"cpu":"12.3%","mem":"50.0%","disk":"100.0%","uptime":60,"process_uptime":0,"cpu_percent":12.34,"mem_percent":50,"disk_percent":99.99}`, string(jb))
+
+	now = now.Add(90 * time.Second)
+	assert.Equal(t, uint64(90), s.systemStatus(SystemInfo{Uptime: 60}).ProcessUptime)
+}
+
+type testLogger struct{ lines []string }
+
+func (l *testLogger) Println(v ...any) {
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func TestInjectedDependencies(t *testing.T) {
+	var body string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := io.ReadAll(r.Body)
+		body = string(bs)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer panel.Close()
+
+	now := time.Unix(1700000000, 0)
+	logger := &testLogger{}
+	s := newTestServer(
+		WithHTTPClient(panel.Client()),
+		WithClock(func() time.Time { return now }),
+		WithLogger(logger),
+		WithSystemInfo(func() (SystemInfo, error) { return SystemInfo{CpuPercent: 1, Uptime: 5}, nil }),
+		WithSlowPushThreshold(time.Nanosecond),
+	)
+
+	assert.Error(t, s.PushSystemStatus(panel.URL))
+	assert.Equal(t, `{"cpu":"1%","mem":"0%","disk":"0%","uptime":5,"process_uptime":0,"cpu_percent":1,"mem_percent":0,"disk_percent":0}`, body)
+
+	s.NewKick("1")
+	assert.Equal(t, now, s.KickMap["1"])
+
+	// Each push takes a second on the fake clock, so it is logged as slow
+	s.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	s.LogTraffic("2", 1, 1)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	require.Len(t, logger.lines, 1)
+	assert.Contains(t, logger.lines[0], "耗时 1s")
+}
+
+func TestCPUWarmup(t *testing.T) {
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer panel.Close()
+
+	s := newTestServer(
+		WithSystemInfo(func() (SystemInfo, error) { return SystemInfo{}, nil }),
+		WithCPUWarmup(50*time.Millisecond),
+	)
+	assert.NoError(t, s.PushSystemStatus(panel.URL))
+	assert.GreaterOrEqual(t, time.Since(s.createdAt), 50*time.Millisecond)
+}
+
+func TestConnectionCounts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	samples := 0
+	s := newTestServer(WithClock(func() time.Time { return now }), WithConnectionCounts(time.Minute))
+	s.connCounter = func() (int, int, error) {
+		samples++
+		return samples, 2, nil
+	}
+
+	tcp, udp := s.sampleConnCounts()
+	require.NotNil(t, tcp)
+	assert.Equal(t, 1, *tcp)
+	assert.Equal(t, 2, *udp)
+
+	// Within the interval the cached counts are reused
+	now = now.Add(30 * time.Second)
+	tcp, _ = s.sampleConnCounts()
+	assert.Equal(t, 1, *tcp)
+
+	now = now.Add(30 * time.Second)
+	tcp, _ = s.sampleConnCounts()
+	assert.Equal(t, 2, *tcp)
+
+	tcp, udp = newTestServer().sampleConnCounts()
+	assert.Nil(t, tcp)
+	assert.Nil(t, udp)
+}
+
+func TestReconnectGrace(t *testing.T) {
+	s := newTestServer(WithReconnectGrace(50 * time.Millisecond))
+	s.LogOnlineState("1", true)
+
+	// A quick reconnect reuses the held slot
+	s.LogOnlineState("1", false)
+	s.LogOnlineState("1", true)
+	assert.Equal(t, map[string]int{"1": 1}, s.OnlineMap)
+
+	// Without a reconnect the slot is freed after the grace period
+	s.LogOnlineState("1", false)
+	s.Mutex.RLock()
+	assert.Equal(t, map[string]int{"1": 1}, s.OnlineMap)
+	s.Mutex.RUnlock()
+	time.Sleep(100 * time.Millisecond)
+	s.Mutex.RLock()
+	assert.Empty(t, s.OnlineMap)
+	assert.Empty(t, s.graceSlots)
+	s.Mutex.RUnlock()
+}
+
+func TestTrafficClearResetOnline(t *testing.T) {
+	s := newTestServer()
+	s.LogOnlineState("1", true)
+	s.LogTraffic("1", 1, 2)
+
+	// A plain clear keeps the online state
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?clear=true", nil))
+	assert.Empty(t, s.StatsMap)
+	assert.Equal(t, map[string]int{"1": 1}, s.OnlineMap)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?reset_online=true", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	s.LogTraffic("1", 1, 2)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?clear=true&reset_online=true", nil))
+	assert.Equal(t, `{"1":{"tx":1,"rx":2}}`, rec.Body.String())
+	assert.Empty(t, s.StatsMap)
+	assert.Empty(t, s.OnlineMap)
+
+	// Sessions that disconnect after the reset do not go negative
+	s.LogOnlineState("1", false)
+	assert.Empty(t, s.OnlineMap)
+	s.LogOnlineState("2", true)
+	s.ResetOnline()
+	assert.Empty(t, s.OnlineMap)
+}
+
+func TestLifetimeTraffic(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("1", 10, 20)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?clear=true", nil))
+	assert.Empty(t, s.StatsMap)
+
+	s.LogTraffic("1", 1, 2)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/lifetime", nil))
+	assert.Equal(t, `{"1":{"tx":11,"rx":22}}`, rec.Body.String())
+	assert.Equal(t, trafficStatsEntry{Tx: 1, Rx: 2}, *s.StatsMap["1"])
+}
+
+func TestTrafficFirstSeen(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestServer(WithClock(func() time.Time { return now }))
+	s.LogTraffic("1", 1, 2)
+	first := now
+	now = now.Add(time.Minute)
+	s.LogTraffic("1", 1, 2)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?detail=true&clear=true", nil))
+	var detail map[string]TrafficDetail
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail))
+	assert.Equal(t, uint64(2), detail["1"].Tx)
+	assert.True(t, first.Equal(*detail["1"].FirstSeen))
+
+	// A cleared entry starts a new window
+	s.LogTraffic("1", 1, 2)
+	assert.Equal(t, now, s.firstSeen["1"])
+}
+
+func TestConsumeUserTraffic(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("1", 10, 20)
+	s.LogTraffic("2", 1, 2)
+
+	consume := func(id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/traffic/user/consume?id="+id, nil))
+		return rec
+	}
+	assert.Equal(t, `{"id":"1","tx":10,"rx":20}`, consume("1").Body.String())
+	assert.Equal(t, `{"id":"1","tx":0,"rx":0}`, consume("1").Body.String())
+	assert.Equal(t, http.StatusBadRequest, consume("").Code)
+	assert.Contains(t, s.StatsMap, "2")
+
+	s.LogTraffic("1", 3, 4)
+	tx, rx, ok := s.ReadAndResetUser("1")
+	assert.True(t, ok)
+	assert.Equal(t, [2]uint64{3, 4}, [2]uint64{tx, rx})
+	_, _, ok = s.ReadAndResetUser("1")
+	assert.False(t, ok)
+}
+
+func TestMergeTraffic(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("1", 1, 2)
+	s.MergeTraffic(map[string]TrafficStats{"1": {Tx: 10, Rx: 20}, "2": {Tx: 3, Rx: 4}, "3": {}})
+	s.flushTrafficBuffer()
+	assert.Equal(t, map[string]*trafficStatsEntry{"1": {Tx: 11, Rx: 22}, "2": {Tx: 3, Rx: 4}}, s.StatsMap)
+	assert.Equal(t, map[string]*trafficStatsEntry{"1": {Tx: 1, Rx: 2}}, s.LifetimeMap)
+}
+
+func TestTrafficCSV(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("2", 3, 4)
+	s.LogTraffic("1", 10, 20)
+	s.LogTraffic(`a"b,c`, 1, 1)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?format=csv&clear=true", nil))
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "id,tx,rx\n1,10,20\n2,3,4\n\"a\"\"b,c\",1,1\n", rec.Body.String())
+	assert.Empty(t, s.StatsMap)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?format=xml", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestTrafficJSONStream(t *testing.T) {
+	s := newTestServer()
+	for i := 0; i < 100; i++ {
+		s.LogTraffic(strconv.Itoa(i), uint64(i), uint64(2*i))
+	}
+	s.LogTraffic(`<a"b>`, 1, 1)
+
+	// The streamed body is identical to marshalling the whole map
+	want, err := json.Marshal(s.StatsMap)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic", nil))
+	assert.Equal(t, string(want), rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?clear=true", nil))
+	assert.Equal(t, string(want), rec.Body.String())
+	assert.Empty(t, s.StatsMap)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic", nil))
+	assert.Equal(t, "{}", rec.Body.String())
+}
+
+func TestIndexPath(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		path string
+		want int
+	}{
+		{nil, "/", http.StatusOK},
+		{nil, "", http.StatusNotFound},
+		{[]Option{WithIndexPath("", true)}, "", http.StatusOK},
+		{[]Option{WithIndexPath("/stats/", false)}, "/stats/", http.StatusOK},
+		{[]Option{WithIndexPath("/stats/", false)}, "/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		s := newTestServer(tt.opts...)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = tt.path
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, tt.want, rec.Code, "path %q", tt.path)
+	}
+
+	s := newTestServer(WithIndexPath("stats", false))
+	assert.Error(t, s.Validate())
+}
+
+func TestUserTraffic(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := newTestServer(WithClock(func() time.Time { return now }))
+	s.LogTraffic("1", 10, 20)
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("2", true)
+
+	get := func(id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/user?id="+id, nil))
+		return rec
+	}
+	assert.Equal(t, `{"id":"1","tx":10,"rx":20,"sessions":1,"last_seen":"2024-01-02T03:04:05Z","first_seen":"2024-01-02T03:04:05Z"}`, get("1").Body.String())
+	assert.Equal(t, `{"id":"2","tx":0,"rx":0,"sessions":1}`, get("2").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("3").Code)
+	assert.Equal(t, http.StatusBadRequest, get("").Code)
+}
+
+func TestPrettyResponse(t *testing.T) {
+	s := newTestServer()
+	s.LogTraffic("1", 10, 20)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?pretty=true", nil))
+	assert.Equal(t, "{\n  \"1\": {\n    \"tx\": 10,\n    \"rx\": 20\n  }\n}\n", rec.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/user?id=2&pretty=true", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "user not found\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic", nil))
+	assert.Equal(t, `{"1":{"tx":10,"rx":20}}`, rec.Body.String())
+}
+
+func TestPauseTraffic(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithTrafficShards(4)}} {
+		s := newTestServer(opts...)
+		s.LogTraffic("1", 1, 1)
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/traffic/pause", nil))
+		assert.Equal(t, `{"paused":true}`, rec.Body.String())
+		assert.True(t, s.Paused())
+
+		s.LogTraffic("1", 10, 10)
+		s.NewKick("2")
+		assert.False(t, s.LogTraffic("2", 10, 10))
+
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		assert.Contains(t, rec.Body.String(), `"paused":true`)
+		assert.Equal(t, map[string]trafficStatsEntry{"1": {Tx: 1, Rx: 1}}, s.snapshotTraffic())
+
+		s.Resume()
+		s.LogTraffic("1", 10, 10)
+		assert.Equal(t, map[string]trafficStatsEntry{"1": {Tx: 11, Rx: 11}}, s.snapshotTraffic())
+	}
+}
+
+type testGroupProvider map[string][]string
+
+func (p testGroupProvider) Users() []auth.User                 { return nil }
+func (p testGroupProvider) GroupMembers(group string) []string { return p[group] }
+
+func TestGroupEndpoints(t *testing.T) {
+	s := newTestServer(WithUserProvider(testGroupProvider{"reseller": {"1", "2"}}))
+	s.LogTraffic("1", 10, 20)
+	s.LogTraffic("3", 30, 40)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/group?name=reseller", nil))
+	assert.Equal(t, `{"1":{"tx":10,"rx":20}}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/kick/group", strings.NewReader(`["reseller"]`)))
+	assert.Equal(t, `{"count":2}`, rec.Body.String())
+	assert.Len(t, s.KickMap, 2)
+	assert.Contains(t, s.KickMap, "2")
+}
+
+type testUserProvider []auth.User
+
+func (p testUserProvider) Users() []auth.User { return p }
+
+func TestUnknownUserPolicy(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+
+	users := testUserProvider{{ID: 1}}
+	tests := []struct {
+		policy UnknownUserPolicy
+		want   string
+	}{
+		{UnknownUserDrop, `[{"uid":1,"u":1,"d":2}]`},
+		{UnknownUserBucket, `[{"uid":1,"u":1,"d":2},{"uid":-1,"u":30,"d":40}]`},
+	}
+	for _, tt := range tests {
+		s := newTestServer(WithUserProvider(users), WithUnknownUserPolicy(tt.policy, -1))
+		s.LogTraffic("1", 1, 2)
+		s.LogTraffic("2", 10, 20)
+		s.LogTraffic("not-a-number", 20, 20)
+		require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+		assert.Equal(t, tt.want, pushed)
+		assert.Empty(t, s.StatsMap)
+	}
+
+	// Default policy keeps the old behavior
+	s := newTestServer(WithUserProvider(users))
+	s.LogTraffic("not-a-number", 1, 1)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+}
+
+func TestKickedUserFinalPush(t *testing.T) {
+	var pushed []string
+	fail := true
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		pushed = append(pushed, string(b))
+	}))
+	defer panel.Close()
+
+	users := testUserProvider{{ID: 1}, {ID: 2}}
+	s := newTestServer(WithUserProvider(&users), WithUnknownUserPolicy(UnknownUserDrop, 0), WithLogger(&testLogger{}))
+	s.LogTraffic("1", 1, 2)
+	s.LogTraffic("2", 3, 4)
+
+	// User 2 is kicked and removed from the user list, and the first push fails
+	s.NewKick("2")
+	users = users[:1]
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+
+	// The final bytes still reach the panel
+	fail = false
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	require.Len(t, pushed, 1)
+	assert.Contains(t, pushed[0], `{"uid":2,"u":3,"d":4}`)
+	assert.Empty(t, s.StatsMap)
+	assert.Empty(t, s.kickedUnpushed)
+
+	// Once pushed, later traffic of the removed user follows the unknown user policy
+	assert.False(t, s.LogTraffic("2", 1, 1))
+	assert.True(t, s.LogTraffic("2", 1, 1))
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, pushed, 1)
+}
+
+func TestPushLimits(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+
+	users := testUserProvider{{ID: 1, SpeedLimit: 100, DeviceLimit: 2}, {ID: 2}}
+	s := newTestServer(WithUserProvider(users), WithPushLimits(true), WithSortedPush(true))
+	s.LogTraffic("1", 1, 2)
+	s.LogTraffic("2", 3, 4)
+	s.LogTraffic("3", 5, 6)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2,"st":100,"dt":2},{"uid":2,"u":3,"d":4,"st":0,"dt":0},{"uid":3,"u":5,"d":6}]`, pushed)
+
+	// Limits are not included by default
+	s = newTestServer(WithUserProvider(users))
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2}]`, pushed)
+}
+
+func TestGranularity(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithGranularity(1000), WithSortedPush(true))
+	s.LogTraffic("1", 2500, 999)
+	s.LogTraffic("2", 10, 20)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":2000,"d":0}]`, pushed)
+	assert.Equal(t, map[string]*trafficStatsEntry{"1": {Tx: 500, Rx: 999}, "2": {Tx: 10, Rx: 20}}, s.StatsMap)
+
+	// The remainder is carried into the next push
+	s.LogTraffic("1", 500, 1)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1000,"d":1000}]`, pushed)
+
+	// Kicked users push their exact remainder
+	s.NewKick("2")
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":2,"u":10,"d":20}]`, pushed)
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestUserLimits(t *testing.T) {
+	s := newTestServer(WithUserProvider(testUserProvider{{ID: 1, SpeedLimit: 100, DeviceLimit: 2}}))
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	assert.Equal(t, `{"id":"1","speed_limit":100,"device_limit":2}`, get("/users/limits?id=1").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/users/limits?id=2").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/users/limits").Code)
+}
+
+func TestMaxEntryValue(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithMaxEntryValue(100), WithSortedPush(true))
+	s.LogTraffic("1", 250, 10)
+	s.LogTraffic("2", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":100,"d":10},{"uid":2,"u":1,"d":2}]`, pushed)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":100,"d":0}]`, pushed)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":50,"d":0}]`, pushed)
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestOnPush(t *testing.T) {
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer panel.Close()
+
+	var results []PushResult
+	s := newTestServer(WithOnPush(func(result PushResult) {
+		results = append(results, result)
+	}))
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, results)
+
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	require.Len(t, results, 1)
+	assert.Equal(t, []TrafficPushEntry{{UserID: 1, U: 1, D: 2}}, results[0].Entries)
+	assert.Empty(t, s.StatsMap)
+
+	// Failed pushes do not invoke the callback
+	panel.Close()
+	s.LogTraffic("1", 1, 2)
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, results, 1)
+}
+
+func TestCumulativePush(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithPushMode(PushModeCumulative))
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2}]`, pushed)
+	assert.Empty(t, s.StatsMap)
+
+	// Only users with new traffic are pushed, with their totals
+	s.LogTraffic("1", 10, 20)
+	s.LogTraffic("2", 3, 4)
+	pushed = ""
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	var entries []TrafficPushEntry
+	require.NoError(t, json.Unmarshal([]byte(pushed), &entries))
+	assert.ElementsMatch(t, []TrafficPushEntry{{UserID: 1, U: 11, D: 22}, {UserID: 2, U: 3, D: 4}}, entries)
+
+	pushed = ""
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, "", pushed)
+
+	s = newTestServer(WithPushMode(PushModeCumulative), WithUserProvider(testUserProvider{}), WithUnknownUserPolicy(UnknownUserBucket, -1))
+	assert.Error(t, s.Validate())
+}
+
+func TestActiveOnline(t *testing.T) {
+	s := newTestServer()
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("2", true)
+	s.LogTraffic("1", 1, 1)
+	s.LogTraffic("3", 1, 1)
+	s.LogTraffic("4", 0, 0)
+	s.lastTraffic["5"] = time.Now().Add(-2 * time.Minute)
+
+	assert.Equal(t, map[string]int{"1": 2, "3": 1}, s.activeUsers(time.Now(), time.Minute))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online?mode=active&window=5m", nil))
+	assert.Equal(t, `{"1":2,"3":1,"5":1}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online?mode=active&window=2h", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online", nil))
+	assert.Equal(t, `{"1":2,"2":1}`, rec.Body.String())
+
+	// Old entries are pruned unless the user is still online
+	s.lastTraffic["1"] = time.Now().Add(-2 * time.Hour)
+	s.lastTraffic["5"] = time.Now().Add(-2 * time.Hour)
+	s.pruneLastTraffic(time.Now())
+	assert.Contains(t, s.lastTraffic, "1")
+	assert.Contains(t, s.lastTraffic, "3")
+	assert.NotContains(t, s.lastTraffic, "5")
+}
+
+func TestOnlineClientInfo(t *testing.T) {
+	s := newTestServer(WithClientInfo())
+	s.LogOnlineState("1", true)
+	s.LogClientInfo("1", "hysteria/2.4.0 sni=example.com")
+	s.LogOnlineState("2", true)
+	// Offline users are ignored
+	s.LogClientInfo("3", "hysteria/2.4.0")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online?detail=true", nil))
+	assert.Equal(t, `{"1":{"sessions":1,"client":"hysteria/2.4.0 sni=example.com"},"2":{"sessions":1}}`, rec.Body.String())
+
+	s.LogOnlineState("1", false)
+	assert.NotContains(t, s.clientInfo, "1")
+
+	// Disabled by default
+	s = newTestServer()
+	s.LogOnlineState("1", true)
+	s.LogClientInfo("1", "hysteria/2.4.0")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online?detail=true", nil))
+	assert.Equal(t, `{"1":{"sessions":1}}`, rec.Body.String())
+}
+
+func TestReapIdle(t *testing.T) {
+	var kicked []string
+	s := newTestServer(WithOnKick(func(id, reason string) {
+		kicked = append(kicked, id+":"+reason)
+	}))
+	s.idleTimeout = time.Minute
+	now := time.Now()
+	s.LogOnlineState("1", true)
+	s.LogOnlineState("2", true)
+	s.LogOnlineState("3", true)
+	s.LogTraffic("1", 1, 1)
+	s.LogTraffic("2", 1, 1)
+	s.LogTraffic("4", 1, 1)
+	s.lastTraffic["1"] = now.Add(-2 * time.Minute)
+	s.lastTraffic["4"] = now.Add(-2 * time.Minute)
+
+	s.reapIdle(now)
+	// 3 has never sent traffic, 4 is not online
+	assert.Equal(t, []string{"1:idle"}, kicked)
+	assert.Equal(t, map[string]int{"2": 1, "3": 1}, s.OnlineMap)
+	assert.Contains(t, s.KickMap, "1")
+
+	assert.True(t, s.NewKick("2"))
+	assert.Equal(t, []string{"1:idle", "2:auth"}, kicked)
+
+	// 4 comes back online after the idle timeout and is not reaped right away
+	s.LogOnlineState("4", true)
+	s.reapIdle(time.Now())
+	assert.Equal(t, []string{"1:idle", "2:auth"}, kicked)
+	assert.Contains(t, s.OnlineMap, "4")
+}
+
+func TestReapIdleAfterGraceReconnect(t *testing.T) {
+	var kicked []string
+	s := newTestServer(WithReconnectGrace(time.Hour), WithOnKick(func(id, reason string) {
+		kicked = append(kicked, id)
+	}))
+	s.idleTimeout = time.Minute
+	s.LogOnlineState("1", true)
+	s.LogTraffic("1", 1, 1)
+	s.LogOnlineState("1", false)
+	s.lastTraffic["1"] = time.Now().Add(-2 * time.Minute)
+
+	// Reconnecting within the grace period reuses the slot and restarts the idle clock
+	s.LogOnlineState("1", true)
+	s.reapIdle(time.Now())
+	assert.Empty(t, kicked)
+	assert.Equal(t, map[string]int{"1": 1}, s.OnlineMap)
+}
+
+func TestClearDuringPush(t *testing.T) {
+	received := make(chan string, 1)
+	release := make(chan struct{})
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- string(b)
+		<-release
+	}))
+	defer panel.Close()
+
+	s := newTestServer()
+	s.LogTraffic("1", 10, 10)
+	pushed := make(chan error)
+	go func() { pushed <- s.PushTrafficToV2RaySocks(panel.URL) }()
+	assert.Equal(t, `[{"uid":1,"u":10,"d":10}]`, <-received)
+
+	// Traffic logged while the push is in flight is returned by the clear, and the
+	// clear waits for the push instead of returning the pushed traffic a second time
+	s.LogTraffic("1", 5, 5)
+	cleared := make(chan string)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic?clear=true", nil))
+		cleared <- rec.Body.String()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-pushed)
+	assert.Equal(t, `{"1":{"tx":5,"rx":5}}`, <-cleared)
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestConsumeDuringPush(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer panel.Close()
+
+	s := newTestServer()
+	s.LogTraffic("1", 10, 10)
+	pushed := make(chan error)
+	go func() { pushed <- s.PushTrafficToV2RaySocks(panel.URL) }()
+	<-received
+
+	// The consume waits for the push, so it only returns traffic the panel has not received,
+	// and the push does not deduct from traffic logged after the consume
+	s.LogTraffic("1", 5, 5)
+	consumed := make(chan TrafficStats)
+	go func() {
+		tx, rx, _ := s.ReadAndResetUser("1")
+		consumed <- TrafficStats{Tx: tx, Rx: rx}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-pushed)
+	assert.Equal(t, TrafficStats{Tx: 5, Rx: 5}, <-consumed)
+	s.LogTraffic("1", 3, 3)
+	assert.Equal(t, trafficStatsEntry{Tx: 3, Rx: 3}, *s.StatsMap["1"])
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newTestServer(WithRequestTimeout(time.Second))
+	s.LogTraffic("1", 1, 2)
+
+	// A request whose context is already done must not clear the stats
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/traffic?clear=true", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Len(t, s.StatsMap, 1)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/traffic?clear=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestThresholds(t *testing.T) {
+	var alerts []string
+	s := newTestServer(
+		WithSystemInfo(func() (SystemInfo, error) {
+			return SystemInfo{CpuPercent: 95, MemPercent: 50, DiskPercent: 91}, nil
+		}),
+		WithThresholds(Thresholds{CPU: 90, Mem: 80}, func(metric string, value float64) {
+			alerts = append(alerts, fmt.Sprint(metric, "=", value))
+		}),
+	)
+
+	// The panel is unreachable, but the thresholds are still checked
+	assert.Error(t, s.PushSystemStatus("http://127.0.0.1:0"))
+	assert.Equal(t, []string{"cpu=95"}, alerts)
+}
+
+func TestSystemStatusDisabled(t *testing.T) {
+	reads := 0
+	s := newTestServer(
+		WithSystemStatus(false),
+		WithSystemStatusURL("http://127.0.0.1:0"),
+		WithLogger(&testLogger{}),
+		WithSystemInfo(func() (SystemInfo, error) {
+			reads++
+			return SystemInfo{}, nil
+		}),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		s.PushSystemStatusInterval("http://127.0.0.1:0", time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("PushSystemStatusInterval did not return")
+	}
+	assert.ErrorIs(t, s.PushSystemStatus("http://127.0.0.1:0"), errSystemStatusDisabled)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/system/flush", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 0, reads)
+}
+
+func TestStaleMetrics(t *testing.T) {
+	logger := &testLogger{}
+	uptimes := []uint64{1, 1, 1, 2, 2, 2, 2}
+	reads := 0
+	s := newTestServer(
+		WithLogger(logger),
+		WithStaleMetricsDetection(3, true),
+		WithSystemInfo(func() (SystemInfo, error) {
+			uptime := uptimes[min(reads, len(uptimes)-1)]
+			reads++
+			return SystemInfo{CpuPercent: 10, Uptime: uptime}, nil
+		}),
+	)
+
+	s.collectSystemStatus()
+	s.collectSystemStatus()
+	assert.Empty(t, logger.lines)
+	// The third identical sample is reported, and the refreshed read that differs is used instead
+	assert.Equal(t, uint64(2), s.collectSystemStatus().Uptime)
+	require.Len(t, logger.lines, 1)
+	assert.Contains(t, logger.lines[0], "连续 3 次")
+
+	// The refreshed read starts a new streak; when the refresh is identical too the sample is kept
+	s.collectSystemStatus()
+	assert.Equal(t, uint64(2), s.collectSystemStatus().Uptime)
+	assert.Len(t, logger.lines, 3)
+}
+
+func TestCollectSystemStatusDoesNotBlockTraffic(t *testing.T) {
+	sampling := make(chan struct{})
+	release := make(chan struct{})
+	s := newTestServer(WithSystemInfo(func() (SystemInfo, error) {
+		close(sampling)
+		<-release
+		return SystemInfo{}, nil
+	}))
+	done := make(chan struct{})
+	go func() {
+		s.collectSystemStatus()
+		close(done)
+	}()
+
+	<-sampling
+	// Traffic is recorded while a slow sample is in progress
+	assert.True(t, s.LogTraffic("1", 1, 1))
+	close(release)
+	<-done
+}
+
+func TestPartialSystemStatus(t *testing.T) {
+	var body string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := io.ReadAll(r.Body)
+		body = string(bs)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(
+		WithLogger(&testLogger{}),
+		WithSystemInfo(func() (SystemInfo, error) {
+			return SystemInfo{CpuPercent: 12, MemPercent: 34, Failed: []string{MetricDisk}}, fmt.Errorf("获取磁盘使用率失败: boom ")
+		}),
+	)
+
+	// The metrics that succeeded are still pushed
+	require.NoError(t, s.PushSystemStatus(panel.URL))
+	var status SystemStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, float64(12), status.CpuPercent)
+	assert.Equal(t, float64(34), status.MemPercent)
+	// A failed metric is not reported as 0%
+	assert.Equal(t, "", status.Disk)
+	assert.Equal(t, []string{MetricDisk}, status.Failed)
+	assert.Equal(t, "获取磁盘使用率失败: boom", status.Errors)
+}
@@ -0,0 +1,108 @@
+package trafficlogger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultInfluxDBMeasurement = "hysteria_traffic"
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxDBTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// InfluxDBSink 以 InfluxDB line protocol 写入流量数据，每个用户一行：
+//
+//	hysteria_traffic,uid=42 tx=1024i,rx=2048i 1700000000000000000
+type InfluxDBSink struct {
+	Client *http.Client
+	// URL 为完整的写入地址，例如 http://127.0.0.1:8086/api/v2/write?org=my-org&bucket=my-bucket
+	URL string
+	// Token 不为空时以 "Authorization: Token <Token>" 的形式发送
+	Token string
+	// Measurement 为空时使用 hysteria_traffic
+	Measurement string
+	// Tags 附加到每一行的标签，例如节点名
+	Tags map[string]string
+	// Now 获取写入数据点的时间戳，为 nil 时使用 time.Now
+	Now func() time.Time
+}
+
+func (k *InfluxDBSink) Push(ctx context.Context, entries []TrafficPushEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	now := time.Now
+	if k.Now != nil {
+		now = k.Now
+	}
+	body := k.encode(entries, now())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if k.Token != "" {
+		req.Header.Set("Authorization", "Token "+k.Token)
+	}
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// InfluxDB 写入成功时返回 204
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New("InfluxDB write failed with status code: " + resp.Status + " " + string(msg))
+	}
+	return nil
+}
+
+func (k *InfluxDBSink) encode(entries []TrafficPushEntry, t time.Time) []byte {
+	measurement := k.Measurement
+	if measurement == "" {
+		measurement = defaultInfluxDBMeasurement
+	}
+	var tags strings.Builder
+	keys := make([]string, 0, len(k.Tags))
+	for key := range k.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags.WriteByte(',')
+		tags.WriteString(influxDBTagEscaper.Replace(key))
+		tags.WriteByte('=')
+		tags.WriteString(influxDBTagEscaper.Replace(k.Tags[key]))
+	}
+	prefix := influxDBMeasurementEscaper.Replace(measurement) + tags.String()
+	ts := strconv.FormatInt(t.UnixNano(), 10)
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.WriteString(prefix)
+		buf.WriteString(",uid=")
+		buf.WriteString(strconv.FormatInt(e.UserID, 10))
+		buf.WriteString(" tx=")
+		buf.WriteString(strconv.FormatInt(clampInt64(e.U), 10))
+		buf.WriteString("i,rx=")
+		buf.WriteString(strconv.FormatInt(clampInt64(e.D), 10))
+		buf.WriteString("i ")
+		buf.WriteString(ts)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,76 @@
+package trafficlogger
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// kickEvent 等待通知的踢出事件，未设置 OnKickBatch 时 ids 只有一个用户
+type kickEvent struct {
+	ids    []string
+	reason string
+}
+
+// kickQueue 异步调用 OnKick 回调的有界队列，回调中的网络请求等耗时操作不会阻塞踢出用户的调用方
+type kickQueue struct {
+	ch chan kickEvent
+	// mu 保护 pending，并保证入队与标记的原子性
+	mu sync.Mutex
+	// pending 已在队列中等待通知的用户 ID，同一用户重复踢出时合并为一次通知
+	pending map[string]bool
+	// dropped 因队列已满而丢弃的通知数
+	dropped atomic.Uint64
+}
+
+func newKickQueue(size int) *kickQueue {
+	return &kickQueue{
+		ch:      make(chan kickEvent, size),
+		pending: make(map[string]bool),
+	}
+}
+
+// enqueue 将踢出事件加入队列。已在队列中等待的用户不再重复通知，保留先入队的原因，
+// 所有用户都已在队列中时直接返回；队列已满时丢弃并返回 false
+func (q *kickQueue) enqueue(e kickEvent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := make([]string, 0, len(e.ids))
+	for _, id := range e.ids {
+		if !q.pending[id] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return true
+	}
+	select {
+	case q.ch <- kickEvent{ids: ids, reason: e.reason}:
+		for _, id := range ids {
+			q.pending[id] = true
+		}
+		return true
+	default:
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+// runKickQueue 依次取出踢出事件并调用踢出回调，Drain 后退出。
+// 设置了 WithKickConcurrency 时启动相应数量的 runKickQueue 并发通知
+func (s *trafficStatsServerImpl) runKickQueue() {
+	q := s.kickQueue
+	for {
+		select {
+		case e := <-q.ch:
+			q.mu.Lock()
+			for _, id := range e.ids {
+				delete(q.pending, id)
+			}
+			q.mu.Unlock()
+			s.deliverKick(e)
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package trafficlogger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKickQueue(t *testing.T) {
+	block := make(chan struct{})
+	notified := make(chan string, 10)
+	s := newTestServer(WithKickQueue(2), WithLogger(&testLogger{}), WithOnKick(func(id, reason string) {
+		<-block
+		notified <- id
+	}))
+	defer func() { _ = s.Drain(context.Background()) }()
+
+	// The worker takes "1" and blocks in the callback, the kicks below only fill the queue
+	s.NewKick("1")
+	assert.Eventually(t, func() bool { return len(s.kickQueue.ch) == 0 }, time.Second, time.Millisecond)
+	s.NewKick("2")
+	s.NewKick("2")
+	s.NewKick("3")
+	s.NewKick("4")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Contains(t, rec.Body.String(), `"kick_queue_depth":2,"kick_notifications_dropped":1`)
+
+	close(block)
+	for _, want := range []string{"1", "2", "3"} {
+		assert.Equal(t, want, <-notified)
+	}
+}
+
+func TestKickBatch(t *testing.T) {
+	var batches []string
+	s := newTestServer(WithOnKickBatch(func(ids []string, reason string) {
+		batches = append(batches, reason+":"+strings.Join(ids, ","))
+	}))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/kick", strings.NewReader(`["1","2","3"]`)))
+	s.NewKick("4")
+	assert.Equal(t, []string{KickReasonAPI + ":1,2,3", KickReasonAuth + ":4"}, batches)
+}
+
+func TestKickConcurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	done := make(chan struct{}, 10)
+	s := newTestServer(WithKickQueue(10), WithKickConcurrency(2), WithOnKick(func(id, reason string) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+		done <- struct{}{}
+	}))
+	defer func() { _ = s.Drain(context.Background()) }()
+
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		s.NewKick(id)
+	}
+	for i := 0; i < 6; i++ {
+		<-done
+	}
+	assert.Equal(t, int32(2), peak.Load())
+}
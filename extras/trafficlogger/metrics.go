@@ -0,0 +1,168 @@
+package trafficlogger
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricPaths 统计请求指标时使用原路径作为 path 标签的接口，其余路径统一记为 metricOtherPath，
+// 避免扫描等随机路径使标签数量无限增长
+var metricPaths = map[string]bool{
+	"/traffic": true, "/traffic/top": true, "/traffic/user": true, "/traffic/user/consume": true,
+	"/traffic/lifetime": true, "/traffic/pause": true, "/traffic/resume": true, "/traffic/flush": true,
+	"/traffic/group": true, "/system/flush": true, "/kick": true, "/kick/group": true, "/disconnect": true,
+	"/online": true, "/online/duration": true, "/ingest": true, "/fleet": true, "/users": true,
+	"/users/ids": true, "/users/limits": true, "/users/live": true, "/healthz": true, "/selftest": true, "/auth/status": true,
+	"/auth/etag": true, "/auth/reload": true, "/metrics": true,
+}
+
+const (
+	metricIndexPath = "index"
+	metricOtherPath = "other"
+)
+
+// latencyBuckets 请求耗时直方图的上界（秒）
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeKey 请求计数的标签
+type routeKey struct {
+	path   string
+	status int
+}
+
+// latencyHistogram 单个接口的请求耗时直方图，counts[i] 为耗时不超过 latencyBuckets[i] 的请求数（非累计）
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// routeMetrics 按接口统计的请求数、错误数和耗时，通过 GET /metrics 以 Prometheus 文本格式提供
+type routeMetrics struct {
+	mu        sync.Mutex
+	requests  map[routeKey]uint64
+	errors    map[string]uint64
+	latencies map[string]*latencyHistogram
+}
+
+func newRouteMetrics() *routeMetrics {
+	return &routeMetrics{
+		requests:  make(map[routeKey]uint64),
+		errors:    make(map[string]uint64),
+		latencies: make(map[string]*latencyHistogram),
+	}
+}
+
+// observe 记录一次请求，状态码不小于 400 的请求计为错误
+func (m *routeMetrics) observe(path string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[routeKey{path, status}]++
+	if status >= http.StatusBadRequest {
+		m.errors[path]++
+	}
+	h, ok := m.latencies[path]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[path] = h
+	}
+	sec := elapsed.Seconds()
+	for i, le := range latencyBuckets {
+		if sec <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += sec
+}
+
+// write 以 Prometheus 文本格式写出所有指标，标签按路径和状态码排序
+func (m *routeMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]routeKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].status < keys[j].status
+	})
+	fmt.Fprintln(w, "# HELP hysteria_stats_api_requests_total Requests handled by the traffic stats API.")
+	fmt.Fprintln(w, "# TYPE hysteria_stats_api_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "hysteria_stats_api_requests_total{path=%q,status=\"%d\"} %d\n", k.path, k.status, m.requests[k])
+	}
+
+	paths := make([]string, 0, len(m.latencies))
+	for p := range m.latencies {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	fmt.Fprintln(w, "# HELP hysteria_stats_api_request_errors_total Requests to the traffic stats API answered with a status of 400 or above.")
+	fmt.Fprintln(w, "# TYPE hysteria_stats_api_request_errors_total counter")
+	for _, p := range paths {
+		fmt.Fprintf(w, "hysteria_stats_api_request_errors_total{path=%q} %d\n", p, m.errors[p])
+	}
+	fmt.Fprintln(w, "# HELP hysteria_stats_api_request_duration_seconds Latency of traffic stats API requests.")
+	fmt.Fprintln(w, "# TYPE hysteria_stats_api_request_duration_seconds histogram")
+	for _, p := range paths {
+		h := m.latencies[p]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "hysteria_stats_api_request_duration_seconds_bucket{path=%q,le=%q} %d\n",
+				p, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "hysteria_stats_api_request_duration_seconds_bucket{path=%q,le=\"+Inf\"} %d\n", p, h.count)
+		fmt.Fprintf(w, "hysteria_stats_api_request_duration_seconds_sum{path=%q} %s\n", p, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "hysteria_stats_api_request_duration_seconds_count{path=%q} %d\n", p, h.count)
+	}
+}
+
+// statusRecorder 记录处理函数写出的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// metricPath 返回请求在指标中的 path 标签
+func (s *trafficStatsServerImpl) metricPath(r *http.Request) string {
+	if s.isIndexPath(r.URL.Path) {
+		return metricIndexPath
+	}
+	if metricPaths[r.URL.Path] {
+		return r.URL.Path
+	}
+	return metricOtherPath
+}
+
+// getMetrics 处理 GET /metrics
+func (s *trafficStatsServerImpl) getMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.routeMetrics.write(w)
+}
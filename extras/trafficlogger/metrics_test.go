@@ -0,0 +1,34 @@
+package trafficlogger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteMetrics(t *testing.T) {
+	s := newTestServer(WithSecret("secret"), WithLogger(&testLogger{}))
+	do := func(method, target, secret string) {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", secret)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do(http.MethodGet, "/online", "secret")
+	do(http.MethodGet, "/online", "secret")
+	do(http.MethodGet, "/online", "wrong")
+	do(http.MethodGet, "/wp-login.php", "secret")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "secret")
+	s.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	assert.Contains(t, body, `hysteria_stats_api_requests_total{path="/online",status="200"} 2`)
+	assert.Contains(t, body, `hysteria_stats_api_requests_total{path="/online",status="401"} 1`)
+	assert.Contains(t, body, `hysteria_stats_api_requests_total{path="other",status="404"} 1`)
+	assert.Contains(t, body, `hysteria_stats_api_request_errors_total{path="/online"} 1`)
+	assert.Contains(t, body, `hysteria_stats_api_request_duration_seconds_bucket{path="/online",le="+Inf"} 3`)
+	assert.Contains(t, body, `hysteria_stats_api_request_duration_seconds_count{path="other"} 1`)
+}
@@ -0,0 +1,511 @@
+package trafficlogger
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/apernet/hysteria/extras/v2/utils"
+)
+
+// Option 用于配置 TrafficStatsServer 的可选参数
+type Option func(*trafficStatsServerImpl)
+
+// WithSecret 设置 HTTP 接口的访问密钥，为空时不校验。
+// 请求需在 Authorization 请求头中直接携带密钥本身（不加 Bearer 等前缀），例如 "Authorization: mysecret"；
+// 值首尾的空白和一对引号会被去除，以兼容脚本中多出的换行或引号
+func WithSecret(secret string) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.Secret = secret
+	}
+}
+
+// WithMaxConcurrentRequests 限制 /traffic、/online 等耗时 GET 接口的最大并发数，
+// 超出限制的请求返回 429。n <= 0 表示不限制。
+func WithMaxConcurrentRequests(n int) Option {
+	return func(s *trafficStatsServerImpl) {
+		if n > 0 {
+			s.requestSem = make(chan struct{}, n)
+		} else {
+			s.requestSem = nil
+		}
+	}
+}
+
+// WithUserProvider 设置用户列表来源，用于 /users 等需要用户信息的接口
+func WithUserProvider(p UserProvider) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.userProvider = p
+	}
+}
+
+// WithTrafficPushURL 设置流量提交地址，供自检时进行空提交测试
+func WithTrafficPushURL(url string) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.trafficPushURL = url
+	}
+}
+
+// WithSystemStatus 设置是否启用系统状态监控。关闭时不调用 gopsutil 读取 CPU、内存等信息，
+// PushSystemStatusInterval 直接返回而不启动定时任务，PushSystemStatus 和 POST /system/flush 返回错误，
+// 适用于只需要提交流量、/proc 读取缓慢或受限的精简容器。默认启用。
+func WithSystemStatus(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.systemStatusDisabled = !enabled
+	}
+}
+
+// WithSystemStatusURL 设置系统状态提交地址，供 POST /system/flush 立即提交一次系统状态，未设置时该接口返回 503
+func WithSystemStatusURL(url string) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.systemStatusURL = url
+	}
+}
+
+// WithTrafficSink 注册一个额外的流量提交目标，每次提交面板的同时也会提交到该目标。
+// required 为 true 时，只有该目标也提交成功才会清除已提交的流量；
+// 为 false 时提交失败只记录日志，不影响清除；可选目标在所有必需目标之后提交，只收到必需目标已接受的用户，
+// 必需目标整体失败时本次不提交给可选目标，避免重试时收到重复数据。
+func WithTrafficSink(sink TrafficSink, required bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.sinks = append(s.sinks, registeredSink{sink: sink, required: required})
+	}
+}
+
+// WithJitter 设置定时提交间隔的随机浮动比例（0~1）。
+// 首次提交会额外随机延迟最多 interval*fraction，之后每次间隔在 ±fraction 内浮动，
+// 避免大量节点同时重启后在同一时刻请求面板。
+func WithJitter(fraction float64) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.jitter = fraction
+	}
+}
+
+// WithKickTTL 设置踢出名单的保留时间。用户被加入踢出名单后，
+// 若超过 ttl 仍未产生流量（即未被踢出），该记录会被清理。ttl <= 0 表示永不过期。
+func WithKickTTL(ttl time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.kickTTL = ttl
+	}
+}
+
+// WithSecurityHeaders 控制是否在所有响应中附加安全相关的响应头
+// （X-Content-Type-Options、X-Frame-Options、Content-Security-Policy 等），默认开启。
+func WithSecurityHeaders(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		if enabled {
+			s.securityHeaders = defaultSecurityHeaders
+		} else {
+			s.securityHeaders = nil
+		}
+	}
+}
+
+// WithPushMode 设置向面板提交增量（PushModeDelta，默认）还是累计值（PushModeCumulative）。
+// 累计模式下只提交有新流量的用户，会话时长仍为增量
+func WithPushMode(mode PushMode) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.pushMode = mode
+	}
+}
+
+// WithGranularity 设置提交流量的计量粒度（字节）：提交时每个用户的上传、下载流量向下取整到 bytes 的整数倍，
+// 不足的部分保留到下一次提交，长期来看不会丢失流量。不足一个粒度的用户本次不提交；
+// 被踢出的用户最后一次提交时按字节提交剩余流量。不能与 PushModeCumulative 同时使用。为 0 时按字节提交（默认）。
+func WithGranularity(bytes uint64) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.granularity = bytes
+	}
+}
+
+// WithMaxEntryValue 限制单次提交中每个用户上传、下载流量的最大值（字节），适用于对单条记录数值有上限的面板。
+// 超出的部分保留到之后的提交中，一个用户的大量流量分多次提交，不会使整批提交失败。
+// 同时设置 WithGranularity 时先限制再取整。不能与 PushModeCumulative 同时使用。为 0 时不限制（默认）。
+func WithMaxEntryValue(bytes uint64) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.maxEntryValue = bytes
+	}
+}
+
+// WithNumberFormat 设置向面板提交流量时数值字段的编码方式，默认为 NumberFormatInt64。
+func WithNumberFormat(format NumberFormat) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.numberFormat = format
+	}
+}
+
+// WithIDPrefix 设置向面板提交流量和系统状态时使用的用户 ID 前缀（如 "cluster1:"），
+// 用于多集群共用一个面板的场景。本地记录的用户 ID 不受影响，默认不加前缀。
+func WithIDPrefix(prefix string) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.idPrefix = prefix
+	}
+}
+
+// WithNodeName 设置节点名称，附加到每次提交的系统状态（node 字段）和流量（X-Node 请求头）中，
+// 用于多个节点提交到同一地址时区分来源。名称应由运维指定并保持稳定，不随主机名变化。默认不附加。
+func WithNodeName(name string) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.nodeName = name
+	}
+}
+
+// WithSlowPushThreshold 设置慢提交的阈值，单次流量提交耗时超过该值时记录警告日志，
+// 日志中包含提交的用户数和数据大小。为 0 时不记录。
+func WithSlowPushThreshold(threshold time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.slowPushThreshold = threshold
+	}
+}
+
+// WithPercentPrecision 设置提交系统状态时 CPU、内存、磁盘使用率保留的小数位数，默认为 0（取整）。
+func WithPercentPrecision(precision int) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.percentPrecision = precision
+	}
+}
+
+// WithCPUWarmup 设置 CPU 使用率的预热时间：构造后不足 d 时提交系统状态会先等待到期，
+// 使启动后立即提交的 CPU 使用率也覆盖至少 d 的采样区间。默认为 0，不等待；
+// 构造时的预采样已能保证按周期提交时首个值的准确性。
+func WithCPUWarmup(d time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.cpuWarmup = d
+	}
+}
+
+// WithConnectionCounts 在提交的系统状态中附带已建立的 TCP 连接数和 UDP 套接字数，每 interval 重新采样一次，
+// 期间的提交使用上一次的值。枚举系统所有连接的开销较大，interval 应明显长于提交间隔。为 0 时不统计（默认）。
+func WithConnectionCounts(interval time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.connCountInterval = interval
+	}
+}
+
+// WithRequestTimeout 设置单个请求的处理时限，到期后请求的 context 被取消，耗时的接口（如 GET /traffic）
+// 在客户端断开或超时后放弃处理，不会在无法返回数据的情况下清除流量。为 0 时不限制（默认）。
+// 连接级别的读写超时由 http.Server 设置。
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.requestTimeout = timeout
+	}
+}
+
+// WithTrustedProxies 设置受信任的反向代理网段。只有直接连接的对端在这些网段内时，
+// 才从 X-Forwarded-For 中取客户端地址用于日志等，否则使用连接的地址，避免客户端伪造来源。默认不信任任何代理。
+func WithTrustedProxies(proxies utils.TrustedProxies) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.trustedProxies = proxies
+	}
+}
+
+// WithReconnectGrace 设置会话断开后在线名额的保留时间。
+// 保留期内同一用户重新连接会复用该名额，避免网络不稳定的移动端频繁重连时在线数抖动。为 0 时立即释放。
+func WithReconnectGrace(grace time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.reconnectGrace = grace
+	}
+}
+
+// WithReplayProtection 要求修改类请求（POST /kick 等非 GET 请求）在 Secret 之外携带 X-Nonce 和 X-Timestamp（Unix 秒）请求头：
+// 时间戳与服务器时间相差超过 window，或 nonce 在 window 内已出现过的请求以 401 拒绝，防止截获的请求被重放。
+// nonce 最长 128 字节，客户端应为每个请求生成随机值。为 0 时不启用（默认）。
+func WithReplayProtection(window time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		if window > 0 {
+			s.replayGuard = newReplayGuard(window)
+		} else {
+			s.replayGuard = nil
+		}
+	}
+}
+
+// WithQuerySignature 允许 GET 请求通过查询参数 expires 和 sig 认证，
+// sig 为以 Secret 为密钥对 path 和去掉 sig 后按键排序的全部查询参数计算的 HMAC-SHA256（十六进制），
+// 可用 SignQuery 生成；签名后追加或修改参数（例如 clear=true）会导致认证失败。
+// 适用于无法设置请求头的工具，Authorization 请求头仍为主要认证方式。默认关闭。
+func WithQuerySignature(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.querySignature = enabled
+	}
+}
+
+// WithQuerySignatureMaxAge 设置查询签名有效期的上限：expires 比当前时间晚超过 d 的签名会被拒绝，
+// 避免泄露的长期签名 URL 一直可用。为 0 时使用默认的 24 小时。
+func WithQuerySignatureMaxAge(d time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		if d == 0 {
+			d = defaultQuerySignatureMaxAge
+		}
+		s.querySignatureMaxAge = d
+	}
+}
+
+// WithPushAck 要求面板确认每次流量提交：提交内容中附带随机 nonce，
+// 只有面板在响应中原样返回该 nonce 时才清除已提交的流量，否则保留到下次重试。默认关闭。
+func WithPushAck(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.requireAck = enabled
+	}
+}
+
+// WithPartialAccept 允许面板只接受部分用户的流量：面板在提交响应中返回 {"accepted": [uid, ...]} 时，
+// 只清除列出的用户的流量，其余保留到下次重试。响应中没有 accepted 字段时仍按整体成功处理。默认关闭。
+func WithPartialAccept(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.partialAccept = enabled
+	}
+}
+
+// WithPushLimits 在每条流量提交中附带用户列表中该用户的限速（st）和设备数限制（dt），
+// 便于面板核对节点实际使用的限制与面板配置是否一致。需要同时配置 WithUserProvider，
+// 已不在用户列表中的用户不附带。默认不附带，以减小提交数据。
+func WithPushLimits(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.pushLimits = enabled
+	}
+}
+
+// WithSortedPush 提交前将流量数据按用户 ID 升序排序，使相同数据的请求体保持一致，便于面板记录和比对。
+// 默认按 map 的遍历顺序提交，没有排序开销。
+func WithSortedPush(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.sortPushEntries = enabled
+	}
+}
+
+// WithMaxPushSize 设置单次向面板提交的请求体的最大字节数（WithPushAck 时包含 nonce 和节点名），
+// 超过时自动拆分为多批依次提交并记录日志，
+// 避免用户很多的节点因单次提交过大被面板拒绝而一直重试。某一批失败时，已提交的批次照常清除，
+// 其余保留到下次重试。为 0 时不限制（默认）。
+func WithMaxPushSize(size int) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.maxPushSize = size
+	}
+}
+
+// WithUnknownUserPolicy 设置提交流量时对已不在用户列表中的用户（如统计周期中被删除的用户）的处理方式，
+// 避免严格的面板因为一个未知 ID 拒绝整批数据。policy 为 UnknownUserBucket 时，
+// 这些流量合并到 bucketID 下提交。需要同时配置 WithUserProvider，默认原样提交。
+func WithUnknownUserPolicy(policy UnknownUserPolicy, bucketID int64) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.unknownUserPolicy = policy
+		s.unknownUserBucket = bucketID
+	}
+}
+
+// WithPushConcurrency 设置提交流量时最多同时向多少个目标（面板及 WithTrafficSink 添加的目标）提交，
+// 缩短有多个目标时单次提交的耗时，同时避免对外建立过多连接。不大于 1 时依次提交（默认）。
+// 必需目标和可选目标分两批提交，限制分别作用于每一批。
+// 只有所有必需目标都提交成功才会清除已提交的流量。
+func WithPushConcurrency(n int) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.pushConcurrency = n
+	}
+}
+
+// WithSessionTime 启用用户会话时长统计，通过 GET /online/duration 查询。
+// mode 决定同时在线的多个会话如何计时；push 为 true 时，每次流量提交附带各用户自上次提交以来的会话时长，
+// 只附带给本次有流量提交的用户，其余用户的会话时长留到下次提交；已离线的用户全部提交后不再出现在 /online/duration 中。默认不统计。
+func WithSessionTime(mode SessionTimeMode, push bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.sessionTimeMode = mode
+		s.pushSessionTime = push && mode != SessionTimeOff
+	}
+}
+
+// WithIdleTimeout 启用空闲踢出：在线用户超过 timeout 没有产生流量时会被加入踢出名单并清除在线状态，
+// 以 KickReasonIdle 触发 OnKick 回调，用于释放空闲连接占用的设备名额。为 0 时不启用（默认）。
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithKickMarksOffline 设置踢出用户（POST /kick、POST /kick/group、NewKick）时是否立即清除其在线状态。
+// 默认不清除：OnlineMap 只反映实际的连接断开，被踢出的用户在下一次 LogTraffic 断开连接前仍计为在线，
+// 空闲的连接可能要很久才会断开。启用后 /online 立即不再包含被踢出的用户，但连接实际断开时的
+// LogOnlineState 仍会减少在线数，若用户在此之前已重新连接，新会话会被提前计为离线。
+// POST /disconnect 和空闲踢出总是立即清除在线状态，不受此选项影响。
+func WithKickMarksOffline(enabled bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.kickMarksOffline = enabled
+	}
+}
+
+// WithOnKick 设置用户被加入踢出名单时的回调，参数为用户 ID 和踢出原因（KickReason* 常量）。
+// 回调在不持有内部锁的情况下同步调用，不应长时间阻塞。
+func WithOnKick(fn func(id, reason string)) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.onKick = fn
+	}
+}
+
+// WithOnPush 设置每次成功提交流量后的回调，参数包含面板已接受的流量数据和提交耗时，
+// 用于更新本地账本、发送事件等与下游系统的集成。回调在已提交的流量扣除之后调用，不影响提交结果；
+// 调用期间持有提交锁，回调按提交顺序执行，不应长时间阻塞，也不能调用 ReadAndResetUser 等需要提交锁的方法。没有数据需要提交时不调用。
+func WithOnPush(fn func(result PushResult)) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.onPush = fn
+	}
+}
+
+// WithOnKickBatch 设置批量踢出回调：一次操作（如 POST /kick、按分组踢出、空闲检测）踢出的所有用户
+// 合并为一次回调，参数为用户 ID 列表和踢出原因，避免大量踢出时逐个通知造成通知风暴。
+// 设置后不再调用 WithOnKick 的回调，二者不能同时使用。回调在不持有内部锁的情况下同步调用，不应长时间阻塞。
+func WithOnKickBatch(fn func(ids []string, reason string)) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.onKickBatch = fn
+	}
+}
+
+// WithKickConcurrency 限制同时执行的踢出回调数为 n：同步调用时超出的调用方等待，
+// 启用 WithKickQueue 时以 n 个并发通知取出队列中的事件。不大于 0 时不限制，通知队列只按顺序通知（默认）。
+func WithKickConcurrency(n int) Option {
+	return func(s *trafficStatsServerImpl) {
+		if n > 0 {
+			s.kickSem = make(chan struct{}, n)
+		} else {
+			s.kickSem = nil
+		}
+	}
+}
+
+// WithThresholds 设置系统状态的告警阈值，PushSystemStatus 采集后对超过阈值的每项指标调用 fn，
+// 参数为指标名称（Metric* 常量）和使用率，用于在面板提交失败时也能及时在本地告警。
+// 回调在不持有内部锁的情况下同步调用，不应长时间阻塞。fn 为 nil 时不检查（默认）。
+func WithThresholds(t Thresholds, fn func(metric string, value float64)) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.thresholds = t
+		s.onThreshold = fn
+	}
+}
+
+// WithKickQueue 通过容量为 size 的队列异步调用 OnKick 回调，适用于回调中需要通知面板等耗时操作的场景。
+// 同一用户在队列中等待时重复踢出只通知一次；队列已满时丢弃通知并记录日志。
+// 队列长度和丢弃数在 /healthz 中返回。为 0 时同步调用（默认）。
+func WithKickQueue(size int) Option {
+	return func(s *trafficStatsServerImpl) {
+		if size > 0 {
+			s.kickQueue = newKickQueue(size)
+		} else {
+			s.kickQueue = nil
+		}
+	}
+}
+
+// WithFleetCollector 启用汇总模式：通过 POST /ingest 接收其他节点上报的 FleetReport（系统状态和流量），
+// 按节点 ID 保存最近一次上报，并通过 GET /fleet 提供所有节点的汇总视图。
+// 最多保存 maxNodes 个节点，超出时淘汰最久未上报的节点。maxNodes 不大于 0 时不启用（默认）。
+func WithFleetCollector(maxNodes int) Option {
+	return func(s *trafficStatsServerImpl) {
+		if maxNodes > 0 {
+			s.fleet = newFleetStore(maxNodes)
+		} else {
+			s.fleet = nil
+		}
+	}
+}
+
+// WithBacklogPolicy 设置面板持续无法提交时对积压流量的处理策略，避免长时间故障时内存无限增长。
+// 未设置 MaxFailures 和 MaxDuration 时连续失败 10 次触发；BacklogCap 未设置 MaxUsers 时保留 10000 个用户。
+// 默认一直保留（BacklogRetain）。积压情况可通过 GET /healthz 查看。
+func WithBacklogPolicy(p BacklogPolicy) Option {
+	return func(s *trafficStatsServerImpl) {
+		if p.MaxFailures <= 0 && p.MaxDuration <= 0 {
+			p.MaxFailures = defaultBacklogMaxFailures
+		}
+		if p.Mode == BacklogCap && p.MaxUsers <= 0 {
+			p.MaxUsers = defaultBacklogMaxUsers
+		}
+		s.backlog = p
+	}
+}
+
+// WithClientInfo 记录在线用户的客户端信息（内核在认证时提供的 User-Agent、SNI 等），
+// 通过 GET /online?detail=true 返回。默认不记录。
+func WithClientInfo() Option {
+	return func(s *trafficStatsServerImpl) {
+		s.clientInfo = make(map[string]string)
+	}
+}
+
+// WithIndexPath 设置返回首页的路径，为空时保持默认的 "/"。emptyAsIndex 为 true 时空路径也返回首页，
+// 适用于反向代理去掉挂载前缀后把挂载根路径转发为空路径的情况
+func WithIndexPath(path string, emptyAsIndex bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		if path != "" {
+			s.indexPath = path
+		}
+		s.emptyPathAsIndex = emptyAsIndex
+	}
+}
+
+// WithHTTPClient 设置提交系统状态、流量和自检时使用的 HTTP 客户端（超时、代理、TLS 等），
+// 为 nil 时使用 http.DefaultClient。通过 WithTrafficSink 注册的目标使用各自的客户端。
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.httpClient = client
+	}
+}
+
+// WithClock 设置获取当前时间的函数，用于在测试中控制踢出过期、空闲检测、会话时长、
+// 提交退避（包括 HTTP 日期格式的 Retry-After）、进程运行时长、CPU 预热和接口耗时等依赖时间的逻辑。
+// 为 nil 时使用 time.Now。定时任务的触发间隔不受影响。
+func WithClock(now func() time.Time) Option {
+	return func(s *trafficStatsServerImpl) {
+		if now == nil {
+			now = time.Now
+		}
+		s.now = now
+	}
+}
+
+// WithLogger 设置运行日志的输出。默认输出到标准输出，相同的错误每分钟只输出一次；
+// 为 nil 时恢复默认。
+func WithLogger(logger Logger) Option {
+	return func(s *trafficStatsServerImpl) {
+		if logger == nil {
+			logger = loopLog
+		}
+		s.logger = logger
+	}
+}
+
+// WithSystemInfo 设置系统状态的采集函数，PushSystemStatus 提交的 CPU、内存、磁盘等信息由它提供。
+// 为 nil 时使用 ReadSystemInfo。
+func WithSystemInfo(read func() (SystemInfo, error)) Option {
+	return func(s *trafficStatsServerImpl) {
+		if read == nil {
+			read = ReadSystemInfo
+		}
+		s.sysInfo = read
+	}
+}
+
+// WithStaleMetricsDetection 在系统状态连续 threshold 次采集结果完全相同（包括系统运行时间）时记录警告日志，
+// 用于区分节点确实稳定和指标来源（gopsutil 在部分平台上会缓存读数）已失效。refresh 为 true 时告警后立即重新采集一次，
+// 结果不同则提交新的结果。同一段连续相同只告警一次。threshold 不大于 0 时不检测（默认）。
+func WithStaleMetricsDetection(threshold int, refresh bool) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.staleMetrics.threshold = threshold
+		s.staleMetrics.refresh = refresh
+	}
+}
+
+// WithTrafficBuffer 启用流量缓冲：LogTraffic 只锁定按用户 ID 分片的缓冲，每隔 interval 合并到 StatsMap，
+// 用于高吞吐节点减少全局锁争用。读取流量的接口和流量提交会先合并所有分片，不会读到过期数据。
+// 未通过 WithTrafficShards 设置分片数时使用 64 个分片。为 0 时不定期合并，也不会自动启用分片。
+func WithTrafficBuffer(interval time.Duration) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.bufferInterval = interval
+	}
+}
+
+// WithTrafficShards 将 LogTraffic 的写入按用户 ID 分到 n 个各自加锁的分片，写入吞吐随核数增加；
+// 读取时遍历所有分片合并。不大于 1 时不分片（默认），所有写入争用同一把锁；同时启用了 WithTrafficBuffer 时使用 64 个分片。
+// 可与 WithTrafficBuffer 同时使用以定期合并，否则分片中的数据在下次读取时合并，两者的先后顺序不影响结果。
+func WithTrafficShards(n int) Option {
+	return func(s *trafficStatsServerImpl) {
+		s.trafficShards = n
+	}
+}
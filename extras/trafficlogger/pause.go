@@ -0,0 +1,39 @@
+package trafficlogger
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Pause 暂停流量统计：LogTraffic 仍然返回踢出等处理结果，但不再累计流量，
+// 用于维护期间产生的流量不计入用户账单
+func (s *trafficStatsServerImpl) Pause() {
+	s.paused.Store(true)
+}
+
+// Resume 恢复流量统计
+func (s *trafficStatsServerImpl) Resume() {
+	s.paused.Store(false)
+}
+
+// Paused 返回流量统计是否已暂停
+func (s *trafficStatsServerImpl) Paused() bool {
+	return s.paused.Load()
+}
+
+// pauseResponse /traffic/pause 和 /traffic/resume 的返回结果
+type pauseResponse struct {
+	Paused bool `json:"paused"`
+}
+
+// setPaused 处理 POST /traffic/pause 和 POST /traffic/resume
+func (s *trafficStatsServerImpl) setPaused(w http.ResponseWriter, paused bool) {
+	s.paused.Store(paused)
+	jb, err := json.Marshal(pauseResponse{Paused: paused})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
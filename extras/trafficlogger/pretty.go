@@ -0,0 +1,50 @@
+package trafficlogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// prettyResponseWriter 缓存处理函数的响应，结束后将 JSON 响应缩进后再写出，用于 ?pretty=true
+type prettyResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (p *prettyResponseWriter) WriteHeader(status int) {
+	p.status = status
+}
+
+func (p *prettyResponseWriter) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+// flush 写出缓存的响应，非 JSON 或无法解析的响应原样写出
+func (p *prettyResponseWriter) flush() {
+	body := p.buf.Bytes()
+	if strings.HasPrefix(p.Header().Get("Content-Type"), "application/json") {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			indented.WriteByte('\n')
+			body = indented.Bytes()
+			p.Header().Del("Content-Length")
+		}
+	}
+	if p.status != 0 {
+		p.ResponseWriter.WriteHeader(p.status)
+	}
+	_, _ = p.ResponseWriter.Write(body)
+}
+
+// wantPretty 判断 GET 请求是否要求缩进的 JSON 响应
+func wantPretty(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
@@ -0,0 +1,30 @@
+package trafficlogger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/apernet/hysteria/extras/v2/auth"
+)
+
+// Reloader 由支持立即重新加载的用户列表来源实现，用于 POST /auth/reload 接口
+type Reloader interface {
+	Reload(ctx context.Context) (auth.ReloadResult, error)
+}
+
+// reloadUsers 立即重新加载用户列表，返回重新加载后的用户数和是否有变化；拉取失败时返回 502
+func (s *trafficStatsServerImpl) reloadUsers(w http.ResponseWriter, r *http.Request, rl Reloader) {
+	result, err := rl.Reload(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
@@ -0,0 +1,60 @@
+package trafficlogger
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	nonceHeader     = "X-Nonce"
+	timestampHeader = "X-Timestamp"
+
+	// maxNonceLength nonce 的最大长度，限制记录 nonce 占用的内存
+	maxNonceLength = 128
+)
+
+// replayGuard 记录时间窗口内出现过的 nonce，拒绝时间戳过期或 nonce 重复的请求
+type replayGuard struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // nonce -> 请求的时间戳
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{window: window, nonces: make(map[string]time.Time)}
+}
+
+// check 校验请求的 X-Nonce 和 X-Timestamp（Unix 秒），通过时记录该 nonce
+func (g *replayGuard) check(r *http.Request, now time.Time) error {
+	nonce := r.Header.Get(nonceHeader)
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return errors.New("missing or invalid " + nonceHeader)
+	}
+	sec, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid " + timestampHeader)
+	}
+	ts := time.Unix(sec, 0)
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return errors.New("stale timestamp")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// 时间戳超出窗口的 nonce 已无法通过上面的检查，不必再记录
+	for n, t := range g.nonces {
+		if t.Before(now.Add(-g.window)) {
+			delete(g.nonces, n)
+		}
+	}
+	if _, ok := g.nonces[nonce]; ok {
+		return errors.New("replayed nonce")
+	}
+	g.nonces[nonce] = ts
+	return nil
+}
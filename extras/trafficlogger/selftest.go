@@ -0,0 +1,94 @@
+package trafficlogger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SelfTester 由支持自检的用户列表来源实现
+type SelfTester interface {
+	SelfTest(ctx context.Context) error
+}
+
+// SelfTestStep 自检中单个步骤的结果
+type SelfTestStep struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type selfTestResponse struct {
+	OK    bool           `json:"ok"`
+	Steps []SelfTestStep `json:"steps"`
+}
+
+// SelfTest 依次检查用户列表拉取和流量提交接口，返回所有失败步骤的错误
+func (s *trafficStatsServerImpl) SelfTest(ctx context.Context) error {
+	var errs []error
+	for _, step := range s.selfTest(ctx) {
+		if !step.OK {
+			errs = append(errs, fmt.Errorf("%s: %s", step.Name, step.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *trafficStatsServerImpl) selfTest(ctx context.Context) []SelfTestStep {
+	var steps []SelfTestStep
+	if tester, ok := s.userProvider.(SelfTester); ok {
+		steps = append(steps, runSelfTestStep(s.now, "user_list", func() error {
+			return tester.SelfTest(ctx)
+		}))
+	}
+	if s.trafficPushURL != "" {
+		steps = append(steps, runSelfTestStep(s.now, "traffic_push", func() error {
+			return dryRunPush(ctx, s.httpClient, s.trafficPushURL)
+		}))
+	}
+	return steps
+}
+
+func runSelfTestStep(now func() time.Time, name string, f func() error) SelfTestStep {
+	start := now()
+	err := f()
+	step := SelfTestStep{
+		Name:      name,
+		OK:        err == nil,
+		LatencyMs: now().Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	return step
+}
+
+// dryRunPush 向流量提交接口提交一个空列表，检查接口是否可用且不会产生任何计费
+func dryRunPush(ctx context.Context, client *http.Client, url string) error {
+	sink := &HTTPJSONSink{Client: client, URL: url}
+	return sink.Push(ctx, []TrafficPushEntry{})
+}
+
+func (s *trafficStatsServerImpl) getSelfTest(w http.ResponseWriter, r *http.Request) {
+	steps := s.selfTest(r.Context())
+	result := selfTestResponse{OK: true, Steps: steps}
+	for _, step := range steps {
+		if !step.OK {
+			result.OK = false
+		}
+	}
+	jb, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !result.OK {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	_, _ = w.Write(jb)
+}
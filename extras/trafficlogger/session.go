@@ -0,0 +1,118 @@
+package trafficlogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SessionTimeMode 用户会话时长的统计方式
+type SessionTimeMode int
+
+const (
+	// SessionTimeOff 不统计会话时长（默认）
+	SessionTimeOff SessionTimeMode = iota
+	// SessionTimeConcurrent 累加每个会话的时长，同时在线的多个会话分别计时
+	SessionTimeConcurrent
+	// SessionTimeWallClock 只统计至少有一个会话在线的时间，同时在线的多个会话不重复计时
+	SessionTimeWallClock
+)
+
+// ParseSessionTimeMode 解析配置中的会话时长统计方式，空字符串视为不统计
+func ParseSessionTimeMode(s string) (SessionTimeMode, error) {
+	switch s {
+	case "", "off":
+		return SessionTimeOff, nil
+	case "concurrent":
+		return SessionTimeConcurrent, nil
+	case "wallclock":
+		return SessionTimeWallClock, nil
+	default:
+		return 0, fmt.Errorf("unsupported session time mode %q", s)
+	}
+}
+
+// sessionWeight 返回有 n 个会话在线时会话时长的计时倍数
+func (m SessionTimeMode) sessionWeight(n int) time.Duration {
+	switch {
+	case n <= 0 || m == SessionTimeOff:
+		return 0
+	case m == SessionTimeWallClock:
+		return 1
+	default:
+		return time.Duration(n)
+	}
+}
+
+// accountSessionTime 将上次在线会话数变化以来的时长计入累计会话时长，
+// 应在修改 OnlineMap 之前调用，调用方需持有 Mutex
+func (s *trafficStatsServerImpl) accountSessionTime(id string, now time.Time) {
+	if s.sessionTimeMode == SessionTimeOff {
+		return
+	}
+	// sessionTime 中始终包含 sessionSince 中的所有用户
+	s.sessionTime[id] = s.sessionTimeAt(id, now)
+	s.sessionSince[id] = now
+}
+
+// sessionTimeAt 返回截至 now 的累计会话时长，包含仍在进行中的会话，调用方需持有读锁
+func (s *trafficStatsServerImpl) sessionTimeAt(id string, now time.Time) time.Duration {
+	d := s.sessionTime[id]
+	if since, ok := s.sessionSince[id]; ok {
+		d += now.Sub(since) * s.sessionTimeMode.sessionWeight(s.OnlineMap[id])
+	}
+	return d
+}
+
+// unpushedSessionTime 返回各用户尚未提交的会话时长，按整秒截断，余下部分留到下次提交
+func (s *trafficStatsServerImpl) unpushedSessionTime(now time.Time) map[string]time.Duration {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	unpushed := make(map[string]time.Duration)
+	for id := range s.sessionTime {
+		if d := (s.sessionTimeAt(id, now) - s.sessionPushed[id]).Truncate(time.Second); d > 0 {
+			unpushed[id] = d
+		}
+	}
+	return unpushed
+}
+
+// markSessionTimePushed 记录已成功提交的会话时长。已离线且会话时长已全部提交（剩余不足一秒）的用户不再保留，
+// 避免 sessionTime 和 sessionPushed 随历史用户无限增长
+func (s *trafficStatsServerImpl) markSessionTimePushed(pushed map[string]time.Duration) {
+	if len(pushed) == 0 {
+		return
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for id, d := range pushed {
+		s.sessionPushed[id] += d
+		if _, online := s.sessionSince[id]; !online && s.sessionTime[id]-s.sessionPushed[id] < time.Second {
+			delete(s.sessionTime, id)
+			delete(s.sessionPushed, id)
+		}
+	}
+}
+
+// getSessionDuration 返回各用户节点启动以来的累计会话时长（秒），
+// 提交会话时长时已离线且全部提交的用户不再列出
+func (s *trafficStatsServerImpl) getSessionDuration(w http.ResponseWriter, r *http.Request) {
+	now := s.now()
+	s.Mutex.RLock()
+	durations := make(map[string]int64, len(s.sessionTime))
+	for id := range s.sessionTime {
+		durations[id] = int64(s.sessionTimeAt(id, now) / time.Second)
+	}
+	s.Mutex.RUnlock()
+
+	jb, err := json.Marshal(durations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
@@ -0,0 +1,74 @@
+package trafficlogger
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTime(t *testing.T) {
+	tests := []struct {
+		mode SessionTimeMode
+		want time.Duration
+	}{
+		{SessionTimeConcurrent, 30 * time.Second},
+		{SessionTimeWallClock, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		s := newTestServer(WithSessionTime(tt.mode, false))
+		s.LogOnlineState("1", true)
+		s.LogOnlineState("1", true)
+		// Two sessions for 10s, then one session for 10s
+		s.sessionSince["1"] = s.sessionSince["1"].Add(-10 * time.Second)
+		s.LogOnlineState("1", false)
+		s.sessionSince["1"] = s.sessionSince["1"].Add(-10 * time.Second)
+		s.LogOnlineState("1", false)
+
+		assert.Empty(t, s.sessionSince)
+		assert.InDelta(t, tt.want, s.sessionTime["1"], float64(100*time.Millisecond))
+		assert.Equal(t, int64(tt.want/time.Second), int64(s.sessionTimeAt("1", time.Now().Add(time.Hour))/time.Second))
+	}
+
+	s := newTestServer()
+	s.LogOnlineState("1", true)
+	assert.Empty(t, s.sessionTime)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online/duration", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPushSessionTime(t *testing.T) {
+	var pushed string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithSessionTime(SessionTimeWallClock, true))
+	s.LogOnlineState("1", true)
+	s.sessionSince["1"] = time.Now().Add(-90*time.Second - 500*time.Millisecond)
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2,"session_seconds":90}]`, pushed)
+
+	// Only the remainder is pushed next time
+	s.sessionSince["1"] = s.sessionSince["1"].Add(-10 * time.Second)
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2,"session_seconds":10}]`, pushed)
+
+	// Offline users are forgotten once all of their session time has been pushed
+	s.sessionSince["1"] = s.sessionSince["1"].Add(-5 * time.Second)
+	s.LogOnlineState("1", false)
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2,"session_seconds":5}]`, pushed)
+	assert.Empty(t, s.sessionTime)
+	assert.Empty(t, s.sessionPushed)
+}
@@ -0,0 +1,41 @@
+package trafficlogger
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Drain 停止所有定时任务（流量和系统状态提交、缓冲合并、踢出过期、空闲检测），
+// 然后向 WithTrafficPushURL 设置的地址提交剩余的流量。正在进行的定时提交会先完成。
+// 提交失败且积压策略为 BacklogSpill 时，剩余流量写入溢出文件，下次启动后随流量一并提交。
+// 可重复调用，之后的调用只会再提交一次
+func (s *trafficStatsServerImpl) Drain(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.done) })
+	if s.trafficPushURL == "" {
+		s.flushTrafficBuffer()
+		return nil
+	}
+	_, err := s.pushTraffic(ctx, s.trafficPushURL)
+	if err != nil && s.backlog.Mode == BacklogSpill {
+		s.pushLock.Lock()
+		if spillErr := s.spillBacklog(s.now()); spillErr != nil {
+			err = errors.Join(err, spillErr)
+		}
+		s.pushLock.Unlock()
+	}
+	return err
+}
+
+// Shutdown 按顺序停止用户列表更新和流量统计：先关闭 users（不再接受用户列表更新），
+// 再调用 tss.Drain 提交剩余的流量。users 或 tss 为 nil 时跳过对应步骤，返回所有步骤的错误
+func Shutdown(ctx context.Context, users io.Closer, tss TrafficStatsServer) error {
+	var errs []error
+	if users != nil {
+		errs = append(errs, users.Close())
+	}
+	if tss != nil {
+		errs = append(errs, tss.Drain(ctx))
+	}
+	return errors.Join(errs...)
+}
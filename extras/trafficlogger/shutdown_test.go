@@ -0,0 +1,39 @@
+package trafficlogger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCloser struct{ closed *[]string }
+
+func (c testCloser) Close() error {
+	*c.closed = append(*c.closed, "users")
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	var order []string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "push")
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithTrafficPushURL(panel.URL))
+	s.LogTraffic("1", 1, 2)
+	assert.NoError(t, Shutdown(context.Background(), testCloser{&order}, s))
+	assert.Equal(t, []string{"users", "push"}, order)
+	assert.Empty(t, s.StatsMap)
+
+	select {
+	case <-s.done:
+	default:
+		t.Fatal("interval loops were not stopped")
+	}
+	// Draining again only pushes what is left
+	assert.NoError(t, s.Drain(context.Background()))
+}
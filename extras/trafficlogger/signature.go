@@ -0,0 +1,80 @@
+package trafficlogger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureParam = "sig"
+	expiresParam   = "expires"
+	// defaultQuerySignatureMaxAge 查询签名有效期的默认上限
+	defaultQuerySignatureMaxAge = 24 * time.Hour
+)
+
+// signPath 计算 path 与规范化查询参数的 HMAC-SHA256 签名。查询参数去掉 sig 后按键排序编码，
+// 其中已包含 expires，因此追加或修改任何参数（例如 clear=true）都会使签名失效
+func signPath(secret, path string, query url.Values) string {
+	q := url.Values{}
+	for k, v := range query {
+		if k != signatureParam {
+			q[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "\n" + q.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignQuery 为不方便设置请求头的工具生成 GET 请求的签名参数，query 为请求需要携带的其他参数，可为 nil。
+// 返回包含 query、expires 和 sig 的查询字符串，在 expires 之后失效；签名覆盖全部参数，使用时不能再增删或修改。
+// expires 比验证时的当前时间晚于 WithQuerySignatureMaxAge 的签名会被拒绝
+func SignQuery(secret, path string, query url.Values, expires time.Time) string {
+	v := url.Values{}
+	for k, vs := range query {
+		v[k] = append([]string(nil), vs...)
+	}
+	v.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	v.Set(signatureParam, signPath(secret, path, v))
+	return v.Encode()
+}
+
+// validAuthorization 校验 Authorization 请求头中的密钥。比较前去除首尾空白和一对成对的单引号或双引号，
+// 避免 shell 脚本中多出的换行或引号导致正确的密钥被拒绝；比较使用常量时间
+func (s *trafficStatsServerImpl) validAuthorization(r *http.Request) bool {
+	got := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(got) >= 2 && (got[0] == '"' || got[0] == '\'') && got[len(got)-1] == got[0] {
+		got = strings.TrimSpace(got[1 : len(got)-1])
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(s.Secret)) == 1
+}
+
+// validQuerySignature 校验 GET 请求的查询签名，作为 Authorization 请求头之外的备选认证方式。
+// expires 已过期或比当前时间晚于 querySignatureMaxAge 时拒绝，避免签发几乎永久有效的签名
+func (s *trafficStatsServerImpl) validQuerySignature(r *http.Request) bool {
+	if !s.querySignature || r.Method != http.MethodGet {
+		return false
+	}
+	q := r.URL.Query()
+	sig, err := hex.DecodeString(q.Get(signatureParam))
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(q.Get(expiresParam), 10, 64)
+	if err != nil {
+		return false
+	}
+	now := s.now()
+	if now.Unix() > expires || expires > now.Add(s.querySignatureMaxAge).Unix() {
+		return false
+	}
+	expected, _ := hex.DecodeString(signPath(s.Secret, r.URL.Path, q))
+	return hmac.Equal(sig, expected)
+}
@@ -0,0 +1,118 @@
+package trafficlogger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuerySignature(t *testing.T) {
+	s := newTestServer(WithSecret("secret"), WithQuerySignature(true))
+	get := func(target string) int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+
+	valid := SignQuery("secret", "/online", nil, time.Now().Add(time.Minute))
+	assert.Equal(t, http.StatusOK, get("/online?"+valid))
+	// Signature is bound to the path
+	assert.Equal(t, http.StatusUnauthorized, get("/traffic?"+valid))
+	// Expired
+	assert.Equal(t, http.StatusUnauthorized, get("/online?"+SignQuery("secret", "/online", nil, time.Now().Add(-time.Minute))))
+	// Wrong secret
+	assert.Equal(t, http.StatusUnauthorized, get("/online?"+SignQuery("other", "/online", nil, time.Now().Add(time.Minute))))
+
+	// Tampering with the signed query is rejected
+	traffic := SignQuery("secret", "/traffic", nil, time.Now().Add(time.Minute))
+	assert.Equal(t, http.StatusOK, get("/traffic?"+traffic))
+	assert.Equal(t, http.StatusUnauthorized, get("/traffic?"+traffic+"&clear=true"))
+	assert.Equal(t, http.StatusUnauthorized, get("/traffic?clear=true&"+traffic))
+	// Parameters included when signing are accepted, and cannot be changed
+	signedClear := SignQuery("secret", "/traffic", url.Values{"clear": {"true"}}, time.Now().Add(time.Minute))
+	assert.Equal(t, http.StatusOK, get("/traffic?"+signedClear))
+	assert.Equal(t, http.StatusUnauthorized, get("/traffic?"+strings.Replace(signedClear, "clear=true", "clear=false", 1)))
+	assert.Equal(t, http.StatusUnauthorized, get("/traffic?"+signedClear+"&reset_online=true"))
+
+	s = newTestServer(WithSecret("secret"))
+	assert.Equal(t, http.StatusUnauthorized, get("/online?"+valid))
+}
+
+func TestQuerySignatureMaxAge(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestServer(WithSecret("secret"), WithQuerySignature(true), WithQuerySignatureMaxAge(time.Hour),
+		WithClock(func() time.Time { return now }))
+	get := func(expires time.Time) int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/online?"+SignQuery("secret", "/online", nil, expires), nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get(now.Add(time.Hour)))
+	// Signatures valid for longer than the maximum age are rejected
+	assert.Equal(t, http.StatusUnauthorized, get(now.Add(time.Hour+time.Second)))
+	assert.Equal(t, http.StatusUnauthorized, get(now.Add(100*365*24*time.Hour)))
+
+	// Zero keeps the default
+	s = newTestServer(WithSecret("secret"), WithQuerySignature(true), WithQuerySignatureMaxAge(0),
+		WithClock(func() time.Time { return now }))
+	assert.Equal(t, defaultQuerySignatureMaxAge, s.querySignatureMaxAge)
+	assert.Equal(t, http.StatusOK, get(now.Add(defaultQuerySignatureMaxAge)))
+	assert.Equal(t, http.StatusUnauthorized, get(now.Add(defaultQuerySignatureMaxAge+time.Minute)))
+}
+
+func TestAuthorizationTrim(t *testing.T) {
+	s := newTestServer(WithSecret("secret"), WithLogger(&testLogger{}))
+	get := func(auth string) int {
+		req := httptest.NewRequest(http.MethodGet, "/online", nil)
+		req.Header.Set("authorization", auth)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, auth := range []string{"secret", " secret\t", `"secret"`, `'secret'`, `" secret "`} {
+		assert.Equal(t, http.StatusOK, get(auth), auth)
+	}
+	for _, auth := range []string{"", "Secret", `"secret'`, "Bearer secret", `""secret""`} {
+		assert.Equal(t, http.StatusUnauthorized, get(auth), auth)
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestServer(WithSecret("secret"), WithReplayProtection(time.Minute), WithLogger(&testLogger{}),
+		WithClock(func() time.Time { return now }))
+	do := func(method, nonce string, ts time.Time) int {
+		req := httptest.NewRequest(method, "/kick", strings.NewReader(`["1"]`))
+		req.Header.Set("Authorization", "secret")
+		if nonce != "" {
+			req.Header.Set(nonceHeader, nonce)
+			req.Header.Set(timestampHeader, strconv.FormatInt(ts.Unix(), 10))
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "a", now))
+	// Replayed nonce
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "a", now))
+	// Missing headers
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "", now))
+	// Stale timestamp
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "b", now.Add(-2*time.Minute)))
+	// GET requests are not checked
+	assert.NotEqual(t, http.StatusUnauthorized, do(http.MethodGet, "", now))
+
+	// Nonces are forgotten once their timestamp leaves the window
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "c", now))
+	assert.Len(t, s.replayGuard.nonces, 1)
+}
@@ -0,0 +1,473 @@
+package trafficlogger
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TrafficSink 流量数据的提交目标
+type TrafficSink interface {
+	Push(ctx context.Context, entries []TrafficPushEntry) error
+}
+
+// registeredSink 已注册的提交目标。
+// required 为 true 时，只有该目标提交成功才会清除已提交的流量记录；
+// 否则提交失败只记录日志（尽力而为）。
+type registeredSink struct {
+	sink     TrafficSink
+	required bool
+}
+
+// NumberFormat 流量数值在 JSON 中的编码方式
+type NumberFormat int
+
+const (
+	// NumberFormatInt64 编码为有符号整数，超出 int64 范围的值会被截断为 math.MaxInt64（默认）
+	NumberFormatInt64 NumberFormat = iota
+	// NumberFormatUint64 编码为无符号整数
+	NumberFormatUint64
+	// NumberFormatString 编码为十进制字符串，适用于无法处理大整数的面板
+	NumberFormatString
+)
+
+// ParseNumberFormat 解析配置中的数值编码方式，空字符串视为 int64
+func ParseNumberFormat(s string) (NumberFormat, error) {
+	switch s {
+	case "", "int64":
+		return NumberFormatInt64, nil
+	case "uint64":
+		return NumberFormatUint64, nil
+	case "string":
+		return NumberFormatString, nil
+	default:
+		return 0, fmt.Errorf("unsupported number format %q", s)
+	}
+}
+
+// PushMode 向面板提交的流量数值的含义
+type PushMode int
+
+const (
+	// PushModeDelta 提交上次提交以来的增量，提交成功后清除（默认）
+	PushModeDelta PushMode = iota
+	// PushModeCumulative 提交节点启动以来的累计值，由面板自行计算增量。
+	// 节点重启后累计值从零开始，面板需要能处理计数回退
+	PushModeCumulative
+)
+
+// ParsePushMode 解析配置中的提交模式，空字符串视为 delta
+func ParsePushMode(s string) (PushMode, error) {
+	switch s {
+	case "", "delta":
+		return PushModeDelta, nil
+	case "cumulative":
+		return PushModeCumulative, nil
+	default:
+		return 0, fmt.Errorf("unsupported push mode %q", s)
+	}
+}
+
+// clampInt64 将 uint64 转换为 int64，溢出时截断为 math.MaxInt64，避免提交负数流量。
+// 截断发生在每个目标的编码过程中，日志由 logOverflowEntries 在每次提交时汇总记录
+func clampInt64(v uint64) int64 {
+	if v > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(v)
+}
+
+// pushUserID 返回提交时使用的用户 ID，设置了前缀时编码为 "前缀+ID" 形式的字符串
+func pushUserID(id int64, prefix string) any {
+	if prefix == "" {
+		return id
+	}
+	return prefix + strconv.FormatInt(id, 10)
+}
+
+// encodedEntry 按数值编码方式和用户 ID 前缀转换后的单个用户的流量数据
+type encodedEntry struct {
+	UserID         any    `json:"uid"`
+	U              any    `json:"u"`
+	D              any    `json:"d"`
+	SessionSeconds uint64 `json:"session_seconds,omitempty"`
+	SpeedLimit     *int   `json:"st,omitempty"`
+	DeviceLimit    *int   `json:"dt,omitempty"`
+}
+
+// newEncodedEntry 按指定的数值编码方式和用户 ID 前缀转换单个用户的流量数据
+func newEncodedEntry(e TrafficPushEntry, format NumberFormat, prefix string) encodedEntry {
+	out := encodedEntry{
+		UserID:         pushUserID(e.UserID, prefix),
+		SessionSeconds: e.SessionSeconds,
+		SpeedLimit:     e.SpeedLimit,
+		DeviceLimit:    e.DeviceLimit,
+	}
+	switch format {
+	case NumberFormatUint64:
+		out.U, out.D = e.U, e.D
+	case NumberFormatString:
+		out.U, out.D = strconv.FormatUint(e.U, 10), strconv.FormatUint(e.D, 10)
+	default:
+		out.U, out.D = clampInt64(e.U), clampInt64(e.D)
+	}
+	return out
+}
+
+// encodeEntries 按指定的数值编码方式和用户 ID 前缀将流量数据编码为 JSON
+func encodeEntries(entries []TrafficPushEntry, format NumberFormat, prefix string) ([]byte, error) {
+	out := make([]encodedEntry, len(entries))
+	for i, e := range entries {
+		out[i] = newEncodedEntry(e, format, prefix)
+	}
+	return json.Marshal(out)
+}
+
+// defaultRetryAfter 面板返回 429 但未指定 Retry-After 时的退避时间
+const defaultRetryAfter = time.Minute
+
+// RateLimitedError 面板返回 429 时的错误，RetryAfter 为下次提交前需要等待的时间
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by panel, retry after %s", e.RetryAfter)
+}
+
+// parseRetryAfter 解析 Retry-After 响应头，支持秒数和 HTTP 日期两种格式，无法解析时返回 defaultRetryAfter
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return defaultRetryAfter
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return defaultRetryAfter
+}
+
+// HTTPJSONSink 将流量数据以 JSON 数组的形式 POST 到指定地址，即 v2raysocks 面板使用的格式
+type HTTPJSONSink struct {
+	Client *http.Client
+	URL    string
+	// NumberFormat 流量数值的编码方式，默认为 int64
+	NumberFormat NumberFormat
+	// IDPrefix 提交时附加到用户 ID 前的前缀（如 "cluster1:"），非空时 uid 以字符串形式提交
+	IDPrefix string
+	// Node 节点名称，非空时通过 X-Node 请求头提交，RequireAck 时同时包含在请求体的 node 字段中
+	Node string
+	// RequireAck 为 true 时以 {"nonce": ..., "data": [...]} 的形式提交，
+	// 并要求面板在响应中返回 {"ack": nonce}，未确认的提交视为失败，流量保留到下次重试
+	RequireAck bool
+	// PartialAccept 为 true 时解析面板响应中的 {"accepted": [uid, ...]}，
+	// 未列出的用户视为被拒绝并返回 *PartialAcceptError；响应中没有 accepted 字段时视为全部接受
+	PartialAccept bool
+	// MaxPayloadSize 单次提交的请求体（RequireAck 时包含 nonce 和 node 字段）的最大字节数，
+	// 超过时拆分为多批依次提交，为 0 时不限制。
+	// 某一批失败时，已提交的批次视为被接受，该批及之后的用户通过 *PartialAcceptError 返回
+	MaxPayloadSize int
+	// Logger 记录分批提交等日志，为 nil 时不记录
+	Logger Logger
+	// Now 获取当前时间，用于解析 HTTP 日期格式的 Retry-After，为 nil 时使用 time.Now
+	Now func() time.Time
+}
+
+// ackPushRequest 需要确认的提交请求
+type ackPushRequest struct {
+	Nonce string          `json:"nonce"`
+	Node  string          `json:"node,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// pushResponse 面板对提交的响应，Ack 用于 RequireAck，Accepted 用于 PartialAccept
+type pushResponse struct {
+	Ack      string            `json:"ack"`
+	Accepted []json.RawMessage `json:"accepted"`
+}
+
+// PartialAcceptError 面板只接受了部分用户的流量，Rejected 为未被接受的用户 ID。
+// 分批提交中途失败时 Err 为导致失败的错误
+type PartialAcceptError struct {
+	Rejected []int64
+	Err      error
+}
+
+func (e *PartialAcceptError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("traffic of %d users not accepted: %v", len(e.Rejected), e.Err)
+	}
+	return fmt.Sprintf("panel rejected traffic of %d users", len(e.Rejected))
+}
+
+func (e *PartialAcceptError) Unwrap() error {
+	return e.Err
+}
+
+// rejectedEntries 返回不在 accepted 中的用户 ID。accepted 中的 uid 可以是数字或字符串，
+// 按提交时的编码（含前缀）比较
+func rejectedEntries(entries []TrafficPushEntry, accepted []json.RawMessage, prefix string) []int64 {
+	acceptedSet := make(map[string]bool, len(accepted))
+	for _, raw := range accepted {
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			acceptedSet[str] = true
+		} else {
+			acceptedSet[string(bytes.TrimSpace(raw))] = true
+		}
+	}
+	var rejected []int64
+	for _, e := range entries {
+		if !acceptedSet[fmt.Sprint(pushUserID(e.UserID, prefix))] {
+			rejected = append(rejected, e.UserID)
+		}
+	}
+	return rejected
+}
+
+// maxAckResponseSize 确认响应的最大读取长度
+const maxAckResponseSize = 64 << 10
+
+// nodeHeader 提交流量时携带节点名称的请求头
+const nodeHeader = "X-Node"
+
+// newNonce 生成随机的提交标识
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (k *HTTPJSONSink) Push(ctx context.Context, entries []TrafficPushEntry) error {
+	chunk, err := k.encode(entries)
+	if err != nil {
+		return err
+	}
+	if k.MaxPayloadSize > 0 && len(chunk.data) > k.MaxPayloadSize && len(entries) > 1 {
+		return k.pushChunked(ctx, entries, len(chunk.data))
+	}
+	return k.push(ctx, chunk)
+}
+
+// pushChunked 将超过 MaxPayloadSize 的数据拆分为多批依次提交。
+// 某一批失败后不再提交剩余批次，该批及之后的用户作为未被接受的用户返回
+func (k *HTTPJSONSink) pushChunked(ctx context.Context, entries []TrafficPushEntry, size int) error {
+	chunks, err := k.split(entries)
+	if err != nil {
+		return err
+	}
+	if k.Logger != nil {
+		k.Logger.Println(fmt.Sprintf("流量数据 %d 字节，超过单次提交上限 %d 字节，分 %d 批提交", size, k.MaxPayloadSize, len(chunks)))
+	}
+	var rejected []int64
+	for i, chunk := range chunks {
+		err := k.push(ctx, chunk)
+		var pe *PartialAcceptError
+		switch {
+		case err == nil:
+		case errors.As(err, &pe):
+			rejected = append(rejected, pe.Rejected...)
+		case i == 0:
+			return err
+		default:
+			for _, c := range chunks[i:] {
+				for _, e := range c.entries {
+					rejected = append(rejected, e.UserID)
+				}
+			}
+			return &PartialAcceptError{Rejected: rejected, Err: err}
+		}
+	}
+	if len(rejected) > 0 {
+		return &PartialAcceptError{Rejected: rejected}
+	}
+	return nil
+}
+
+// pushChunk 一次提交的数据及其编码后的完整请求体，RequireAck 时 nonce 为请求体中的提交标识
+type pushChunk struct {
+	entries []TrafficPushEntry
+	data    []byte
+	nonce   string
+}
+
+// encode 编码一次提交的完整请求体，RequireAck 时包含 nonce 和 node 字段
+func (k *HTTPJSONSink) encode(entries []TrafficPushEntry) (pushChunk, error) {
+	data, err := encodeEntries(entries, k.NumberFormat, k.IDPrefix)
+	if err != nil {
+		return pushChunk{}, err
+	}
+	chunk := pushChunk{entries: entries, data: data}
+	if k.RequireAck {
+		if chunk.nonce, err = newNonce(); err != nil {
+			return pushChunk{}, err
+		}
+		if chunk.data, err = json.Marshal(ackPushRequest{Nonce: chunk.nonce, Node: k.Node, Data: data}); err != nil {
+			return pushChunk{}, err
+		}
+	}
+	return chunk, nil
+}
+
+// split 将数据二分拆分，直到每批的完整请求体不超过 MaxPayloadSize；单个用户超过上限时单独成批
+func (k *HTTPJSONSink) split(entries []TrafficPushEntry) ([]pushChunk, error) {
+	chunk, err := k.encode(entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk.data) <= k.MaxPayloadSize || len(entries) == 1 {
+		return []pushChunk{chunk}, nil
+	}
+	mid := len(entries) / 2
+	left, err := k.split(entries[:mid])
+	if err != nil {
+		return nil, err
+	}
+	right, err := k.split(entries[mid:])
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// push 提交一批已编码的数据
+func (k *HTTPJSONSink) push(ctx context.Context, chunk pushChunk) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.URL, bytes.NewReader(chunk.data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.Node != "" {
+		req.Header.Set(nodeHeader, k.Node)
+	}
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		now := time.Now
+		if k.Now != nil {
+			now = k.Now
+		}
+		return &RateLimitedError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), now())}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("HTTP request failed with status code: " + resp.Status)
+	}
+	if !k.RequireAck && !k.PartialAccept {
+		return nil
+	}
+	var pr pushResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAckResponseSize)).Decode(&pr); err != nil {
+		if k.RequireAck {
+			return fmt.Errorf("invalid ack response: %w", err)
+		}
+		// 面板没有返回可解析的响应体，视为全部接受
+		return nil
+	}
+	if k.RequireAck && pr.Ack != chunk.nonce {
+		return fmt.Errorf("ack mismatch: sent %q, got %q", chunk.nonce, pr.Ack)
+	}
+	if k.PartialAccept && pr.Accepted != nil {
+		if rejected := rejectedEntries(chunk.entries, pr.Accepted, k.IDPrefix); len(rejected) > 0 {
+			return &PartialAcceptError{Rejected: rejected}
+		}
+	}
+	return nil
+}
+
+// partialRejected 判断提交错误是否仅由部分接受引起，是时返回所有被拒绝的用户 ID；
+// 任一必需目标完全失败时返回 false，按整体失败处理
+func partialRejected(err error) (map[int64]bool, bool) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	rejected := make(map[int64]bool)
+	for _, e := range errs {
+		var pe *PartialAcceptError
+		if !errors.As(e, &pe) {
+			return nil, false
+		}
+		for _, id := range pe.Rejected {
+			rejected[id] = true
+		}
+	}
+	return rejected, true
+}
+
+// pushToSinks 先向必需目标提交数据，再向可选目标提交必需目标已接受的部分：必需目标整体失败时数据留待下次重试，
+// 不提交给可选目标；部分接受时可选目标只收到未被拒绝的用户，避免重试时可选目标收到重复数据。
+// 每组内最多同时向 concurrency 个目标提交（不大于 1 时依次提交），返回必需目标的错误
+func pushToSinks(ctx context.Context, sinks []registeredSink, entries []TrafficPushEntry, concurrency int, logger Logger) error {
+	var required, optional []TrafficSink
+	for _, rs := range sinks {
+		if rs.required {
+			required = append(required, rs.sink)
+		} else {
+			optional = append(optional, rs.sink)
+		}
+	}
+	err := errors.Join(pushGroup(ctx, required, entries, concurrency)...)
+	accepted := entries
+	if err != nil {
+		rejected, ok := partialRejected(err)
+		if !ok {
+			return err
+		}
+		accepted = make([]TrafficPushEntry, 0, len(entries))
+		for _, e := range entries {
+			if !rejected[e.UserID] {
+				accepted = append(accepted, e)
+			}
+		}
+	}
+	if len(accepted) > 0 {
+		for _, e := range pushGroup(ctx, optional, accepted, concurrency) {
+			if e != nil {
+				logger.Println("流量信息提交失败（可选目标）:", e)
+			}
+		}
+	}
+	return err
+}
+
+// pushGroup 并发向一组目标提交相同的数据，最多同时提交 concurrency 个，按目标顺序返回各自的错误
+func pushGroup(ctx context.Context, sinks []TrafficSink, entries []TrafficPushEntry, concurrency int) []error {
+	errs := make([]error, len(sinks))
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, sink TrafficSink) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = sink.Push(ctx, entries)
+		}(i, sink)
+	}
+	wg.Wait()
+	return errs
+}
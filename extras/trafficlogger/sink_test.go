@@ -0,0 +1,360 @@
+package trafficlogger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeEntries(t *testing.T) {
+	entries := []TrafficPushEntry{
+		{UserID: 1, U: 100, D: 200},
+		{UserID: 2, U: math.MaxUint64, D: math.MaxInt64 + 1},
+	}
+	tests := []struct {
+		format NumberFormat
+		want   string
+	}{
+		{NumberFormatInt64, `[{"uid":1,"u":100,"d":200},{"uid":2,"u":9223372036854775807,"d":9223372036854775807}]`},
+		{NumberFormatUint64, `[{"uid":1,"u":100,"d":200},{"uid":2,"u":18446744073709551615,"d":9223372036854775808}]`},
+		{NumberFormatString, `[{"uid":1,"u":"100","d":"200"},{"uid":2,"u":"18446744073709551615","d":"9223372036854775808"}]`},
+	}
+	for _, tt := range tests {
+		jb, err := encodeEntries(entries, tt.format, "")
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, string(jb))
+	}
+
+	// Overflowing values are logged once per push through the injected logger
+	logger := &testLogger{}
+	newTestServer(WithLogger(logger)).logOverflowEntries(entries)
+	require.Len(t, logger.lines, 1)
+	assert.Contains(t, logger.lines[0], "1 个用户")
+}
+
+func TestParseNumberFormat(t *testing.T) {
+	f, err := ParseNumberFormat("")
+	assert.NoError(t, err)
+	assert.Equal(t, NumberFormatInt64, f)
+	f, err = ParseNumberFormat("string")
+	assert.NoError(t, err)
+	assert.Equal(t, NumberFormatString, f)
+	_, err = ParseNumberFormat("float")
+	assert.Error(t, err)
+}
+
+func TestEncodeEntriesIDPrefix(t *testing.T) {
+	jb, err := encodeEntries([]TrafficPushEntry{{UserID: 42, U: 1, D: 2}}, NumberFormatInt64, "cluster1:")
+	require.NoError(t, err)
+	assert.Equal(t, `[{"uid":"cluster1:42","u":1,"d":2}]`, string(jb))
+}
+
+func TestHTTPJSONSinkAck(t *testing.T) {
+	echo := true
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ackPushRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, `[{"uid":1,"u":1,"d":2}]`, string(req.Data))
+		ack := req.Nonce
+		if !echo {
+			ack = "stale"
+		}
+		_ = json.NewEncoder(w).Encode(pushResponse{Ack: ack})
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithPushAck(true))
+	s.LogTraffic("1", 1, 2)
+
+	// A wrong ack keeps the traffic for the next push
+	echo = false
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, s.StatsMap, 1)
+
+	echo = true
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestNodeName(t *testing.T) {
+	var node, body string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := io.ReadAll(r.Body)
+		node, body = r.Header.Get(nodeHeader), string(bs)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(
+		WithNodeName("hk-01"),
+		WithSystemInfo(func() (SystemInfo, error) { return SystemInfo{}, nil }),
+	)
+	s.LogTraffic("1", 1, 2)
+	require.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, "hk-01", node)
+	assert.Equal(t, `[{"uid":1,"u":1,"d":2}]`, body)
+
+	require.NoError(t, s.PushSystemStatus(panel.URL))
+	assert.Contains(t, body, `"node":"hk-01"`)
+}
+
+func TestPushPartialAccept(t *testing.T) {
+	var body string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithPartialAccept(true))
+	s.LogTraffic("1", 1, 2)
+	s.LogTraffic("2", 3, 4)
+
+	// Only the accepted user is cleared, the rejected one is kept for retry
+	body = `{"accepted":["1"]}`
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Len(t, s.StatsMap, 1)
+	assert.Contains(t, s.StatsMap, "2")
+
+	// No acceptance list falls back to all-or-nothing
+	body = `{}`
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+
+	// Without the flag the acceptance list is ignored
+	s = newTestServer()
+	s.LogTraffic("1", 1, 2)
+	s.LogTraffic("2", 3, 4)
+	body = `{"accepted":[1]}`
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestPushMaxSize(t *testing.T) {
+	var batches [][]TrafficPushEntry
+	failAfter := 0
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries []TrafficPushEntry
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&entries))
+		if failAfter > 0 && len(batches) >= failAfter {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		batches = append(batches, entries)
+	}))
+	defer panel.Close()
+
+	logger := &testLogger{}
+	s := newTestServer(WithMaxPushSize(60), WithLogger(logger))
+	for i := 1; i <= 4; i++ {
+		s.LogTraffic(strconv.Itoa(i), 1, 1)
+	}
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Greater(t, len(batches), 1)
+	for _, b := range batches {
+		jb, err := encodeEntries(b, NumberFormatInt64, "")
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(jb), 60)
+	}
+	assert.Empty(t, s.StatsMap)
+	assert.NotEmpty(t, logger.lines)
+
+	// A failing batch keeps its users and the remaining ones for the next push
+	batches = nil
+	failAfter = 1
+	for i := 1; i <= 4; i++ {
+		s.LogTraffic(strconv.Itoa(i), 1, 1)
+	}
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	require.Len(t, batches, 1)
+	assert.Len(t, s.StatsMap, 4-len(batches[0]))
+	for _, e := range batches[0] {
+		assert.NotContains(t, s.StatsMap, strconv.FormatInt(e.UserID, 10))
+	}
+}
+
+func TestPushMaxSizeWithAck(t *testing.T) {
+	const limit = 150
+	var sizes []int
+	users := 0
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sizes = append(sizes, len(b))
+		var req ackPushRequest
+		require.NoError(t, json.Unmarshal(b, &req))
+		var entries []TrafficPushEntry
+		require.NoError(t, json.Unmarshal(req.Data, &entries))
+		users += len(entries)
+		_ = json.NewEncoder(w).Encode(pushResponse{Ack: req.Nonce})
+	}))
+	defer panel.Close()
+
+	// The limit applies to the whole body including the nonce/node envelope,
+	// not just the data array inside it
+	s := newTestServer(WithMaxPushSize(limit), WithPushAck(true), WithNodeName("node-with-a-long-name"))
+	for i := 1; i <= 4; i++ {
+		s.LogTraffic(strconv.Itoa(i), 1, 1)
+	}
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Greater(t, len(sizes), 1)
+	for _, size := range sizes {
+		assert.True(t, size <= limit, "body of %d bytes exceeds the limit", size)
+	}
+	assert.Equal(t, 4, users)
+	assert.Empty(t, s.StatsMap)
+}
+
+func TestSortedPush(t *testing.T) {
+	var body string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer panel.Close()
+
+	s := newTestServer(WithSortedPush(true))
+	for _, id := range []string{"3", "10", "1", "2"} {
+		s.LogTraffic(id, 1, 1)
+	}
+	assert.NoError(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, `[{"uid":1,"u":1,"d":1},{"uid":2,"u":1,"d":1},{"uid":3,"u":1,"d":1},{"uid":10,"u":1,"d":1}]`, body)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, defaultRetryAfter, parseRetryAfter("", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, defaultRetryAfter, parseRetryAfter("soon", now))
+}
+
+func TestPushRateLimited(t *testing.T) {
+	requests := 0
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer panel.Close()
+
+	s := newTestServer()
+	s.LogTraffic("1", 1, 2)
+
+	var rl *RateLimitedError
+	err := s.PushTrafficToV2RaySocks(panel.URL)
+	require.ErrorAs(t, err, &rl)
+	assert.Equal(t, time.Hour, rl.RetryAfter)
+	assert.Len(t, s.StatsMap, 1)
+
+	// Backing off: no request reaches the panel
+	assert.Error(t, s.PushTrafficToV2RaySocks(panel.URL))
+	assert.Equal(t, 1, requests)
+	assert.Len(t, s.StatsMap, 1)
+}
+
+func TestPushRateLimitedHTTPDate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", now.Add(10*time.Minute).Format(http.TimeFormat))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer panel.Close()
+
+	// Retry-After as an HTTP date is resolved against the injected clock
+	s := newTestServer(WithClock(func() time.Time { return now }))
+	s.LogTraffic("1", 1, 2)
+
+	var rl *RateLimitedError
+	require.ErrorAs(t, s.PushTrafficToV2RaySocks(panel.URL), &rl)
+	assert.Equal(t, 10*time.Minute, rl.RetryAfter)
+	assert.Equal(t, now.Add(10*time.Minute), s.pushBackoffUntil)
+}
+
+type testSink struct {
+	mu      *sync.Mutex
+	running *int
+	peak    *int
+	err     error
+}
+
+func (k testSink) Push(ctx context.Context, entries []TrafficPushEntry) error {
+	k.mu.Lock()
+	*k.running++
+	*k.peak = max(*k.peak, *k.running)
+	k.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	k.mu.Lock()
+	*k.running--
+	k.mu.Unlock()
+	return k.err
+}
+
+func TestPushToSinksConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	sink := testSink{mu: &mu, running: &running, peak: &peak}
+	failing := sink
+	failing.err = errors.New("boom")
+
+	sinks := []registeredSink{
+		{sink: sink, required: true},
+		{sink: failing, required: false},
+		{sink: sink, required: true},
+		{sink: sink, required: false},
+		{sink: failing, required: true},
+	}
+	err := pushToSinks(context.Background(), sinks, nil, 2, loopLog)
+	assert.Equal(t, 2, peak)
+	assert.EqualError(t, err, "boom")
+
+	peak = 0
+	assert.Error(t, pushToSinks(context.Background(), sinks, nil, 0, loopLog))
+	assert.Equal(t, 1, peak)
+}
+
+type recordingSink struct {
+	mu     *sync.Mutex
+	pushed *[][]TrafficPushEntry
+	err    error
+}
+
+func (k recordingSink) Push(ctx context.Context, entries []TrafficPushEntry) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	*k.pushed = append(*k.pushed, entries)
+	return k.err
+}
+
+func TestPushToSinksOptionalAfterRequired(t *testing.T) {
+	var mu sync.Mutex
+	var required, optional [][]TrafficPushEntry
+	entries := []TrafficPushEntry{{UserID: 1, U: 1}, {UserID: 2, U: 2}, {UserID: 3, U: 3}}
+	run := func(err error) error {
+		required, optional = nil, nil
+		return pushToSinks(context.Background(), []registeredSink{
+			{sink: recordingSink{mu: &mu, pushed: &optional}, required: false},
+			{sink: recordingSink{mu: &mu, pushed: &required, err: err}, required: true},
+		}, entries, 2, loopLog)
+	}
+
+	assert.NoError(t, run(nil))
+	assert.Equal(t, [][]TrafficPushEntry{entries}, optional)
+
+	// Optional sinks only receive what the required sinks accepted
+	assert.Error(t, run(&PartialAcceptError{Rejected: []int64{2}}))
+	assert.Len(t, required, 1)
+	assert.Equal(t, [][]TrafficPushEntry{{entries[0], entries[2]}}, optional)
+
+	// Nothing is sent to optional sinks when the required push fails; it is retried later
+	assert.Error(t, run(errors.New("boom")))
+	assert.Len(t, optional, 0)
+}
@@ -0,0 +1,69 @@
+package trafficlogger
+
+import (
+	"fmt"
+	"sync"
+)
+
+// staleMetrics 检测系统状态是否连续多次完全相同。系统运行时间每次都会增加，
+// 连续相同通常说明指标来源返回的是缓存的旧值，而不是节点确实没有变化
+type staleMetrics struct {
+	// threshold 连续相同多少次时告警，为 0 时不检测
+	threshold int
+	// refresh 告警时是否重新采集一次
+	refresh bool
+
+	// mu 保护 last 和 same，只在比较期间持有，不覆盖采集过程
+	mu   sync.Mutex
+	last *SystemInfo
+	// same 截至 last 连续完全相同的采集次数（包括 last 本身）
+	same int
+}
+
+// sameSystemInfo 判断两次采集结果是否完全相同，有采集失败的指标时不比较
+func sameSystemInfo(a, b SystemInfo) bool {
+	if len(a.Failed) > 0 || len(b.Failed) > 0 {
+		return false
+	}
+	return a.CpuPercent == b.CpuPercent && a.MemPercent == b.MemPercent &&
+		a.DiskPercent == b.DiskPercent && a.Uptime == b.Uptime
+}
+
+// observe 记录一次采集结果并返回连续相同的次数，达到阈值时 stale 为 true，同一段连续相同只返回一次
+func (m *staleMetrics) observe(info SystemInfo) (same int, stale bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.last != nil && sameSystemInfo(*m.last, info) {
+		m.same++
+	} else {
+		m.same = 1
+	}
+	m.last = &info
+	return m.same, m.same == m.threshold
+}
+
+// checkStaleMetrics 检查系统状态是否疑似陈旧，是则记录警告日志；启用 refresh 时重新采集一次，
+// 结果不同时改用新的结果。重新采集时不持有任何锁
+func (s *trafficStatsServerImpl) checkStaleMetrics(info SystemInfo, err error) (SystemInfo, error) {
+	m := &s.staleMetrics
+	if m.threshold <= 0 {
+		return info, err
+	}
+	same, stale := m.observe(info)
+	if !stale {
+		return info, err
+	}
+	s.logger.Println(fmt.Sprintf("警告: 系统状态连续 %d 次采集结果完全相同（运行时间 %d 秒），指标来源可能返回了缓存的旧值",
+		same, info.Uptime))
+	if !m.refresh {
+		return info, err
+	}
+	fresh, freshErr := s.sysInfo()
+	if sameSystemInfo(info, fresh) {
+		s.logger.Println("重新采集的系统状态仍然相同")
+		return info, err
+	}
+	m.observe(fresh)
+	return fresh, freshErr
+}
@@ -0,0 +1,101 @@
+package trafficlogger
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// trafficRecord 流量快照中单个用户的记录
+type trafficRecord struct {
+	id    string
+	entry trafficStatsEntry
+	// firstSeen 本统计周期内首次产生流量的时间，未知时为 nil
+	firstSeen *time.Time
+}
+
+// trafficSnapshot 在短暂持有锁期间复制 StatsMap（clear 为 true 时直接取走并清空，
+// resetOnline 为 true 时同时清除在线状态），结果按用户 ID 排序，编码在锁外进行。调用方需先调用 flushTrafficBuffer
+func (s *trafficStatsServerImpl) trafficSnapshot(clear, resetOnline bool) []trafficRecord {
+	var stats map[string]*trafficStatsEntry
+	var firstSeen map[string]time.Time
+	var records []trafficRecord
+	if clear {
+		s.Mutex.Lock()
+		stats, firstSeen = s.StatsMap, s.firstSeen
+		s.StatsMap = make(map[string]*trafficStatsEntry)
+		s.firstSeen = make(map[string]time.Time)
+		if resetOnline {
+			s.resetOnline()
+		}
+		s.Mutex.Unlock()
+		records = snapshotRecords(stats, firstSeen)
+	} else {
+		s.Mutex.RLock()
+		records = snapshotRecords(s.StatsMap, s.firstSeen)
+		s.Mutex.RUnlock()
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].id < records[j].id })
+	return records
+}
+
+// snapshotRecords 将流量记录复制为切片
+func snapshotRecords(stats map[string]*trafficStatsEntry, firstSeen map[string]time.Time) []trafficRecord {
+	records := make([]trafficRecord, 0, len(stats))
+	for id, e := range stats {
+		rec := trafficRecord{id: id, entry: *e}
+		if t, ok := firstSeen[id]; ok {
+			rec.firstSeen = &t
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// writeTrafficJSON 逐条写出 JSON 对象（用户 ID -> 流量），输出与 json.Marshal 编码 map 相同。
+// detail 为 true 时值为 TrafficDetail
+func writeTrafficJSON(w io.Writer, records []trafficRecord, detail bool) error {
+	bw := bufio.NewWriter(w)
+	_ = bw.WriteByte('{')
+	for i, rec := range records {
+		if i > 0 {
+			_ = bw.WriteByte(',')
+		}
+		key, err := json.Marshal(rec.id)
+		if err != nil {
+			return err
+		}
+		var value any = rec.entry
+		if detail {
+			value = TrafficDetail{Tx: rec.entry.Tx, Rx: rec.entry.Rx, FirstSeen: rec.firstSeen}
+		}
+		val, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, _ = bw.Write(key)
+		_ = bw.WriteByte(':')
+		if _, err := bw.Write(val); err != nil {
+			return err
+		}
+	}
+	_ = bw.WriteByte('}')
+	return bw.Flush()
+}
+
+// writeTrafficCSV 逐行写出带表头的 CSV（id,tx,rx）
+func writeTrafficCSV(w io.Writer, records []trafficRecord) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "tx", "rx"})
+	for _, rec := range records {
+		if err := cw.Write([]string{rec.id, strconv.FormatUint(rec.entry.Tx, 10), strconv.FormatUint(rec.entry.Rx, 10)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,37 @@
+package trafficlogger
+
+// 系统状态的指标名称，用于阈值回调和 SystemStatus.Failed
+const (
+	MetricCPU    = "cpu"
+	MetricMem    = "mem"
+	MetricDisk   = "disk"
+	MetricUptime = "uptime"
+)
+
+// Thresholds 系统状态各项使用率（百分比）的告警阈值，为 0 的项不检查
+type Thresholds struct {
+	CPU  float64
+	Mem  float64
+	Disk float64
+}
+
+// checkThresholds 对超过阈值的每项指标调用 OnThreshold 回调，未设置回调时不做任何事。
+// 调用方不能持有 Mutex
+func (s *trafficStatsServerImpl) checkThresholds(status SystemStatus) {
+	if s.onThreshold == nil {
+		return
+	}
+	for _, m := range []struct {
+		name      string
+		value     float64
+		threshold float64
+	}{
+		{MetricCPU, status.CpuPercent, s.thresholds.CPU},
+		{MetricMem, status.MemPercent, s.thresholds.Mem},
+		{MetricDisk, status.DiskPercent, s.thresholds.Disk},
+	} {
+		if m.threshold > 0 && m.value > m.threshold {
+			s.onThreshold(m.name, m.value)
+		}
+	}
+}
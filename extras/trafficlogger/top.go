@@ -0,0 +1,112 @@
+package trafficlogger
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultTopN = 10
+	maxTopN     = 1000
+)
+
+// TopUser /traffic/top 返回的单个用户流量
+type TopUser struct {
+	ID    string `json:"id"`
+	Tx    uint64 `json:"tx"`
+	Rx    uint64 `json:"rx"`
+	Total uint64 `json:"total"`
+}
+
+// topKey 返回用于排序的流量值
+type topKey func(u TopUser) uint64
+
+func parseTopKey(by string) (topKey, error) {
+	switch by {
+	case "", "total":
+		return func(u TopUser) uint64 { return u.Total }, nil
+	case "tx":
+		return func(u TopUser) uint64 { return u.Tx }, nil
+	case "rx":
+		return func(u TopUser) uint64 { return u.Rx }, nil
+	default:
+		return nil, fmt.Errorf("unsupported sort key %q", by)
+	}
+}
+
+// less 判断 a 是否排在 b 之后：流量较小，或流量相同时 ID 较大，保证结果稳定
+func (k topKey) less(a, b TopUser) bool {
+	ka, kb := k(a), k(b)
+	if ka != kb {
+		return ka < kb
+	}
+	return a.ID > b.ID
+}
+
+// topHeap 小根堆，堆顶为当前前 N 名中排在最后的用户
+type topHeap struct {
+	users []TopUser
+	key   topKey
+}
+
+func (h *topHeap) Len() int           { return len(h.users) }
+func (h *topHeap) Less(i, j int) bool { return h.key.less(h.users[i], h.users[j]) }
+func (h *topHeap) Swap(i, j int)      { h.users[i], h.users[j] = h.users[j], h.users[i] }
+func (h *topHeap) Push(x any)         { h.users = append(h.users, x.(TopUser)) }
+func (h *topHeap) Pop() any {
+	n := len(h.users)
+	u := h.users[n-1]
+	h.users = h.users[:n-1]
+	return u
+}
+
+// topTraffic 在读锁下用大小为 n 的堆选出流量最高的 n 个用户，按流量从高到低返回
+func (s *trafficStatsServerImpl) topTraffic(n int, key topKey) []TopUser {
+	h := &topHeap{users: make([]TopUser, 0, n), key: key}
+	s.flushTrafficBuffer()
+	s.Mutex.RLock()
+	for id, stats := range s.StatsMap {
+		u := TopUser{ID: id, Tx: stats.Tx, Rx: stats.Rx, Total: stats.Tx + stats.Rx}
+		if h.Len() < n {
+			heap.Push(h, u)
+		} else if key.less(h.users[0], u) {
+			h.users[0] = u
+			heap.Fix(h, 0)
+		}
+	}
+	s.Mutex.RUnlock()
+
+	sort.Slice(h.users, func(i, j int) bool { return key.less(h.users[j], h.users[i]) })
+	return h.users
+}
+
+func (s *trafficStatsServerImpl) getTopTraffic(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n := defaultTopN
+	if v := q.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		n = min(n, maxTopN)
+	}
+	key, err := parseTopKey(q.Get("by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jb, err := json.Marshal(s.topTraffic(n, key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jb)
+}
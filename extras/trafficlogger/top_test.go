@@ -0,0 +1,40 @@
+package trafficlogger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopTraffic(t *testing.T) {
+	s := newTestServer()
+	for i := 1; i <= 100; i++ {
+		s.LogTraffic(strconv.Itoa(i), uint64(i), uint64(100-i))
+	}
+	s.LogTraffic("big", 1000, 0)
+
+	key, _ := parseTopKey("tx")
+	assert.Equal(t, []TopUser{
+		{ID: "big", Tx: 1000, Rx: 0, Total: 1000},
+		{ID: "100", Tx: 100, Rx: 0, Total: 100},
+		{ID: "99", Tx: 99, Rx: 1, Total: 100},
+	}, s.topTraffic(3, key))
+
+	key, _ = parseTopKey("rx")
+	top := s.topTraffic(2, key)
+	assert.Equal(t, "1", top[0].ID)
+	assert.Equal(t, "2", top[1].ID)
+
+	assert.Len(t, s.topTraffic(500, key), 101)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/top?n=1", nil))
+	assert.Equal(t, `[{"id":"big","tx":1000,"rx":0,"total":1000}]`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/traffic/top?by=foo", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,138 @@
+package trafficlogger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/apernet/hysteria/extras/v2/utils"
+)
+
+// validator 由可以检查自身配置的提交目标实现
+type validator interface {
+	Validate() error
+}
+
+// Validate 检查各选项的取值，返回所有无效配置项的汇总错误（每项注明对应的选项），
+// 便于嵌入方在启动时尽早失败，而不是让后台定时任务带着错误配置运行
+func (s *trafficStatsServerImpl) Validate() error {
+	var errs []error
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", setting, err))
+		}
+	}
+
+	if s.trafficPushURL != "" {
+		check("WithTrafficPushURL", utils.ValidateHTTPURL(s.trafficPushURL))
+	}
+	if s.systemStatusURL != "" {
+		check("WithSystemStatusURL", utils.ValidateHTTPURL(s.systemStatusURL))
+	}
+	check("WithJitter", utils.ValidateFraction(s.jitter))
+	if s.kickTTL < 0 {
+		check("WithKickTTL", errors.New("must not be negative"))
+	}
+	if s.reconnectGrace < 0 {
+		check("WithReconnectGrace", errors.New("must not be negative"))
+	}
+	if s.idleTimeout < 0 {
+		check("WithIdleTimeout", errors.New("must not be negative"))
+	}
+	if s.requestTimeout < 0 {
+		check("WithRequestTimeout", errors.New("must not be negative"))
+	}
+	if s.slowPushThreshold < 0 {
+		check("WithSlowPushThreshold", errors.New("must not be negative"))
+	}
+	if s.maxPushSize < 0 {
+		check("WithMaxPushSize", errors.New("must not be negative"))
+	}
+	if s.percentPrecision < 0 || s.percentPrecision > 6 {
+		check("WithPercentPrecision", fmt.Errorf("%d is out of range [0, 6]", s.percentPrecision))
+	}
+	if s.querySignature && s.Secret == "" {
+		check("WithQuerySignature", errors.New("requires a secret"))
+	}
+	if s.querySignatureMaxAge < 0 {
+		check("WithQuerySignatureMaxAge", errors.New("must not be negative"))
+	}
+	if s.replayGuard != nil && s.Secret == "" {
+		check("WithReplayProtection", errors.New("requires a secret"))
+	}
+	if s.unknownUserPolicy != UnknownUserSend && s.userProvider == nil {
+		check("WithUnknownUserPolicy", errors.New("requires a user provider"))
+	}
+	if s.pushLimits && s.userProvider == nil {
+		check("WithPushLimits", errors.New("requires a user provider"))
+	}
+	if !strings.HasPrefix(s.indexPath, "/") {
+		check("WithIndexPath", fmt.Errorf("%q must start with /", s.indexPath))
+	}
+	if s.pushMode == PushModeCumulative && s.unknownUserPolicy == UnknownUserBucket {
+		check("WithPushMode", errors.New("cumulative mode cannot be used with the unknown user bucket"))
+	}
+	if s.pushMode == PushModeCumulative && s.granularity > 0 {
+		check("WithGranularity", errors.New("cannot be used with cumulative push mode"))
+	}
+	if s.pushMode == PushModeCumulative && s.maxEntryValue > 0 {
+		check("WithMaxEntryValue", errors.New("cannot be used with cumulative push mode"))
+	}
+	if s.maxEntryValue > 0 && s.granularity > s.maxEntryValue {
+		check("WithMaxEntryValue", errors.New("must not be smaller than the granularity"))
+	}
+	if s.staleMetrics.threshold == 1 {
+		check("WithStaleMetricsDetection", errors.New("threshold must be at least 2"))
+	}
+	if s.onKick != nil && s.onKickBatch != nil {
+		check("WithOnKickBatch", errors.New("cannot be used with WithOnKick"))
+	}
+	if s.backlog.Mode == BacklogSpill && s.backlog.SpillFile == "" {
+		check("WithBacklogPolicy", errors.New("spill mode requires a spill file"))
+	}
+	if s.backlog.MaxSpillSize < 0 || s.backlog.MaxSpillAge < 0 {
+		check("WithBacklogPolicy", errors.New("max spill size and age must not be negative"))
+	}
+	for i, rs := range s.sinks {
+		if v, ok := rs.sink.(validator); ok {
+			check(fmt.Sprintf("WithTrafficSink[%d]", i), v.Validate())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate 检查提交地址是否有效
+func (k *HTTPJSONSink) Validate() error {
+	return utils.ValidateHTTPURL(k.URL)
+}
+
+// Validate 检查写入地址是否有效
+func (k *InfluxDBSink) Validate() error {
+	return utils.ValidateHTTPURL(k.URL)
+}
+
+// Validate 检查地址和频道（主题）是否有效
+func (k *BrokerSink) Validate() error {
+	if k.Kind != BrokerRedis && k.Kind != BrokerNATS {
+		return fmt.Errorf("unsupported broker kind %d", k.Kind)
+	}
+	host, port, err := net.SplitHostPort(k.Addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host in broker address")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q in broker address", port)
+	}
+	if k.Subject == "" {
+		return errors.New("missing subject")
+	}
+	if strings.ContainsAny(k.Subject, " \t\r\n") {
+		return fmt.Errorf("subject %q must not contain whitespace", k.Subject)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package trafficlogger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, newTestServer().Validate())
+	assert.NoError(t, newTestServer(
+		WithSecret("secret"),
+		WithTrafficPushURL("https://panel.example.com/api?act=submit"),
+		WithJitter(0.1),
+		WithQuerySignature(true),
+		WithTrafficSink(&InfluxDBSink{URL: "http://127.0.0.1:8086/api/v2/write"}, false),
+	).Validate())
+
+	err := newTestServer(
+		WithTrafficPushURL("panel.example.com"),
+		WithJitter(2),
+		WithKickTTL(-time.Second),
+		WithQuerySignature(true),
+		WithQuerySignatureMaxAge(-time.Hour),
+		WithReplayProtection(time.Minute),
+		WithUnknownUserPolicy(UnknownUserDrop, 0),
+		WithTrafficSink(&InfluxDBSink{}, false),
+		WithOnKick(func(id, reason string) {}),
+		WithOnKickBatch(func(ids []string, reason string) {}),
+	).Validate()
+	assert.Error(t, err)
+	for _, setting := range []string{
+		"WithTrafficPushURL", "WithJitter", "WithKickTTL", "WithQuerySignature", "WithQuerySignatureMaxAge",
+		"WithReplayProtection", "WithUnknownUserPolicy", "WithTrafficSink[0]", "WithOnKickBatch",
+	} {
+		assert.Contains(t, err.Error(), setting)
+	}
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLimiter prints log lines like fmt.Println, but suppresses identical
+// lines that repeat within a window. The first occurrence is printed right
+// away; repeats are counted and reported as a single "repeated N times"
+// summary by the first Println call after the window has passed. This keeps
+// loops that fail on every tick from flooding the output during a long outage.
+// It is safe for concurrent use.
+type LogLimiter struct {
+	window time.Duration
+	out    io.Writer
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*logLimiterEntry
+}
+
+type logLimiterEntry struct {
+	since      time.Time // when the current window started
+	suppressed int
+}
+
+// NewLogLimiter returns a LogLimiter that writes to stdout and prints each
+// distinct line at most once per window. A window <= 0 disables suppression.
+func NewLogLimiter(window time.Duration) *LogLimiter {
+	return &LogLimiter{
+		window:  window,
+		out:     os.Stdout,
+		now:     time.Now,
+		entries: make(map[string]*logLimiterEntry),
+	}
+}
+
+// Println formats its arguments like fmt.Println and prints the line
+// unless the same line was already printed in the current window.
+func (l *LogLimiter) Println(a ...any) {
+	msg := strings.TrimSuffix(fmt.Sprintln(a...), "\n")
+	if l.window <= 0 {
+		fmt.Fprintln(l.out, msg)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.flush(now)
+	if e, ok := l.entries[msg]; ok {
+		e.suppressed++
+		return
+	}
+	l.entries[msg] = &logLimiterEntry{since: now}
+	fmt.Fprintln(l.out, msg)
+}
+
+// flush reports and forgets the lines whose window has passed.
+// The caller must hold mu.
+func (l *LogLimiter) flush(now time.Time) {
+	for msg, e := range l.entries {
+		if now.Sub(e.since) < l.window {
+			continue
+		}
+		if e.suppressed > 0 {
+			fmt.Fprintf(l.out, "%s (repeated %d times in the last %s)\n", msg, e.suppressed, l.window)
+		}
+		delete(l.entries, msg)
+	}
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Unix(0, 0)
+	l := NewLogLimiter(time.Minute)
+	l.out = &buf
+	l.now = func() time.Time { return now }
+
+	l.Println("Error:", "timeout")
+	l.Println("Error:", "timeout")
+	l.Println("Error:", "timeout")
+	l.Println("other")
+	now = now.Add(time.Minute)
+	l.Println("Error:", "timeout")
+
+	want := "Error: timeout\n" +
+		"other\n" +
+		"Error: timeout (repeated 2 times in the last 1m0s)\n" +
+		"Error: timeout\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("output = %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	l = NewLogLimiter(0)
+	l.out = &buf
+	l.Println("a")
+	l.Println("a")
+	if got := buf.String(); got != "a\na\n" {
+		t.Fatalf("output with suppression disabled = %q", got)
+	}
+}
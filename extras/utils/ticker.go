@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Jitter returns d randomly adjusted by up to ±fraction of d.
+// A fraction <= 0 returns d unchanged.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	spread := time.Duration(float64(d) * fraction)
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + time.Duration(rand.Int63n(int64(2*spread)+1))
+}
+
+// JitterTicker is like time.Ticker, but spreads ticks out to avoid many
+// processes started at the same time from firing in sync.
+// The first tick is delayed by an extra random duration of up to fraction of
+// the interval, and every following interval is adjusted by up to ±fraction.
+// With a fraction <= 0 it behaves like a regular time.Ticker.
+type JitterTicker struct {
+	C <-chan time.Time
+
+	c        chan time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewJitterTicker(interval time.Duration, fraction float64) *JitterTicker {
+	c := make(chan time.Time, 1)
+	t := &JitterTicker{
+		C:    c,
+		c:    c,
+		stop: make(chan struct{}),
+	}
+	first := interval
+	if spread := time.Duration(float64(interval) * fraction); spread > 0 {
+		first += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+	go t.run(first, interval, fraction)
+	return t
+}
+
+func (t *JitterTicker) run(first, interval time.Duration, fraction float64) {
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+	for {
+		select {
+		case now := <-timer.C:
+			// Drop the tick if the receiver is still busy, same as time.Ticker
+			select {
+			case t.c <- now:
+			default:
+			}
+			timer.Reset(Jitter(interval, fraction))
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Stop turns off the ticker. No more ticks will be sent after Stop returns.
+func (t *JitterTicker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	const d = time.Second
+	for i := 0; i < 1000; i++ {
+		j := Jitter(d, 0.2)
+		if j < 800*time.Millisecond || j > 1200*time.Millisecond {
+			t.Fatalf("Jitter(%v, 0.2) = %v, out of range", d, j)
+		}
+	}
+	if j := Jitter(d, 0); j != d {
+		t.Fatalf("Jitter(%v, 0) = %v, want %v", d, j, d)
+	}
+}
+
+func TestJitterTicker(t *testing.T) {
+	ticker := NewJitterTicker(10*time.Millisecond, 0.5)
+	defer ticker.Stop()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ticker.C:
+		case <-time.After(time.Second):
+			t.Fatal("ticker did not fire")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{"1.2.3.4:1000", "", "1.2.3.4"},
+		// Untrusted peers cannot spoof their address
+		{"1.2.3.4:1000", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1000", "5.6.7.8", "5.6.7.8"},
+		// Entries prepended by the client are ignored
+		{"10.0.0.1:1000", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.1:1000", "10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1:1000", "", "10.0.0.1"},
+		{"10.0.0.1:1000", "garbage", "10.0.0.1"},
+		{"[::ffff:10.0.0.1]:1000", "5.6.7.8", "5.6.7.8"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		assert.Equal(t, tt.want, proxies.ClientIP(r), "remote %s xff %q", tt.remote, tt.xff)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1000"
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	assert.Equal(t, "10.0.0.1", TrustedProxies(nil).ClientIP(r))
+
+	_, err = ParseTrustedProxies([]string{"not-a-cidr"})
+	assert.Error(t, err)
+}
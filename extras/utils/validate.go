@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ValidateHTTPURL checks that raw is an absolute http or https URL with a host.
+func ValidateHTTPURL(raw string) error {
+	if raw == "" {
+		return errors.New("empty URL")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host in URL")
+	}
+	return nil
+}
+
+// ValidateFraction checks that f is within [0, 1].
+func ValidateFraction(f float64) error {
+	if f < 0 || f > 1 {
+		return fmt.Errorf("%v is out of range [0, 1]", f)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package utils
+
+import "testing"
+
+func TestValidateHTTPURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://127.0.0.1:8080/api?token=x", false},
+		{"https://panel.example.com", false},
+		{"", true},
+		{"ftp://panel.example.com", true},
+		{"panel.example.com/api", true},
+		{"http://", true},
+		{"http://[::1", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateHTTPURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateHTTPURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateFraction(t *testing.T) {
+	for _, f := range []float64{0, 0.5, 1} {
+		if err := ValidateFraction(f); err != nil {
+			t.Errorf("ValidateFraction(%v) = %v", f, err)
+		}
+	}
+	for _, f := range []float64{-0.1, 1.1} {
+		if err := ValidateFraction(f); err == nil {
+			t.Errorf("ValidateFraction(%v) = nil", f)
+		}
+	}
+}